@@ -0,0 +1,638 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nwaples/rardecode/v2"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+var (
+	archiveMaxEntries     = 100000
+	archiveMaxExtractSize = int64(20 * 1024 * 1024 * 1024)
+	archiveMaxRatio       = int64(1000)
+)
+
+type archiveEntry struct {
+	Name       string
+	Size       int64
+	Packed     int64
+	IsDir      bool
+	IsSymlink  bool
+	LinkTarget string
+	ModTime    time.Time
+}
+
+type archiveOpener func() (io.ReadCloser, error)
+
+func archiveFormat(name string) string {
+	l := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(l, ".zip"):
+		return "zip"
+	case strings.HasSuffix(l, ".tar"):
+		return "tar"
+	case strings.HasSuffix(l, ".tar.gz"), strings.HasSuffix(l, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(l, ".tar.bz2"), strings.HasSuffix(l, ".tbz2"):
+		return "tar.bz2"
+	case strings.HasSuffix(l, ".tar.xz"), strings.HasSuffix(l, ".txz"):
+		return "tar.xz"
+	case strings.HasSuffix(l, ".tar.zst"), strings.HasSuffix(l, ".tzst"):
+		return "tar.zst"
+	case strings.HasSuffix(l, ".7z"):
+		return "7z"
+	case strings.HasSuffix(l, ".rar"):
+		return "rar"
+	}
+	return ""
+}
+
+func archiveStem(name string) string {
+	l := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tar.zst"} {
+		if strings.HasSuffix(l, ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// decodeEntryName converts names written by Chinese Windows tools, which
+// store GBK bytes without setting the zip UTF-8 flag.
+func decodeEntryName(name string) string {
+	if utf8.ValidString(name) {
+		return name
+	}
+	if decoded, err := simplifiedchinese.GB18030.NewDecoder().String(name); err == nil {
+		return decoded
+	}
+	return name
+}
+
+func walkArchive(ctx context.Context, absPath string, fn func(e archiveEntry, open archiveOpener) error) error {
+	switch format := archiveFormat(absPath); format {
+	case "zip":
+		return walkZip(ctx, absPath, fn)
+	case "7z":
+		return walk7z(ctx, absPath, fn)
+	case "rar":
+		return walkRar(ctx, absPath, fn)
+	case "":
+		return fmt.Errorf("不支持的压缩包格式")
+	default:
+		return walkTar(ctx, absPath, format, fn)
+	}
+}
+
+func walkZip(ctx context.Context, absPath string, fn func(e archiveEntry, open archiveOpener) error) error {
+	zr, err := zip.OpenReader(absPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := f.Name
+		if f.Flags&0x800 == 0 {
+			name = decodeEntryName(name)
+		}
+		e := archiveEntry{
+			Name:      strings.ReplaceAll(name, "\\", "/"),
+			Size:      int64(f.UncompressedSize64),
+			Packed:    int64(f.CompressedSize64),
+			IsDir:     f.FileInfo().IsDir(),
+			IsSymlink: f.Mode()&os.ModeSymlink != 0,
+			ModTime:   f.Modified,
+		}
+		if err := fn(e, f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openTarStream(f io.Reader, format string) (io.Reader, func(), error) {
+	switch format {
+	case "tar":
+		return f, func() {}, nil
+	case "tar.gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { _ = gz.Close() }, nil
+	case "tar.bz2":
+		return bzip2.NewReader(f), func() {}, nil
+	case "tar.xz":
+		xr, err := xz.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xr, func() {}, nil
+	case "tar.zst":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return nil, nil, fmt.Errorf("不支持的压缩包格式")
+}
+
+// ctxReader stops reading once ctx is done, so skipping over one huge tar
+// entry does not keep decompressing after the client went away.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func walkTar(ctx context.Context, absPath, format string, fn func(e archiveEntry, open archiveOpener) error) error {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stream, closeStream, err := openTarStream(ctxReader{ctx: ctx, r: f}, format)
+	if err != nil {
+		return err
+	}
+	defer closeStream()
+	tr := tar.NewReader(stream)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+		default:
+			continue
+		}
+		e := archiveEntry{
+			Name:       decodeEntryName(hdr.Name),
+			Size:       hdr.Size,
+			IsDir:      hdr.Typeflag == tar.TypeDir,
+			IsSymlink:  hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink,
+			LinkTarget: hdr.Linkname,
+			ModTime:    hdr.ModTime,
+		}
+		open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+		if err := fn(e, open); err != nil {
+			return err
+		}
+	}
+}
+
+func walk7z(ctx context.Context, absPath string, fn func(e archiveEntry, open archiveOpener) error) error {
+	zr, err := sevenzip.OpenReader(absPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info := f.FileInfo()
+		e := archiveEntry{
+			Name:      strings.ReplaceAll(f.Name, "\\", "/"),
+			Size:      int64(f.UncompressedSize),
+			IsDir:     info.IsDir(),
+			IsSymlink: info.Mode()&os.ModeSymlink != 0,
+			ModTime:   f.Modified,
+		}
+		if err := fn(e, f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkRar(ctx context.Context, absPath string, fn func(e archiveEntry, open archiveOpener) error) error {
+	rr, err := rardecode.OpenReader(absPath)
+	if err != nil {
+		return err
+	}
+	defer rr.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := archiveEntry{
+			Name:      strings.ReplaceAll(hdr.Name, "\\", "/"),
+			Size:      hdr.UnPackedSize,
+			Packed:    hdr.PackedSize,
+			IsDir:     hdr.IsDir,
+			IsSymlink: hdr.Mode()&os.ModeSymlink != 0,
+			ModTime:   hdr.ModificationTime,
+		}
+		open := func() (io.ReadCloser, error) { return io.NopCloser(rr), nil }
+		if err := fn(e, open); err != nil {
+			return err
+		}
+	}
+}
+
+func safeEntryPath(dest, name string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if cleaned == "" {
+		return "", nil
+	}
+	target := filepath.Join(dest, filepath.FromSlash(cleaned))
+	rel, err := filepath.Rel(dest, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("压缩包条目路径非法: %s", name)
+	}
+	return ensurePathInRoot(target)
+}
+
+func uniqueDirPath(absPath string) string {
+	if _, err := os.Lstat(absPath); os.IsNotExist(err) {
+		return absPath
+	}
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", absPath, i)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+func extractArchive(j *Job, absArchive, dest string) (interface{}, error) {
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return nil, err
+	}
+	var entries int
+	var written int64
+	var skipped []string
+	err := walkArchive(j.ctx, absArchive, func(e archiveEntry, open archiveOpener) error {
+		entries++
+		if entries > archiveMaxEntries {
+			return fmt.Errorf("压缩包条目数超过限制（%d）", archiveMaxEntries)
+		}
+		if e.Size > archiveMaxExtractSize-written {
+			return fmt.Errorf("解压后的大小超过限制（%d 字节）", archiveMaxExtractSize)
+		}
+		if e.Packed > 0 && e.Size/e.Packed > archiveMaxRatio {
+			return fmt.Errorf("条目 %s 压缩比异常，疑似压缩炸弹", e.Name)
+		}
+		target, err := safeEntryPath(dest, e.Name)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			return nil
+		}
+		if e.IsSymlink {
+			skipped = append(skipped, e.Name)
+			return nil
+		}
+		if e.IsDir {
+			return os.MkdirAll(target, 0755)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		rc, err := open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		remaining := archiveMaxExtractSize - written
+		n, err := io.Copy(out, io.LimitReader(rc, remaining+1))
+		written += n
+		j.addProgress(1, n)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if n > remaining {
+			return fmt.Errorf("解压后的大小超过限制（%d 字节）", archiveMaxExtractSize)
+		}
+		if !e.ModTime.IsZero() {
+			_ = os.Chtimes(target, e.ModTime, e.ModTime)
+		}
+		return nil
+	})
+	if err != nil {
+		if rmErr := os.RemoveAll(dest); rmErr != nil {
+			log.Printf("清理解压目录失败 %s: %v", dest, rmErr)
+		}
+		return nil, err
+	}
+	relDest, _ := filepath.Rel(rootDir, dest)
+	return map[string]interface{}{
+		"path":    relDest,
+		"entries": entries,
+		"bytes":   written,
+		"skipped": skipped,
+	}, nil
+}
+
+func handleArchiveExtract(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	archivePath := r.FormValue("path")
+	absArchive, err := ensurePathInRoot(archivePath)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if archiveFormat(absArchive) == "" {
+		writeError(w, http.StatusBadRequest, "不支持的压缩包格式")
+		return
+	}
+	if info, err := os.Stat(absArchive); err != nil || info.IsDir() {
+		writeError(w, http.StatusNotFound, "压缩包不存在")
+		return
+	}
+	destParam := r.FormValue("dest")
+	var dest string
+	if destParam == "" {
+		dest = uniqueDirPath(filepath.Join(filepath.Dir(absArchive), archiveStem(filepath.Base(absArchive))))
+	} else {
+		dest, err = ensurePathInRoot(destParam)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, err := os.Lstat(dest); err == nil {
+			writeError(w, http.StatusConflict, "目标目录已存在")
+			return
+		}
+	}
+	relDest, _ := filepath.Rel(rootDir, dest)
+	relArchive, _ := filepath.Rel(rootDir, absArchive)
+	j := startJob(r, "extract", []string{relArchive}, relDest, func(j *Job) (interface{}, error) {
+		return extractArchive(j, absArchive, dest)
+	})
+	writeJSON(w, http.StatusAccepted, snapshotJob(j))
+}
+
+func addToZip(zw *zip.Writer, absPath, name string, info os.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+		_, err := zw.CreateHeader(hdr)
+		return err
+	}
+	hdr.Method = zip.Deflate
+	out, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(absPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, target)
+		return err
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(out, f)
+	return err
+}
+
+func addToTar(tw *tar.Writer, absPath, name string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(absPath)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func createArchive(j *Job, sources []string, dest, format string) (interface{}, error) {
+	var total int64
+	for _, src := range sources {
+		total += pathSize(src)
+	}
+	j.setTotal(total)
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".compress-*")
+	if err != nil {
+		return nil, err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) (interface{}, error) {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return nil, err
+	}
+
+	var add func(absPath, name string, info os.FileInfo) error
+	var finish func() error
+	if format == "zip" {
+		zw := zip.NewWriter(tmp)
+		add = func(absPath, name string, info os.FileInfo) error { return addToZip(zw, absPath, name, info) }
+		finish = zw.Close
+	} else {
+		gz := gzip.NewWriter(tmp)
+		tw := tar.NewWriter(gz)
+		add = func(absPath, name string, info os.FileInfo) error { return addToTar(tw, absPath, name, info) }
+		finish = func() error {
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return gz.Close()
+		}
+	}
+
+	entries := 0
+	for _, src := range sources {
+		base := filepath.Dir(src)
+		err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := j.ctx.Err(); err != nil {
+				return err
+			}
+			if p == tmpName {
+				return nil
+			}
+			if isInternalName(info.Name()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, _ := filepath.Rel(base, p)
+			if err := add(p, filepath.ToSlash(rel), info); err != nil {
+				return err
+			}
+			entries++
+			size := int64(0)
+			if info.Mode().IsRegular() {
+				size = info.Size()
+			}
+			j.addProgress(1, size)
+			return nil
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := finish(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fail(err)
+	}
+	_ = os.Chmod(tmpName, 0644)
+	if _, err := os.Lstat(dest); err == nil {
+		_ = os.Remove(tmpName)
+		return nil, fmt.Errorf("目标文件已存在")
+	}
+	if err := os.Rename(tmpName, dest); err != nil {
+		_ = os.Remove(tmpName)
+		return nil, err
+	}
+	relDest, _ := filepath.Rel(rootDir, dest)
+	return map[string]interface{}{
+		"path":    relDest,
+		"entries": entries,
+	}, nil
+}
+
+func handleArchiveCompress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	paths := r.Form["paths"]
+	if len(paths) == 0 {
+		writeError(w, http.StatusBadRequest, "没有选择要压缩的文件")
+		return
+	}
+	var sources, relSources []string
+	for _, p := range paths {
+		abs, err := ensurePathInRoot(p)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, err := os.Lstat(abs); err != nil {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("路径不存在: %s", p))
+			return
+		}
+		rel, _ := filepath.Rel(rootDir, abs)
+		if rel == "." {
+			writeError(w, http.StatusBadRequest, "不能压缩根目录")
+			return
+		}
+		sources = append(sources, abs)
+		relSources = append(relSources, rel)
+	}
+	dest, err := ensurePathInRoot(r.FormValue("dest"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := archiveFormat(dest)
+	if format != "zip" && format != "tar.gz" {
+		writeError(w, http.StatusBadRequest, "只支持创建 .zip 或 .tar.gz 压缩包")
+		return
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		writeError(w, http.StatusConflict, "目标文件已存在")
+		return
+	}
+	if info, err := os.Stat(filepath.Dir(dest)); err != nil || !info.IsDir() {
+		writeError(w, http.StatusBadRequest, "目标目录不存在")
+		return
+	}
+	relDest, _ := filepath.Rel(rootDir, dest)
+	j := startJob(r, "compress", relSources, relDest, func(j *Job) (interface{}, error) {
+		return createArchive(j, sources, dest, format)
+	})
+	writeJSON(w, http.StatusAccepted, snapshotJob(j))
+}
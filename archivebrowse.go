@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var archiveListCacheSize = 32
+
+type archiveListing struct {
+	modTime int64
+	size    int64
+	entries []FileInfo
+}
+
+var (
+	archiveListMu    sync.Mutex
+	archiveListCache = map[string]*archiveListing{}
+	archiveListOrder []string
+)
+
+var errEntryFound = errors.New("entry found")
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// readArchiveEntries lists an archive, giving up when ctx is cancelled or the
+// archive holds more than archiveMaxEntries entries.
+func readArchiveEntries(ctx context.Context, absPath string, info os.FileInfo) ([]FileInfo, error) {
+	archiveListMu.Lock()
+	cached, ok := archiveListCache[absPath]
+	archiveListMu.Unlock()
+	if ok && cached.modTime == info.ModTime().UnixNano() && cached.size == info.Size() {
+		return cached.entries, nil
+	}
+
+	seen := map[string]bool{}
+	var entries []FileInfo
+	addDir := func(name string, modTime int64) {
+		for dir := name; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+			if seen[dir] {
+				return
+			}
+			seen[dir] = true
+			entries = append(entries, FileInfo{Name: path.Base(dir), Path: dir, IsDir: true, ModTime: modTime})
+		}
+	}
+	count := 0
+	err := walkArchive(ctx, absPath, func(e archiveEntry, _ archiveOpener) error {
+		count++
+		if count > archiveMaxEntries {
+			return fmt.Errorf("压缩包条目数超过限制（%d）", archiveMaxEntries)
+		}
+		name := cleanEntryName(e.Name)
+		if name == "" {
+			return nil
+		}
+		modTime := e.ModTime.Unix()
+		if e.IsDir {
+			addDir(name, modTime)
+			return nil
+		}
+		addDir(path.Dir(name), modTime)
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		entries = append(entries, FileInfo{
+			Name:          path.Base(name),
+			Path:          name,
+			Size:          e.Size,
+			IsSymlink:     e.IsSymlink,
+			ModTime:       modTime,
+			SymlinkTarget: e.LinkTarget,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	archiveListMu.Lock()
+	if _, exists := archiveListCache[absPath]; !exists {
+		archiveListOrder = append(archiveListOrder, absPath)
+	}
+	archiveListCache[absPath] = &archiveListing{modTime: info.ModTime().UnixNano(), size: info.Size(), entries: entries}
+	for len(archiveListOrder) > archiveListCacheSize {
+		delete(archiveListCache, archiveListOrder[0])
+		archiveListOrder = archiveListOrder[1:]
+	}
+	archiveListMu.Unlock()
+	return entries, nil
+}
+
+func openArchiveParam(w http.ResponseWriter, pathParam string) (string, os.FileInfo, bool) {
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", nil, false
+	}
+	if archiveFormat(absPath) == "" {
+		writeError(w, http.StatusBadRequest, "不支持的压缩包格式")
+		return "", nil, false
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || info.IsDir() {
+		writeError(w, http.StatusNotFound, "压缩包不存在")
+		return "", nil, false
+	}
+	return absPath, info, true
+}
+
+func handleArchiveList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "archive/list/")
+	absPath, info, ok := openArchiveParam(w, pathParam)
+	if !ok {
+		return
+	}
+	entries, err := readArchiveEntries(r.Context(), absPath, info)
+	if err != nil {
+		log.Printf("读取压缩包目录失败 %s: %v", pathParam, err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("无法读取压缩包: %v", err))
+		return
+	}
+
+	files := entries
+	dir := cleanEntryName(r.URL.Query().Get("dir"))
+	if r.URL.Query().Get("recursive") != "true" {
+		files = []FileInfo{}
+		for _, e := range entries {
+			parent := path.Dir(e.Path)
+			if parent == "." {
+				parent = ""
+			}
+			if parent == dir {
+				files = append(files, e)
+			}
+		}
+	}
+	if files == nil {
+		files = []FileInfo{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"path":  pathParam,
+		"dir":   dir,
+		"files": files,
+	})
+}
+
+func handleArchiveEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "archive/entry/")
+	absPath, _, ok := openArchiveParam(w, pathParam)
+	if !ok {
+		return
+	}
+	want := cleanEntryName(r.URL.Query().Get("entry"))
+	if want == "" {
+		writeError(w, http.StatusBadRequest, "条目名称不能为空")
+		return
+	}
+
+	err := walkArchive(r.Context(), absPath, func(e archiveEntry, open archiveOpener) error {
+		if e.IsDir || e.IsSymlink || cleanEntryName(e.Name) != want {
+			return nil
+		}
+		rc, err := open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		name := path.Base(want)
+		// The size in the entry header is not trusted, so the length is left
+		// to the stream.
+		w.Header().Set("Content-Type", getContentType(name))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if _, err := io.Copy(w, rc); err != nil {
+			log.Printf("输出压缩包条目失败 %s!%s: %v", pathParam, want, err)
+		}
+		return errEntryFound
+	})
+	if errors.Is(err, errEntryFound) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("无法读取压缩包: %v", err))
+		return
+	}
+	writeError(w, http.StatusNotFound, "压缩包中不存在该条目")
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var batchRenameMaxItems = 5000
+
+const (
+	// renameMaxWidth caps the zero padding of {n:W}.
+	renameMaxWidth = 10
+	// renameMaxNameBytes is the longest file name common file systems accept.
+	renameMaxNameBytes = 255
+)
+
+type BatchRenameRequest struct {
+	Paths      []string `json:"paths"`
+	Find       string   `json:"find"`
+	Replace    string   `json:"replace"`
+	Regex      bool     `json:"regex"`
+	Pattern    string   `json:"pattern"`
+	Start      *int     `json:"start"`
+	Step       int      `json:"step"`
+	DateSource string   `json:"dateSource"`
+	Case       string   `json:"case"`
+	Ext        *string  `json:"ext"`
+	Preview    bool     `json:"preview"`
+}
+
+type BatchRenameItem struct {
+	Path     string `json:"path"`
+	OldName  string `json:"oldName"`
+	NewName  string `json:"newName"`
+	NewPath  string `json:"newPath"`
+	Conflict string `json:"conflict,omitempty"`
+	absOld   string
+	absNew   string
+}
+
+var renameTokenRe = regexp.MustCompile(`\{(name|ext|n|date)(?::([^}]*))?\}`)
+
+func fileDate(absPath, source string) time.Time {
+	if source == "exif" {
+		if info, err := readEXIF(absPath); err == nil {
+			if !info.DateTimeOriginal.IsZero() {
+				return info.DateTimeOriginal
+			}
+			if !info.DateTime.IsZero() {
+				return info.DateTime
+			}
+		}
+	}
+	if info, err := os.Stat(absPath); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+func formatRenameDate(t time.Time, layout string) string {
+	if layout == "" {
+		layout = "YYYYMMDD"
+	}
+	replacer := strings.NewReplacer(
+		"YYYY", fmt.Sprintf("%04d", t.Year()),
+		"MM", fmt.Sprintf("%02d", int(t.Month())),
+		"DD", fmt.Sprintf("%02d", t.Day()),
+		"hh", fmt.Sprintf("%02d", t.Hour()),
+		"mm", fmt.Sprintf("%02d", t.Minute()),
+		"ss", fmt.Sprintf("%02d", t.Second()),
+	)
+	return replacer.Replace(layout)
+}
+
+func applyCase(s, mode string) string {
+	switch mode {
+	case "lower":
+		return strings.ToLower(s)
+	case "upper":
+		return strings.ToUpper(s)
+	case "title":
+		words := strings.Fields(s)
+		for i, w := range words {
+			runes := []rune(strings.ToLower(w))
+			runes[0] = []rune(strings.ToUpper(string(runes[0])))[0]
+			words[i] = string(runes)
+		}
+		return strings.Join(words, " ")
+	}
+	return s
+}
+
+func buildRenamePlan(req *BatchRenameRequest) ([]BatchRenameItem, error) {
+	if len(req.Paths) == 0 {
+		return nil, fmt.Errorf("没有选择要重命名的文件")
+	}
+	if len(req.Paths) > batchRenameMaxItems {
+		return nil, fmt.Errorf("一次最多重命名 %d 个文件", batchRenameMaxItems)
+	}
+	var findRe *regexp.Regexp
+	if req.Find != "" {
+		expr := req.Find
+		if !req.Regex {
+			expr = regexp.QuoteMeta(expr)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("正则表达式无效: %v", err)
+		}
+		findRe = re
+	}
+	pattern := req.Pattern
+	if pattern == "" {
+		pattern = "{name}"
+	}
+	step := req.Step
+	if step == 0 {
+		step = 1
+	}
+	start := 1
+	if req.Start != nil {
+		start = *req.Start
+	}
+
+	items := make([]BatchRenameItem, 0, len(req.Paths))
+	for i, p := range req.Paths {
+		absOld, err := ensurePathInRoot(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		if _, err := os.Lstat(absOld); err != nil {
+			return nil, fmt.Errorf("路径不存在: %s", p)
+		}
+		oldName := filepath.Base(absOld)
+		ext := filepath.Ext(oldName)
+		stem := strings.TrimSuffix(oldName, ext)
+		if findRe != nil {
+			stem = findRe.ReplaceAllString(stem, req.Replace)
+		}
+		seq := start + i*step
+		name := renameTokenRe.ReplaceAllStringFunc(pattern, func(tok string) string {
+			m := renameTokenRe.FindStringSubmatch(tok)
+			switch m[1] {
+			case "name":
+				return stem
+			case "ext":
+				return strings.TrimPrefix(ext, ".")
+			case "n":
+				width, _ := strconv.Atoi(m[2])
+				return fmt.Sprintf("%0*d", min(max(width, 0), renameMaxWidth), seq)
+			case "date":
+				return formatRenameDate(fileDate(absOld, req.DateSource), m[2])
+			}
+			return tok
+		})
+		name = applyCase(name, req.Case)
+		newExt := ext
+		if req.Ext != nil {
+			newExt = strings.TrimPrefix(*req.Ext, ".")
+			if newExt != "" {
+				newExt = "." + newExt
+			}
+		}
+		if req.Case != "" {
+			newExt = applyCase(newExt, req.Case)
+		}
+		newName := name + newExt
+
+		item := BatchRenameItem{
+			Path:    filepath.ToSlash(mustRel(absOld)),
+			OldName: oldName,
+			NewName: newName,
+			absOld:  absOld,
+		}
+		if newName == "" || newName == "." || newName == ".." || strings.ContainsAny(newName, "/\x00") {
+			item.Conflict = "新文件名无效"
+		} else if len(newName) > renameMaxNameBytes {
+			item.Conflict = "新文件名过长"
+		} else if absNew, err := ensurePathInRoot(filepath.Join(filepath.Dir(absOld), newName)); err != nil {
+			item.Conflict = err.Error()
+		} else {
+			item.absNew = absNew
+			item.NewPath = filepath.ToSlash(mustRel(absNew))
+		}
+		items = append(items, item)
+	}
+
+	movingAway := map[string]bool{}
+	targets := map[string]int{}
+	for i, item := range items {
+		if item.Conflict != "" || item.absNew == item.absOld {
+			targets[item.absOld] = i
+			continue
+		}
+		movingAway[item.absOld] = true
+	}
+	for i := range items {
+		item := &items[i]
+		if item.Conflict != "" || item.absNew == item.absOld {
+			continue
+		}
+		if err := checkProtected(item.Path); err != nil {
+			item.Conflict = err.Error()
+			continue
+		}
+		if j, dup := targets[item.absNew]; dup {
+			item.Conflict = "与其他文件的新名称重复"
+			items[j].Conflict = "与其他文件的新名称重复"
+			continue
+		}
+		targets[item.absNew] = i
+		if _, err := os.Lstat(item.absNew); err == nil && !movingAway[item.absNew] {
+			item.Conflict = "目标文件已存在"
+		}
+	}
+	return items, nil
+}
+
+func mustRel(absPath string) string {
+	rel, _ := filepath.Rel(rootDir, absPath)
+	return rel
+}
+
+// applyRenamePlan moves every source to a temporary name first and then to
+// its final name, so swaps and chains work and a failure can be rolled back.
+func applyRenamePlan(items []BatchRenameItem) ([]JournalStep, error) {
+	type move struct{ from, to string }
+	var staged []move
+	var done []move
+	rollback := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			_ = os.Rename(done[i].to, done[i].from)
+		}
+		for i := len(staged) - 1; i >= 0; i-- {
+			_ = os.Rename(staged[i].to, staged[i].from)
+		}
+	}
+
+	token := randomToken(4)
+	var pending []BatchRenameItem
+	for i, item := range items {
+		if item.absNew == item.absOld {
+			continue
+		}
+		tmp := filepath.Join(filepath.Dir(item.absOld), fmt.Sprintf(".batchrename-%s-%d", token, i))
+		if err := os.Rename(item.absOld, tmp); err != nil {
+			rollback()
+			return nil, fmt.Errorf("%s: %v", item.Path, err)
+		}
+		staged = append(staged, move{from: item.absOld, to: tmp})
+		pending = append(pending, item)
+	}
+	var steps []JournalStep
+	for i, item := range pending {
+		if err := os.Rename(staged[i].to, item.absNew); err != nil {
+			rollback()
+			return nil, fmt.Errorf("%s: %v", item.Path, err)
+		}
+		done = append(done, move{from: staged[i].to, to: item.absNew})
+		steps = append(steps, JournalStep{Op: opRename, Path: item.Path, Target: item.NewPath, Inode: inodeOf(item.absNew)})
+	}
+	moves := make(map[string]string, len(pending))
+	for _, item := range pending {
+		moves[item.absOld] = item.absNew
+		invalidateTimeline(item.absOld, item.absNew)
+	}
+	renameFileStats(moves)
+	return steps, nil
+}
+
+func handleBatchRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req BatchRenameRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*1024*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	items, err := buildRenamePlan(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	conflicts := 0
+	for _, item := range items {
+		if item.Conflict != "" {
+			conflicts++
+		}
+	}
+	if req.Preview || conflicts > 0 {
+		status := http.StatusOK
+		if !req.Preview {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, map[string]interface{}{
+			"preview":   true,
+			"conflicts": conflicts,
+			"items":     items,
+		})
+		return
+	}
+	steps, err := applyRenamePlan(items)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("批量重命名失败，已回滚: %v", err))
+		return
+	}
+	if len(steps) > 0 {
+		recordOperation(r, opBatchRename, JournalStep{Op: opBatchRename, Renames: steps})
+	}
+	log.Printf("批量重命名完成: %d 个文件", len(steps))
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "批量重命名成功", Data: items})
+}
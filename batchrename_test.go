@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatRenameDate(t *testing.T) {
+	tm := time.Date(2024, 3, 5, 6, 7, 8, 0, time.UTC)
+	tests := []struct {
+		layout string
+		want   string
+	}{
+		{"", "20240305"},
+		{"YYYY-MM-DD", "2024-03-05"},
+		{"YYYYMMDD_hhmmss", "20240305_060708"},
+		{"DD.MM.YYYY hh.mm", "05.03.2024 06.07"},
+		{"no tokens", "no tokens"},
+	}
+	for _, tt := range tests {
+		if got := formatRenameDate(tm, tt.layout); got != tt.want {
+			t.Errorf("formatRenameDate(%q) = %q, want %q", tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestApplyCase(t *testing.T) {
+	tests := []struct {
+		s, mode, want string
+	}{
+		{"Hello World", "lower", "hello world"},
+		{"Hello World", "upper", "HELLO WORLD"},
+		{"hELLO wORLD", "title", "Hello World"},
+		{"ärger über", "title", "Ärger Über"},
+		{"  spaced   out ", "title", "Spaced Out"},
+		{"", "title", ""},
+		{"Keep Me", "", "Keep Me"},
+		{"Keep Me", "bogus", "Keep Me"},
+	}
+	for _, tt := range tests {
+		if got := applyCase(tt.s, tt.mode); got != tt.want {
+			t.Errorf("applyCase(%q, %q) = %q, want %q", tt.s, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestBuildRenamePlan(t *testing.T) {
+	savedRoot, savedPaths := rootDir, protectedPaths
+	rootDir = t.TempDir()
+	protectedPaths = []string{"photos/keep.txt"}
+	defer func() { rootDir, protectedPaths = savedRoot, savedPaths }()
+
+	mtime := time.Date(2024, 3, 5, 6, 7, 8, 0, time.Local)
+	for _, name := range []string{"IMG_0001.JPG", "IMG_0002.JPG", "a.txt", "b.txt", "1.txt", "2.txt", "keep.txt", "taken.txt"} {
+		p := filepath.Join(rootDir, "photos", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	photos := func(names ...string) []string {
+		for i, n := range names {
+			names[i] = "photos/" + n
+		}
+		return names
+	}
+	ext := func(s string) *string { return &s }
+	start := func(n int) *int { return &n }
+
+	tests := []struct {
+		name      string
+		req       BatchRenameRequest
+		wantErr   string
+		names     []string
+		conflicts []string
+	}{
+		{"padded sequence with defaults", BatchRenameRequest{Paths: photos("IMG_0001.JPG", "IMG_0002.JPG"), Pattern: "trip_{n:3}"}, "",
+			[]string{"trip_001.JPG", "trip_002.JPG"}, nil},
+		{"start and step", BatchRenameRequest{Paths: photos("IMG_0001.JPG", "IMG_0002.JPG"), Pattern: "{n}-{name}", Start: start(10), Step: 5}, "",
+			[]string{"10-IMG_0001.JPG", "15-IMG_0002.JPG"}, nil},
+		{"explicit start 0", BatchRenameRequest{Paths: photos("IMG_0001.JPG", "IMG_0002.JPG"), Pattern: "{n:2}", Start: start(0)}, "",
+			[]string{"00.JPG", "01.JPG"}, nil},
+		{"padding width capped", BatchRenameRequest{Paths: photos("a.txt"), Pattern: "{n:1000000000}"}, "",
+			[]string{"0000000001.txt"}, nil},
+		{"name too long", BatchRenameRequest{Paths: photos("a.txt"), Pattern: strings.Repeat("长", 84)}, "",
+			[]string{strings.Repeat("长", 84) + ".txt"}, []string{"新文件名过长"}},
+		{"literal find", BatchRenameRequest{Paths: photos("IMG_0001.JPG"), Find: "IMG_", Replace: "P"}, "",
+			[]string{"P0001.JPG"}, nil},
+		{"literal find is not a regex", BatchRenameRequest{Paths: photos("a.txt"), Find: ".", Replace: "x"}, "",
+			[]string{"a.txt"}, nil},
+		{"regex with group", BatchRenameRequest{Paths: photos("IMG_0001.JPG"), Find: `^IMG_0*(\d+)$`, Replace: "photo-$1", Regex: true}, "",
+			[]string{"photo-1.JPG"}, nil},
+		{"ext token and lower case", BatchRenameRequest{Paths: photos("IMG_0001.JPG"), Pattern: "{name}_{ext}", Case: "lower"}, "",
+			[]string{"img_0001_jpg.jpg"}, nil},
+		{"title case", BatchRenameRequest{Paths: photos("a.txt"), Pattern: "{name} holiday", Case: "title"}, "",
+			[]string{"A Holiday.txt"}, nil},
+		{"date tokens", BatchRenameRequest{Paths: photos("a.txt"), Pattern: "{date}_{date:hh.mm.ss}_{name}", DateSource: "mtime"}, "",
+			[]string{"20240305_06.07.08_a.txt"}, nil},
+		{"exif date falls back to mtime", BatchRenameRequest{Paths: photos("IMG_0001.JPG"), Pattern: "{date:YYYY-MM-DD}", DateSource: "exif"}, "",
+			[]string{"2024-03-05.JPG"}, nil},
+		{"unknown token kept", BatchRenameRequest{Paths: photos("a.txt"), Pattern: "{size}{name}"}, "",
+			[]string{"{size}a.txt"}, nil},
+		{"new extension", BatchRenameRequest{Paths: photos("a.txt", "b.txt"), Ext: ext(".md")}, "",
+			[]string{"a.md", "b.md"}, nil},
+		{"extension removed", BatchRenameRequest{Paths: photos("a.txt"), Ext: ext("")}, "",
+			[]string{"a"}, nil},
+		{"chain onto a file moving away", BatchRenameRequest{Paths: photos("1.txt", "2.txt"), Pattern: "{n}", Start: start(2)}, "",
+			[]string{"2.txt", "3.txt"}, nil},
+		{"target exists", BatchRenameRequest{Paths: photos("a.txt"), Pattern: "taken"}, "",
+			[]string{"taken.txt"}, []string{"目标文件已存在"}},
+		{"duplicate targets", BatchRenameRequest{Paths: photos("a.txt", "b.txt"), Pattern: "same"}, "",
+			[]string{"same.txt", "same.txt"}, []string{"与其他文件的新名称重复", "与其他文件的新名称重复"}},
+		{"onto a file that stays", BatchRenameRequest{Paths: photos("a.txt", "b.txt"), Find: "b", Replace: "a"}, "",
+			[]string{"a.txt", "a.txt"}, []string{"与其他文件的新名称重复", "与其他文件的新名称重复"}},
+		{"empty name", BatchRenameRequest{Paths: photos("a.txt"), Find: "a", Ext: ext("")}, "",
+			[]string{""}, []string{"新文件名无效"}},
+		{"slash in name", BatchRenameRequest{Paths: photos("a.txt"), Pattern: "x/{name}"}, "",
+			[]string{"x/a.txt"}, []string{"新文件名无效"}},
+		{"protected source", BatchRenameRequest{Paths: photos("keep.txt"), Pattern: "kept"}, "",
+			[]string{"kept.txt"}, []string{"受保护的路径不允许删除或重命名: photos/keep.txt"}},
+		{"invalid regex", BatchRenameRequest{Paths: photos("a.txt"), Find: "(", Regex: true}, "正则表达式无效", nil, nil},
+		{"no paths", BatchRenameRequest{}, "没有选择要重命名的文件", nil, nil},
+		{"missing file", BatchRenameRequest{Paths: photos("gone.txt")}, "路径不存在", nil, nil},
+		{"outside root", BatchRenameRequest{Paths: []string{"../a.txt"}}, "路径不在允许的目录范围内", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := buildRenamePlan(&tt.req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names, conflicts []string
+			for _, item := range items {
+				names = append(names, item.NewName)
+				if item.Conflict != "" {
+					conflicts = append(conflicts, item.Conflict)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("names = %q, want %q", names, tt.names)
+			}
+			if !reflect.DeepEqual(conflicts, tt.conflicts) {
+				t.Errorf("conflicts = %q, want %q", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
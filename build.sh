@@ -66,7 +66,7 @@ build_arch() {
     go build \
         -ldflags "-s -w" \
         -o "$OUTPUT_DIR/$output_name" \
-        main.go
+        .
     
     # 检查构建结果
     if [ ! -f "$OUTPUT_DIR/$output_name" ]; then
@@ -324,7 +324,27 @@ cat > "$OUTPUT_DIR/README.txt" << 'EOF'
 --------
 - 文件上传：支持多文件上传，最大文件大小8G
 - 目录管理：创建、浏览、删除目录
-- 文件操作：重命名、删除文件
+- 文件操作：重命名、移动、删除文件
+- 回收站：删除的文件先移入回收站，支持恢复、彻底删除和自动过期清理
+- 历史版本：覆盖上传时保留旧版本，支持查看、下载和恢复
+- 压缩包：后台解压 zip/tar/7z/rar（自动识别GBK文件名），支持打包为 zip/tar.gz
+- 图片缩略图：文件列表中显示图片缩略图，自动按EXIF方向旋转并缓存
+- 隐私保护：可按目录配置上传时清除 JPEG/PNG/WebP 的 GPS 位置或全部元数据（位置模式下含位置信息的 XMP 和 JPEG 的 IPTC 块会整体移除）
+- 文本预览：日志/配置等文本文件可在线预览，自动识别 UTF-8/GBK/GB18030/UTF-16 编码并支持语法高亮
+- 目录说明：目录中的 README.md / index.md 会渲染显示在文件列表下方
+- 在线编辑：小型文本文件可在线编辑保存，使用 ETag 检测并发修改，支持按模板新建文件
+- 媒体信息：解析 MP3/FLAC/OGG/MP4/MKV 的时长、码率、编码、分辨率、标签和封面
+- 照片时间线：按拍摄日期（EXIF）按月浏览照片，包含GPS坐标便于地图展示
+- OPDS书库：books 目录提供 OPDS 1.2 目录，阅读器可直接浏览、搜索和下载电子书
+- 播放列表：为音乐/视频目录生成 M3U8 或 XSPF 播放列表，可递归、随机，VLC/mpv 可直接播放
+- 订阅源：任意目录可生成 RSS/Atom 订阅，列出最新上传或修改的文件（含下载链接和附件）
+- 分享链接：为文件或目录生成随机令牌外链，支持密码、有效期、下载次数限制、只读浏览、下载记录、撤销和二维码
+- 文件收集：为目录生成上传请求链接，外部用户无需账号即可上传但看不到目录内容，支持密码、有效期、总大小/文件数限制、类型限制和上传者信息
+- 签名链接：HMAC-SHA256 无状态签名 URL，绑定请求方法、路径、查询参数、有效期及可选的大小/类型限制，任意 /api 接口均可凭签名访问（参数须放在已签名的查询字符串中，不接受表单请求体），支持按密钥 ID 轮换
+- 命令行上传：curl -T 直接 PUT/POST 原始内容到 /api/put/<路径>，流式写入，返回路径、大小和 SHA256（终端下输出纯文本）
+- 临时传输：类似 transfer.sh，上传到 transfer 目录后获得随机短链接，可设置保存天数和最大下载次数，附带删除令牌，过期文件由后台自动清理
+- 粘贴板：文本片段保存到 paste 目录，支持语言提示、可选过期时间，提供原始文本和语法高亮两种查看链接
+- 下载统计：按文件统计下载次数、分段播放次数和独立客户端数，目录列表可附带统计，并提供按时间窗口的下载排行
 - 软链接支持：创建和管理软链接
 - 拖拽上传：支持拖拽文件到页面上传
 - 响应式设计：适配不同屏幕尺寸
@@ -404,6 +424,10 @@ A: 修改源码中的rootDir变量，重新编译部署。
 Q: 如何修改最大上传文件大小？
 A: 修改源码中的maxUploadSize变量，重新编译部署。
 
+Q: 如何防止重要目录被误删？
+A: 在源码的protectedPaths（路径）或protectedPatterns（通配符）中添加规则，重新编译部署。
+   超过deleteConfirmMinItems个项目或deleteConfirmMinSize字节的目录需要二次确认才能删除。
+
 使用说明
 --------
 
@@ -418,7 +442,7 @@ A: 修改源码中的maxUploadSize变量，重新编译部署。
    - 右键点击目录可进行重命名或删除操作
 
 3. 文件操作
-   - 右键点击文件可进行重命名或删除操作
+   - 右键点击文件可进行重命名、移动或删除操作
    - 支持按文件名搜索文件
 
 4. 软链接管理
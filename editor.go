@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+var (
+	editMaxSize   = int64(1024 * 1024)
+	fileTemplates = map[string]string{
+		"empty":    "",
+		"markdown": "# 标题\n\n",
+		"shell":    "#!/bin/sh\nset -e\n\n",
+		"json":     "{\n}\n",
+		"yaml":     "# 配置\n",
+	}
+)
+
+var editMu sync.Mutex
+
+type SaveTextRequest struct {
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+}
+
+type SavedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// fileContentETag hashes the whole file; it is only used for files small
+// enough to be edited, so the cost stays bounded.
+func fileContentETag(absPath string) (string, error) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(f, editMaxSize+1)); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`, nil
+}
+
+func encodeText(content, encName string) ([]byte, error) {
+	switch strings.ToUpper(encName) {
+	case "", "UTF-8":
+		return []byte(content), nil
+	case "UTF-8-BOM":
+		return append([]byte{0xEF, 0xBB, 0xBF}, content...), nil
+	case "GBK":
+		return simplifiedchinese.GBK.NewEncoder().Bytes([]byte(content))
+	case "GB18030":
+		return simplifiedchinese.GB18030.NewEncoder().Bytes([]byte(content))
+	case "UTF-16LE":
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes([]byte(content))
+	case "UTF-16BE":
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewEncoder().Bytes([]byte(content))
+	}
+	return nil, fmt.Errorf("不支持的编码: %s", encName)
+}
+
+// writeFileAtomic replaces absPath with data through a temp file in the same
+// directory, keeping the old file's permissions and, if versioned, a history
+// version.
+func writeFileAtomic(absPath string, data []byte, mode os.FileMode, actor string, versioned bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(absPath), ".fileuploader-edit-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		log.Printf("临时文件同步失败 %s: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		log.Printf("设置权限失败 %s: %v", tmp.Name(), err)
+	}
+	var prev *FileVersion
+	if versioned {
+		if prev, err = snapshotVersion(absPath, actor); err != nil && !os.IsNotExist(err) {
+			_ = os.Remove(tmp.Name())
+			return fmt.Errorf("无法保存历史版本: %v", err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), absPath); err != nil {
+		_ = os.Remove(tmp.Name())
+		revertSnapshot(absPath, prev)
+		return err
+	}
+	return nil
+}
+
+// pathWithin reports whether p is base or lies below it.
+func pathWithin(p, base string) bool {
+	rel, err := filepath.Rel(base, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// resolveEditablePath follows a symlinked file to its target so that saving
+// rewrites the target instead of replacing the link with a regular file.
+// Targets are compared with the resolved rootDir, so a rootDir behind a
+// symlink works; links may also point into /mnt, like handleCreateSymlink
+// allows. For such targets the returned relPath is the link's own path and
+// versioned is false: the version store is keyed by the path inside rootDir
+// and lives on the file's own volume, so it cannot hold versions of a file
+// outside rootDir under the link's name.
+func resolveEditablePath(pathParam string) (absPath, relPath string, versioned bool, err error) {
+	absPath, err = ensurePathInRoot(pathParam)
+	if err != nil {
+		return "", "", false, err
+	}
+	relPath, _ = filepath.Rel(rootDir, absPath)
+	relPath = filepath.ToSlash(relPath)
+	resolved, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		if info, lerr := os.Lstat(absPath); lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", "", false, fmt.Errorf("软链接目标不存在")
+		}
+		return absPath, relPath, true, nil
+	}
+	realRoot, err := filepath.EvalSymlinks(rootDir)
+	if err != nil {
+		return "", "", false, err
+	}
+	switch {
+	case pathWithin(resolved, realRoot):
+		rel, _ := filepath.Rel(realRoot, resolved)
+		if absPath, err = ensurePathInRoot(rel); err != nil {
+			return "", "", false, err
+		}
+		return absPath, filepath.ToSlash(rel), true, nil
+	case pathWithin(resolved, "/mnt"):
+		return resolved, relPath, false, nil
+	}
+	return "", "", false, fmt.Errorf("路径不在允许的目录范围内")
+}
+
+func handleFileSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	absPath, relPath, versioned, err := resolveEditablePath(apiPathParam(r, "file/save/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ifMatch := strings.TrimPrefix(strings.TrimSpace(r.Header.Get("If-Match")), "W/")
+	if ifMatch == "" {
+		writeError(w, http.StatusPreconditionRequired, "缺少 If-Match 请求头，请先加载文件再保存")
+		return
+	}
+	if err := checkWritable(relPath); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	var req SaveTextRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, editMaxSize*4+4096)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	data, err := encodeText(req.Content, req.Encoding)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("编码转换失败: %v", err))
+		return
+	}
+	if int64(len(data)) > editMaxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("文件过大，在线编辑最多支持 %d 字节", editMaxSize))
+		return
+	}
+
+	editMu.Lock()
+	defer editMu.Unlock()
+	info, err := os.Stat(absPath)
+	if os.IsNotExist(err) && ifMatch == "*" {
+		// If-Match: * only creates a file that does not exist yet.
+		if dir, err := os.Stat(filepath.Dir(absPath)); err != nil || !dir.IsDir() {
+			writeError(w, http.StatusNotFound, "目录不存在")
+			return
+		}
+		if err := writeFileAtomic(absPath, data, 0644, requestActor(r), versioned); err != nil {
+			log.Printf("保存文件失败 %s: %v", relPath, err)
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("保存文件失败: %v", err))
+			return
+		}
+		etag, _ := fileContentETag(absPath)
+		log.Printf("文件已创建: %s（%d 字节，操作者: %s）", relPath, len(data), requestActor(r))
+		w.Header().Set("ETag", etag)
+		writeJSON(w, http.StatusCreated, SuccessResponse{
+			Message: "文件创建成功",
+			Data:    SavedFile{Path: relPath, Size: int64(len(data)), ETag: etag},
+		})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, "文件不存在")
+		return
+	}
+	if !info.Mode().IsRegular() {
+		writeError(w, http.StatusBadRequest, "只能编辑普通文件")
+		return
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		writeError(w, http.StatusForbidden, "文件为只读，不允许修改")
+		return
+	}
+	if info.Size() > editMaxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("文件过大，在线编辑最多支持 %d 字节", editMaxSize))
+		return
+	}
+	current, err := fileContentETag(absPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("读取文件失败: %v", err))
+		return
+	}
+	if ifMatch == "*" {
+		w.Header().Set("ETag", current)
+		writeError(w, http.StatusPreconditionFailed, "文件已存在，请先加载文件再保存")
+		return
+	}
+	if ifMatch != current {
+		w.Header().Set("ETag", current)
+		writeJSON(w, http.StatusPreconditionFailed, map[string]interface{}{
+			"error": "文件已被其他人修改，请重新加载后再保存",
+			"etag":  current,
+		})
+		return
+	}
+
+	if !versioned {
+		log.Printf("%s 指向 %s，保存时不保留历史版本", relPath, absPath)
+	}
+	if err := writeFileAtomic(absPath, data, info.Mode().Perm(), requestActor(r), versioned); err != nil {
+		log.Printf("保存文件失败 %s: %v", relPath, err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("保存文件失败: %v", err))
+		return
+	}
+	etag, _ := fileContentETag(absPath)
+	log.Printf("文件已保存: %s（%d 字节，操作者: %s）", relPath, len(data), requestActor(r))
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusOK, SuccessResponse{
+		Message: "保存成功",
+		Data:    SavedFile{Path: relPath, Size: int64(len(data)), ETag: etag},
+	})
+}
+
+func handleFileCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		names := make([]string, 0, len(fileTemplates))
+		for name := range fileTemplates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"templates": names,
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		writeError(w, http.StatusBadRequest, "文件名无效")
+		return
+	}
+	tmpl := r.FormValue("template")
+	if tmpl == "" {
+		tmpl = "empty"
+	}
+	content, ok := fileTemplates[tmpl]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("未知的模板: %s", tmpl))
+		return
+	}
+	dirPath, err := ensurePathInRoot(r.FormValue("path"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	absPath, err := ensurePathInRoot(filepath.Join(dirPath, name))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	relPath = filepath.ToSlash(relPath)
+	if err := checkWritable(relPath); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if info, err := os.Stat(dirPath); err != nil || !info.IsDir() {
+		writeError(w, http.StatusNotFound, "目录不存在")
+		return
+	}
+
+	editMu.Lock()
+	defer editMu.Unlock()
+	f, err := os.OpenFile(absPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			writeError(w, http.StatusConflict, "文件已存在")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("创建文件失败: %v", err))
+		return
+	}
+	_, err = f.WriteString(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(absPath)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("创建文件失败: %v", err))
+		return
+	}
+	etag, _ := fileContentETag(absPath)
+	log.Printf("文件已创建: %s（模板: %s）", relPath, tmpl)
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusCreated, SuccessResponse{
+		Message: "文件创建成功",
+		Data:    SavedFile{Path: relPath, Size: int64(len(content)), ETag: etag},
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandleFileSaveThroughSymlink(t *testing.T) {
+	useTempRoots(t)
+	mntDir, err := os.MkdirTemp("/mnt", "fileuploader-test-")
+	if err != nil {
+		t.Skipf("/mnt not writable: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(mntDir) })
+
+	inside := filepath.Join(rootDir, "real.txt")
+	outside := filepath.Join(mntDir, "ext.txt")
+	for _, p := range []string{inside, outside} {
+		if err := os.WriteFile(p, []byte("v1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("real.txt", filepath.Join(rootDir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(rootDir, "ext.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		link      string
+		target    string
+		versioned bool
+	}{
+		{"link inside root", "link.txt", inside, true},
+		{"link into /mnt", "ext.txt", outside, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			etag, err := fileContentETag(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPut, "/api/file/save/"+tt.link, strings.NewReader(`{"content":"v2","encoding":"UTF-8"}`))
+			r.Header.Set("If-Match", etag)
+			w := httptest.NewRecorder()
+			handleFileSave(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if data, err := os.ReadFile(tt.target); err != nil || string(data) != "v2" {
+				t.Errorf("target holds %q, %v", data, err)
+			}
+			if info, err := os.Lstat(filepath.Join(rootDir, tt.link)); err != nil || info.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("link replaced: %v", err)
+			}
+
+			dir, err := versionStoreDir(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = os.Stat(dir)
+			if tt.versioned && err != nil {
+				t.Errorf("no version saved: %v", err)
+			}
+			if !tt.versioned && !os.IsNotExist(err) {
+				t.Errorf("version store created at %s", dir)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+type exifInfo struct {
+	DateTimeOriginal time.Time
+	DateTime         time.Time
+	Orientation      int
+	HasGPS           bool
+	Latitude         float64
+	Longitude        float64
+}
+
+const (
+	exifTagOrientation      = 0x0112
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	exifTagGPSLatitudeRef   = 0x0001
+	exifTagGPSLatitude      = 0x0002
+	exifTagGPSLongitudeRef  = 0x0003
+	exifTagGPSLongitude     = 0x0004
+	exifTagThumbnailOffset  = 0x0201
+	exifTagThumbnailLength  = 0x0202
+)
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func readEXIF(path string) (*exifInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	payload, err := findJPEGExif(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return parseEXIF(payload)
+}
+
+func findJPEGExif(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, fmt.Errorf("不是JPEG文件")
+	}
+	for {
+		marker, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if marker != 0xFF {
+			return nil, fmt.Errorf("JPEG结构损坏")
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if kind == 0xFF {
+			_ = r.UnreadByte()
+			continue
+		}
+		if kind == 0xD8 || (kind >= 0xD0 && kind <= 0xD7) {
+			continue
+		}
+		if kind == 0xDA || kind == 0xD9 {
+			return nil, fmt.Errorf("未找到EXIF信息")
+		}
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(lenBuf[:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("JPEG结构损坏")
+		}
+		if kind != 0xE1 {
+			if _, err := r.Discard(length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seg := make([]byte, length)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:], nil
+		}
+	}
+}
+
+func parseEXIF(tiff []byte) (*exifInfo, error) {
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("EXIF数据过短")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("无效的EXIF字节序")
+	}
+	info := &exifInfo{}
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:8]))
+	if e, ok := ifd0[exifTagOrientation]; ok && len(e.value) >= 2 {
+		info.Orientation = int(order.Uint16(e.value))
+	}
+	if e, ok := ifd0[exifTagDateTime]; ok {
+		info.DateTime = parseEXIFTime(e.value)
+	}
+	if e, ok := ifd0[exifTagExifIFD]; ok && len(e.value) >= 4 {
+		sub := readIFD(tiff, order, order.Uint32(e.value))
+		if e, ok := sub[exifTagDateTimeOriginal]; ok {
+			info.DateTimeOriginal = parseEXIFTime(e.value)
+		}
+	}
+	if e, ok := ifd0[exifTagGPSIFD]; ok && len(e.value) >= 4 {
+		gps := readIFD(tiff, order, order.Uint32(e.value))
+		lat, latOK := gpsCoordinate(gps[exifTagGPSLatitude], order)
+		lon, lonOK := gpsCoordinate(gps[exifTagGPSLongitude], order)
+		if latOK && lonOK {
+			if ref, ok := gps[exifTagGPSLatitudeRef]; ok && strings.HasPrefix(string(ref.value), "S") {
+				lat = -lat
+			}
+			if ref, ok := gps[exifTagGPSLongitudeRef]; ok && strings.HasPrefix(string(ref.value), "W") {
+				lon = -lon
+			}
+			info.HasGPS = true
+			info.Latitude = lat
+			info.Longitude = lon
+		}
+	}
+	return info, nil
+}
+
+// exifThumbnail returns the JPEG preview that cameras store in IFD1, or nil
+// when there is none.
+func exifThumbnail(tiff []byte) []byte {
+	if len(tiff) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	ifd0 := uint64(order.Uint32(tiff[4:8]))
+	if ifd0+2 > uint64(len(tiff)) {
+		return nil
+	}
+	next := ifd0 + 2 + uint64(order.Uint16(tiff[ifd0:]))*12
+	if next+4 > uint64(len(tiff)) {
+		return nil
+	}
+	ifd1 := readIFD(tiff, order, order.Uint32(tiff[next:]))
+	off, ok1 := ifd1[exifTagThumbnailOffset]
+	n, ok2 := ifd1[exifTagThumbnailLength]
+	if !ok1 || !ok2 || len(off.value) < 4 || len(n.value) < 4 {
+		return nil
+	}
+	start, size := uint64(order.Uint32(off.value)), uint64(order.Uint32(n.value))
+	if start+size > uint64(len(tiff)) || !bytes.HasPrefix(tiff[start:start+size], []byte{0xFF, 0xD8}) {
+		return nil
+	}
+	return tiff[start : start+size]
+}
+
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	// Offsets come from the file; compare them in uint64 so that a value
+	// near 4 GiB cannot wrap to a negative int on 32-bit builds.
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	typeSizes := map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	for i := 0; i < count; i++ {
+		pos := uint64(offset) + 2 + uint64(i)*12
+		if pos+12 > uint64(len(tiff)) {
+			break
+		}
+		tag := order.Uint16(tiff[pos:])
+		typ := order.Uint16(tiff[pos+2:])
+		n := order.Uint32(tiff[pos+4:])
+		size, ok := typeSizes[typ]
+		if !ok || n > 1<<20 {
+			continue
+		}
+		total := size * n
+		var value []byte
+		if total <= 4 {
+			value = tiff[pos+8 : pos+8+uint64(total)]
+		} else {
+			start := order.Uint32(tiff[pos+8:])
+			if uint64(start)+uint64(total) > uint64(len(tiff)) {
+				continue
+			}
+			value = tiff[start : start+total]
+		}
+		entries[tag] = tiffEntry{typ: typ, count: n, value: value}
+	}
+	return entries
+}
+
+func parseEXIFTime(value []byte) time.Time {
+	s := strings.TrimRight(string(value), "\x00 ")
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func gpsCoordinate(e tiffEntry, order binary.ByteOrder) (float64, bool) {
+	if e.typ != 5 || e.count < 3 || len(e.value) < 24 {
+		return 0, false
+	}
+	var parts [3]float64
+	for i := range parts {
+		num := order.Uint32(e.value[i*8:])
+		den := order.Uint32(e.value[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	return parts[0] + parts[1]/60 + parts[2]/3600, true
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseEXIF(t *testing.T) {
+	le, be := testTIFF{binary.LittleEndian}, testTIFF{binary.BigEndian}
+	tests := []struct {
+		name     string
+		tiff     []byte
+		wantErr  bool
+		original string
+		modified string
+		ori      int
+		gps      bool
+		lat, lon float64
+	}{
+		{
+			name: "little endian, all fields",
+			tiff: le.build(
+				[]testIFDEntry{le.short(exifTagOrientation, 6), le.ascii(exifTagDateTime, "2024:05:02 08:00:00")},
+				[]testIFDEntry{le.ascii(exifTagDateTimeOriginal, "2024:05:01 10:20:30")},
+				le.gps("N", 31, "E", 121),
+			),
+			original: "2024-05-01 10:20:30", modified: "2024-05-02 08:00:00", ori: 6, gps: true, lat: 31, lon: 121,
+		},
+		{
+			name: "big endian, southern and western",
+			tiff: be.build([]testIFDEntry{be.short(exifTagOrientation, 1)}, nil, be.gps("S", 33, "W", 70)),
+			ori:  1, gps: true, lat: -33, lon: -70,
+		},
+		{
+			name: "minutes and seconds",
+			tiff: le.build(nil, nil, []testIFDEntry{
+				le.ascii(exifTagGPSLatitudeRef, "N"),
+				le.rational(exifTagGPSLatitude, 30, 1, 30, 1, 36, 1),
+				le.ascii(exifTagGPSLongitudeRef, "E"),
+				le.rational(exifTagGPSLongitude, 1205, 10, 0, 1, 0, 1),
+			}),
+			gps: true, lat: 30.51, lon: 120.5,
+		},
+		{
+			name: "zero denominator",
+			tiff: le.build(nil, nil, []testIFDEntry{
+				le.rational(exifTagGPSLatitude, 30, 0, 0, 1, 0, 1),
+				le.rational(exifTagGPSLongitude, 120, 1, 0, 1, 0, 1),
+			}),
+		},
+		{
+			name: "latitude only",
+			tiff: le.build(nil, nil, []testIFDEntry{le.rational(exifTagGPSLatitude, 30, 1, 0, 1, 0, 1)}),
+		},
+		{
+			name: "unparsable date",
+			tiff: le.build(nil, []testIFDEntry{le.ascii(exifTagDateTimeOriginal, "0000:00:00 00:00:00")}, nil),
+		},
+		{name: "bad byte order", tiff: []byte("ZZ*\x00\x08\x00\x00\x00"), wantErr: true},
+		{name: "too short", tiff: []byte("II"), wantErr: true},
+	}
+	format := func(tm time.Time) string {
+		if tm.IsZero() {
+			return ""
+		}
+		return tm.Format("2006-01-02 15:04:05")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parseEXIF(tt.tiff)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEXIF error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := format(info.DateTimeOriginal); got != tt.original {
+				t.Errorf("DateTimeOriginal = %q, want %q", got, tt.original)
+			}
+			if got := format(info.DateTime); got != tt.modified {
+				t.Errorf("DateTime = %q, want %q", got, tt.modified)
+			}
+			if info.Orientation != tt.ori {
+				t.Errorf("Orientation = %d, want %d", info.Orientation, tt.ori)
+			}
+			if info.HasGPS != tt.gps {
+				t.Fatalf("HasGPS = %v, want %v", info.HasGPS, tt.gps)
+			}
+			const eps = 1e-9
+			if d := info.Latitude - tt.lat; d > eps || d < -eps {
+				t.Errorf("Latitude = %v, want %v", info.Latitude, tt.lat)
+			}
+			if d := info.Longitude - tt.lon; d > eps || d < -eps {
+				t.Errorf("Longitude = %v, want %v", info.Longitude, tt.lon)
+			}
+		})
+	}
+}
+
+func TestParseEXIFTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"2023:12:31 23:59:59", "2023-12-31 23:59:59"},
+		{"2023:12:31 23:59:59\x00", "2023-12-31 23:59:59"},
+		{"2023:12:31 23:59:59   ", "2023-12-31 23:59:59"},
+		{"2023-12-31 23:59:59", ""},
+		{"    :  :     :  :  ", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := parseEXIFTime([]byte(tt.value))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("parseEXIFTime(%q) = %v, want zero", tt.value, got)
+			}
+			continue
+		}
+		if got.Location() != time.Local || got.Format("2006-01-02 15:04:05") != tt.want {
+			t.Errorf("parseEXIFTime(%q) = %v, want %s local time", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFindJPEGExif(t *testing.T) {
+	le := testTIFF{binary.LittleEndian}
+	tiff := le.build([]testIFDEntry{le.short(exifTagOrientation, 3)}, nil, nil)
+	exif := jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"first segment", testJPEG(exif), false},
+		{"after APP0 and XMP", testJPEG(jpegSegment(0xE0, []byte("JFIF\x00\x01\x01")), jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"+xmpPlain)), exif), false},
+		{"fill bytes before marker", append([]byte{0xFF, 0xD8, 0xFF, 0xFF}, testJPEG(exif)[2:]...), false},
+		{"no EXIF before scan", testJPEG(jpegSegment(0xE0, []byte("JFIF\x00"))), true},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), true},
+		{"truncated segment", testJPEG(exif)[:20], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findJPEGExif(bufio.NewReader(bytes.NewReader(tt.data)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("findJPEGExif error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, tiff) {
+				t.Errorf("findJPEGExif = %x, want %x", got, tiff)
+			}
+		})
+	}
+}
+
+func TestBuildTimeline(t *testing.T) {
+	// EXIF times are read as local time; with a zone east of UTC, early
+	// morning on the first of a month is still the previous month in UTC.
+	savedLocal, savedRoot := time.Local, rootDir
+	time.Local = time.FixedZone("UTC+8", 8*3600)
+	rootDir = t.TempDir()
+	defer func() { time.Local, rootDir = savedLocal, savedRoot }()
+
+	le := testTIFF{binary.LittleEndian}
+	photo := func(taken string, gps bool) []byte {
+		var g []testIFDEntry
+		if gps {
+			g = le.gps("N", 31, "E", 121)
+		}
+		tiff := le.build(nil, []testIFDEntry{le.ascii(exifTagDateTimeOriginal, taken)}, g)
+		return testJPEG(jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...)))
+	}
+	mtime := time.Date(2023, 7, 15, 12, 0, 0, 0, time.Local)
+	files := []struct {
+		path string
+		data []byte
+	}{
+		{"album/feb-early.jpg", photo("2024:02:01 05:00:00", true)},
+		{"album/jan-late.jpg", photo("2024:01:31 23:30:00", false)},
+		{"album/jan-mid.jpg", photo("2024:01:15 09:00:00", false)},
+		{"album/sub/no-exif.png", []byte("\x89PNG\r\n\x1a\n")},
+		{"album/_h5ai/hidden.jpg", photo("2024:03:01 12:00:00", false)},
+		{"album/notes.txt", []byte("not an image")},
+	}
+	for _, f := range files {
+		p := filepath.Join(rootDir, f.path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := buildTimeline(filepath.Join(rootDir, "album"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMonths := []TimelineMonth{{"2024-02", 1}, {"2024-01", 2}, {"2023-07", 1}}
+	if !reflect.DeepEqual(result.months, wantMonths) {
+		t.Errorf("months = %v, want %v", result.months, wantMonths)
+	}
+	tests := []struct {
+		month  string
+		paths  []string
+		source string
+	}{
+		{"2024-02", []string{"album/feb-early.jpg"}, "exif"},
+		{"2024-01", []string{"album/jan-late.jpg", "album/jan-mid.jpg"}, "exif"},
+		{"2023-07", []string{"album/sub/no-exif.png"}, "mtime"},
+	}
+	for _, tt := range tests {
+		photos := result.byMonth[tt.month]
+		var paths []string
+		for _, p := range photos {
+			paths = append(paths, p.Path)
+			if p.Source != tt.source {
+				t.Errorf("%s: source = %q, want %q", p.Path, p.Source, tt.source)
+			}
+		}
+		if !reflect.DeepEqual(paths, tt.paths) {
+			t.Errorf("%s: photos = %v, want %v", tt.month, paths, tt.paths)
+		}
+	}
+	if feb := result.byMonth["2024-02"]; len(feb) == 1 && (feb[0].Latitude == nil || *feb[0].Latitude != 31) {
+		t.Errorf("GPS not carried into the timeline: %+v", feb[0])
+	}
+
+	again, err := buildTimeline(filepath.Join(rootDir, "album"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != result {
+		t.Error("unchanged directory was not served from the cache")
+	}
+
+	added := filepath.Join(rootDir, "album", "added.jpg")
+	if err := os.WriteFile(added, photo("2024:01:20 10:00:00", false), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalidateTimeline(filepath.Join(rootDir, "elsewhere", "x.jpg"))
+	if again, _ := buildTimeline(filepath.Join(rootDir, "album")); again != result {
+		t.Error("timeline rebuilt within timelineFreshFor without an invalidation")
+	}
+	invalidateTimeline(added)
+	rebuilt, err := buildTimeline(filepath.Join(rootDir, "album"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMonths = []TimelineMonth{{"2024-02", 1}, {"2024-01", 3}, {"2023-07", 1}}
+	if !reflect.DeepEqual(rebuilt.months, wantMonths) {
+		t.Errorf("months after invalidation = %v, want %v", rebuilt.months, wantMonths)
+	}
+}
+
+func TestBuildTimelineSharesWalks(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 50; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.png", i)), []byte("\x89PNG\r\n\x1a\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const n = 8
+	results := make(chan *timelineResult, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			result, err := buildTimeline(dir)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- result
+		}()
+	}
+	first := <-results
+	for i := 1; i < n; i++ {
+		if r := <-results; r != first {
+			t.Error("concurrent requests built separate timelines")
+		}
+	}
+	photoCacheMu.Lock()
+	defer photoCacheMu.Unlock()
+	if len(timelineFlight) != 0 {
+		t.Errorf("walks left in flight: %v", timelineFlight)
+	}
+}
+
+func TestReadIFDOutOfRangeOffsets(t *testing.T) {
+	le := testTIFF{binary.LittleEndian}
+	valid := le.build([]testIFDEntry{le.short(exifTagOrientation, 6)}, nil, nil)
+	huge := func(patch func([]byte)) []byte {
+		b := append([]byte(nil), valid...)
+		patch(b)
+		return b
+	}
+	tests := []struct {
+		name string
+		tiff []byte
+		ori  int
+	}{
+		{"IFD0 at 4 GiB", huge(func(b []byte) { binary.LittleEndian.PutUint32(b[4:], 0xFFFFFFFF) }), 0},
+		{"IFD0 just below 4 GiB", huge(func(b []byte) { binary.LittleEndian.PutUint32(b[4:], 0xFFFFFFF0) }), 0},
+		{"IFD0 on the last byte", huge(func(b []byte) { binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-1)) }), 0},
+		{"EXIF and GPS pointers at 4 GiB", le.build([]testIFDEntry{
+			le.short(exifTagOrientation, 3),
+			le.long(exifTagExifIFD, 0xFFFFFFFF),
+			le.long(exifTagGPSIFD, 0xFFFFFFFE),
+		}, nil, nil), 3},
+		{"entry count past the end", huge(func(b []byte) { binary.LittleEndian.PutUint16(b[8:], 0xFFFF) }), 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parseEXIF(tt.tiff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Orientation != tt.ori || info.HasGPS {
+				t.Errorf("got orientation %d, GPS %v; want %d and no GPS", info.Orientation, info.HasGPS, tt.ori)
+			}
+			if got := readIFD(tt.tiff, binary.LittleEndian, 0xFFFFFFFF); len(got) != 0 {
+				t.Errorf("readIFD at 4 GiB = %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	feedDefaultLimit = 50
+	feedMaxLimit     = 500
+	feedMaxScan      = 100000
+)
+
+type feedItem struct {
+	path    string
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Description string       `xml:"description"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Channel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Description   string    `xml:"description"`
+		LastBuildDate string    `xml:"lastBuildDate"`
+		Items         []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+// recentFiles returns the most recently modified files below absDir,
+// newest first.
+func recentFiles(absDir string, recursive bool, limit int) ([]feedItem, error) {
+	var items []feedItem
+	scanned := 0
+	err := filepath.WalkDir(absDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p == absDir {
+			return nil
+		}
+		if isHiddenName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if scanned++; scanned > feedMaxScan {
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(rootDir, p)
+		items = append(items, feedItem{path: filepath.ToSlash(relPath), name: d.Name(), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].modTime.After(items[j].modTime) })
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func formatFileSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+func handleDirectoryFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "feed/")
+	if pathParam == "" {
+		pathParam = "."
+	}
+	absDir, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+		writeError(w, http.StatusNotFound, "目录不存在")
+		return
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "atom"
+	}
+	if format != "atom" && format != "rss" {
+		writeError(w, http.StatusBadRequest, "format 只能是 atom 或 rss")
+		return
+	}
+	limit := feedDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "参数 limit 无效")
+			return
+		}
+		limit = min(n, feedMaxLimit)
+	}
+	recursive := query.Get("recursive") == "true"
+	items, err := recentFiles(absDir, recursive, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	relDir, _ := filepath.Rel(rootDir, absDir)
+	relDir = filepath.ToSlash(relDir)
+	base := requestBaseURL(r) + apiPrefix(r)
+	title := "fileuploader: /"
+	if relDir != "." {
+		title += relDir
+	}
+	urlDir := relDir
+	if urlDir == "." {
+		urlDir = ""
+	}
+	selfURL := base + "feed/" + escapePath(urlDir)
+	if raw := r.URL.RawQuery; raw != "" {
+		selfURL += "?" + raw
+	}
+	dirURL := base + "directory/list/" + escapePath(urlDir)
+	updated := time.Now()
+	if len(items) > 0 {
+		updated = items[0].modTime
+	}
+	if match := r.Header.Get("If-Modified-Since"); match != "" {
+		if t, err := http.ParseTime(match); err == nil && !updated.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+
+	if format == "rss" {
+		feed := rssFeed{Version: "2.0"}
+		feed.Channel.Title = title
+		feed.Channel.Link = dirURL
+		feed.Channel.Description = "最近添加或修改的文件"
+		feed.Channel.LastBuildDate = updated.Format(time.RFC1123Z)
+		for _, it := range items {
+			link := base + "file/download/" + escapePath(it.path)
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:       it.name,
+				Link:        link,
+				GUID:        rssGUID{IsPermaLink: "false", Value: it.path + "@" + strconv.FormatInt(it.modTime.UnixNano(), 10)},
+				PubDate:     it.modTime.Format(time.RFC1123Z),
+				Description: fmt.Sprintf("%s（%s）", it.path, formatFileSize(it.size)),
+				Enclosure:   rssEnclosure{URL: link, Length: it.size, Type: getContentType(it.name)},
+			})
+		}
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		_, _ = io.WriteString(w, xml.Header)
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(feed); err != nil {
+			log.Printf("输出RSS订阅失败: %v", err)
+		}
+		return
+	}
+
+	feed := newAtomFeed("urn:fileuploader:feed:"+relDir, title)
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	feed.Links = []atomLink{
+		{Rel: "self", Href: selfURL, Type: "application/atom+xml"},
+		{Rel: "alternate", Href: dirURL, Type: "application/json"},
+	}
+	for _, it := range items {
+		link := base + "file/download/" + escapePath(it.path)
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      "urn:fileuploader:file:" + it.path + "@" + strconv.FormatInt(it.modTime.UnixNano(), 10),
+			Title:   it.name,
+			Updated: it.modTime.UTC().Format(time.RFC3339),
+			Summary: fmt.Sprintf("%s（%s）", it.path, formatFileSize(it.size)),
+			Links: []atomLink{
+				{Rel: "alternate", Href: link},
+				{Rel: "enclosure", Href: link, Type: getContentType(it.name), Length: it.size},
+			},
+		})
+	}
+	writeAtom(w, "application/atom+xml", feed)
+}
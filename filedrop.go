@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var fileDropRecentMax = 500
+
+type FileDropUpload struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Uploader string `json:"uploader,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Actor    string `json:"actor"`
+	Time     int64  `json:"time"`
+}
+
+// FileDrop is an upload-request link: outsiders may add files to Path but
+// never see what is already there.
+type FileDrop struct {
+	ID             string           `json:"id"`
+	Path           string           `json:"path"`
+	Message        string           `json:"message,omitempty"`
+	Password       string           `json:"password,omitempty"`
+	HasPassword    bool             `json:"hasPassword"`
+	ExpiresAt      int64            `json:"expiresAt,omitempty"`
+	MaxTotalSize   int64            `json:"maxTotalSize,omitempty"`
+	MaxFiles       int              `json:"maxFiles,omitempty"`
+	AllowedExts    []string         `json:"allowedExts,omitempty"`
+	RequireContact bool             `json:"requireContact"`
+	UsedBytes      int64            `json:"usedBytes"`
+	UsedFiles      int              `json:"usedFiles"`
+	Uploads        []FileDropUpload `json:"uploads,omitempty"`
+	Creator        string           `json:"creator"`
+	Created        int64            `json:"created"`
+	RevokedAt      int64            `json:"revokedAt,omitempty"`
+	Status         string           `json:"status,omitempty"`
+	URL            string           `json:"url,omitempty"`
+}
+
+var (
+	fileDropsMu sync.Mutex
+	fileDrops   = map[string]*FileDrop{}
+)
+
+func fileDropsFile() string {
+	return filepath.Join(appRootDir, "filedrops.json")
+}
+
+func loadFileDrops() {
+	data, err := os.ReadFile(fileDropsFile())
+	if err != nil {
+		return
+	}
+	fileDropsMu.Lock()
+	defer fileDropsMu.Unlock()
+	if err := json.Unmarshal(data, &fileDrops); err != nil {
+		log.Printf("读取文件收集链接失败: %v", err)
+	}
+}
+
+// saveFileDrops must be called with fileDropsMu held.
+func saveFileDrops() error {
+	data, err := json.MarshalIndent(fileDrops, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fileDropsFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileDropsFile())
+}
+
+// releaseFileDropUpload gives back the quota reserved for an upload that
+// could not be stored and drops its record.
+func releaseFileDropUpload(id string, record FileDropUpload) {
+	fileDropsMu.Lock()
+	defer fileDropsMu.Unlock()
+	d, ok := fileDrops[id]
+	if !ok {
+		return
+	}
+	d.UsedFiles = max(d.UsedFiles-1, 0)
+	d.UsedBytes = max(d.UsedBytes-record.Size, 0)
+	for i := len(d.Uploads) - 1; i >= 0; i-- {
+		if d.Uploads[i] == record {
+			d.Uploads = append(d.Uploads[:i], d.Uploads[i+1:]...)
+			break
+		}
+	}
+	if err := saveFileDrops(); err != nil {
+		log.Printf("保存文件收集记录失败: %v", err)
+	}
+}
+
+func fileDropStatus(d *FileDrop) string {
+	switch {
+	case d.RevokedAt != 0:
+		return shareRevoked
+	case d.ExpiresAt != 0 && time.Now().Unix() >= d.ExpiresAt:
+		return shareExpired
+	case d.MaxFiles > 0 && d.UsedFiles >= d.MaxFiles,
+		d.MaxTotalSize > 0 && d.UsedBytes >= d.MaxTotalSize:
+		return shareExhausted
+	}
+	return shareActive
+}
+
+func fileDropView(r *http.Request, d *FileDrop) FileDrop {
+	v := *d
+	v.HasPassword = d.Password != ""
+	v.Password = ""
+	v.Status = fileDropStatus(d)
+	v.URL = requestBaseURL(r) + apiPrefix(r) + "r/" + d.ID
+	v.Uploads = append([]FileDropUpload(nil), d.Uploads...)
+	return v
+}
+
+// checkFileDropFile validates one incoming file against the link's limits
+// without reserving anything.
+func checkFileDropFile(d *FileDrop, name string) error {
+	if len(d.AllowedExts) > 0 {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+		allowed := false
+		for _, e := range d.AllowedExts {
+			if e == ext {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("只允许上传 %s 类型的文件", strings.Join(d.AllowedExts, "、"))
+		}
+	}
+	if isHiddenName(name) {
+		return fmt.Errorf("文件名不允许")
+	}
+	return nil
+}
+
+func parseAllowedExts(v string) []string {
+	var exts []string
+	for _, e := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' || r == ';' }) {
+		e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "."))
+		if e != "" {
+			exts = append(exts, e)
+		}
+	}
+	return exts
+}
+
+func handleFileDropCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	absPath, err := ensurePathInRoot(r.FormValue("path"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	relPath = filepath.ToSlash(relPath)
+	if err := checkWritable(relPath); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if info, err := os.Stat(absPath); err != nil || !info.IsDir() {
+		writeError(w, http.StatusNotFound, "目录不存在")
+		return
+	}
+	expiresAt, err := parseShareExpiry(r.FormValue("expiresAt"), r.FormValue("expiresIn"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		writeError(w, http.StatusBadRequest, "过期时间必须晚于当前时间")
+		return
+	}
+	d := &FileDrop{
+		ID:             randomToken(16),
+		Path:           relPath,
+		Message:        strings.TrimSpace(r.FormValue("message")),
+		ExpiresAt:      expiresAt,
+		AllowedExts:    parseAllowedExts(r.FormValue("allowedExts")),
+		RequireContact: r.FormValue("requireContact") == "true",
+		Creator:        requestActor(r),
+		Created:        time.Now().Unix(),
+	}
+	if v := r.FormValue("maxTotalSize"); v != "" {
+		d.MaxTotalSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || d.MaxTotalSize < 0 {
+			writeError(w, http.StatusBadRequest, "参数 maxTotalSize 无效")
+			return
+		}
+	}
+	if v := r.FormValue("maxFiles"); v != "" {
+		d.MaxFiles, err = strconv.Atoi(v)
+		if err != nil || d.MaxFiles < 0 {
+			writeError(w, http.StatusBadRequest, "参数 maxFiles 无效")
+			return
+		}
+	}
+	if password := r.FormValue("password"); password != "" {
+		if len(password) > sharePasswordMaxLen {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("密码不能超过 %d 字节", sharePasswordMaxLen))
+			return
+		}
+		if d.Password, err = hashSharePassword(password); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法保存文件收集密码: %v", err))
+			return
+		}
+	}
+
+	fileDropsMu.Lock()
+	fileDrops[d.ID] = d
+	err = saveFileDrops()
+	view := fileDropView(r, d)
+	fileDropsMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法保存文件收集链接: %v", err))
+		return
+	}
+	log.Printf("创建文件收集链接: %s -> %s（创建者 %s）", d.ID, d.Path, d.Creator)
+	writeJSON(w, http.StatusCreated, SuccessResponse{Message: "文件收集链接已创建", Data: view})
+}
+
+func handleFileDropList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	filter := strings.Trim(r.URL.Query().Get("path"), "/")
+	fileDropsMu.Lock()
+	list := make([]FileDrop, 0, len(fileDrops))
+	for _, d := range fileDrops {
+		if filter != "" && d.Path != filter && !strings.HasPrefix(d.Path, filter+"/") {
+			continue
+		}
+		list = append(list, fileDropView(r, d))
+	}
+	fileDropsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"drops": list,
+	})
+}
+
+func handleFileDropRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	id := r.FormValue("id")
+	fileDropsMu.Lock()
+	d, ok := fileDrops[id]
+	if !ok {
+		fileDropsMu.Unlock()
+		writeError(w, http.StatusNotFound, "文件收集链接不存在")
+		return
+	}
+	if r.FormValue("delete") == "true" {
+		delete(fileDrops, id)
+	} else if d.RevokedAt == 0 {
+		d.RevokedAt = time.Now().Unix()
+	}
+	err := saveFileDrops()
+	fileDropsMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法保存文件收集链接: %v", err))
+		return
+	}
+	log.Printf("文件收集链接已撤销: %s -> %s（操作者 %s）", d.ID, d.Path, requestActor(r))
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "文件收集链接已撤销"})
+}
+
+var fileDropPageTemplate = template.Must(template.New("drop").Funcs(template.FuncMap{
+	"size": formatFileSize,
+	"date": func(t int64) string { return time.Unix(t, 0).Format("2006-01-02 15:04") },
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>上传文件</title>
+<style>
+body{font-family:-apple-system,"Segoe UI","PingFang SC","Microsoft YaHei",sans-serif;max-width:640px;margin:2em auto;padding:0 1em;color:#222}
+label{display:block;margin:.8em 0 .3em}input{width:100%;box-sizing:border-box;padding:.4em}button{margin-top:1em;padding:.5em 2em}
+.note{color:#666;font-size:.9em}.err{color:#c62828}.ok{color:#2e7d32}
+</style>
+</head>
+<body>
+<h2>上传文件</h2>
+{{with .Drop}}{{if .Message}}<p>{{.Message}}</p>{{end}}{{end}}
+{{range .Stored}}<p class="ok">✔ {{.}}</p>{{end}}
+{{range .Errors}}<p class="err">{{.}}</p>{{end}}
+{{if .Open}}{{with .Drop}}
+<form method="post" enctype="multipart/form-data">
+<label>姓名{{if .RequireContact}}（必填）{{end}}</label><input type="text" name="name" maxlength="100"{{if .RequireContact}} required{{end}}>
+<label>邮箱{{if .RequireContact}}（必填）{{end}}</label><input type="email" name="email" maxlength="200"{{if .RequireContact}} required{{end}}>
+{{if .HasPassword}}<label>密码</label><input type="password" name="password" required>{{end}}
+<label>文件</label><input type="file" name="files" multiple required{{if .AllowedExts}} accept=".{{join .AllowedExts ",."}}"{{end}}>
+<button type="submit">上传</button>
+</form>
+<p class="note">{{if .AllowedExts}}允许的类型：{{join .AllowedExts "、"}}。{{end}}{{if .MaxFiles}}最多 {{.MaxFiles}} 个文件（已收到 {{.UsedFiles}} 个）。{{end}}{{if .MaxTotalSize}}总大小上限 {{size .MaxTotalSize}}（已使用 {{size .UsedBytes}}）。{{end}}{{if .ExpiresAt}}截止时间 {{date .ExpiresAt}}。{{end}}</p>
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+type fileDropPage struct {
+	Drop   *FileDrop
+	Open   bool
+	Stored []string
+	Errors []string
+}
+
+func renderFileDropPage(w http.ResponseWriter, status int, page fileDropPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.WriteHeader(status)
+	if err := fileDropPageTemplate.Execute(w, page); err != nil {
+		log.Printf("渲染文件收集页面失败: %v", err)
+	}
+}
+
+// handleFileDropPublic serves /r/<id> without login: GET shows the upload
+// form (or the limits with ?format=json), POST accepts a multipart upload
+// built like file/upload. Text fields must precede the files: the password and
+// contact details are checked once, at the first file part, and a mismatch
+// fails the request before any content is read.
+func handleFileDropPublic(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(apiPathParam(r, "r/"), "/")
+	jsonOut := wantsShareJSON(r)
+	fail := func(status int, msg string) {
+		if jsonOut {
+			writeError(w, status, msg)
+			return
+		}
+		renderFileDropPage(w, status, fileDropPage{Errors: []string{msg}})
+	}
+
+	fileDropsMu.Lock()
+	d, ok := fileDrops[id]
+	var snapshot FileDrop
+	if ok {
+		snapshot = fileDropView(r, d)
+		snapshot.Uploads = nil
+		snapshot.Password = d.Password
+	}
+	fileDropsMu.Unlock()
+	if !ok {
+		fail(http.StatusNotFound, "文件收集链接不存在")
+		return
+	}
+	switch snapshot.Status {
+	case shareRevoked:
+		fail(http.StatusGone, "文件收集链接已被撤销")
+		return
+	case shareExpired:
+		fail(http.StatusGone, "文件收集链接已过期")
+		return
+	case shareExhausted:
+		fail(http.StatusGone, "文件收集链接已达到上传上限")
+		return
+	}
+	absDir, err := ensurePathInRoot(snapshot.Path)
+	if err != nil {
+		fail(http.StatusNotFound, "目录不存在")
+		return
+	}
+	if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+		fail(http.StatusNotFound, "目录不存在")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if jsonOut {
+			snapshot.Password, snapshot.Path, snapshot.Creator = "", "", ""
+			writeJSON(w, http.StatusOK, snapshot)
+			return
+		}
+		renderFileDropPage(w, http.StatusOK, fileDropPage{Drop: &snapshot, Open: true})
+		return
+	case http.MethodPost:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	headerPassword := r.Header.Get("X-Drop-Password")
+	checkFields := func(fields map[string]string) (int, error) {
+		if snapshot.Password != "" {
+			password := headerPassword
+			if password == "" {
+				password = fields["password"]
+			}
+			if !checkSharePassword(snapshot.Password, password) {
+				return http.StatusUnauthorized, fmt.Errorf("密码错误")
+			}
+		}
+		name := strings.TrimSpace(fields["name"])
+		email := strings.TrimSpace(fields["email"])
+		if snapshot.RequireContact && (name == "" || email == "") {
+			return http.StatusBadRequest, fmt.Errorf("请填写姓名和邮箱")
+		}
+		if email != "" {
+			if _, err := mail.ParseAddress(email); err != nil {
+				return http.StatusBadRequest, fmt.Errorf("邮箱格式无效")
+			}
+		}
+		return 0, nil
+	}
+
+	bodyLimit := maxUploadSize
+	if snapshot.MaxTotalSize > 0 {
+		// Leave room for the multipart framing around the file data.
+		bodyLimit = min(maxUploadSize, snapshot.MaxTotalSize-snapshot.UsedBytes+1024*1024)
+	}
+	accepted, checked := 0, false
+	upload, status, err := readMultipartUpload(w, r, bodyLimit, func(fields map[string]string, fileName string) error {
+		if !checked {
+			if status, err := checkFields(fields); err != nil {
+				return &uploadAbortError{status: status, err: err}
+			}
+			checked = true
+		}
+		if snapshot.MaxFiles > 0 && snapshot.UsedFiles+accepted >= snapshot.MaxFiles {
+			return fmt.Errorf("文件数量超过上限 %d", snapshot.MaxFiles)
+		}
+		if err := checkFileDropFile(&snapshot, fileName); err != nil {
+			return err
+		}
+		accepted++
+		return nil
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			status, err = http.StatusRequestEntityTooLarge, fmt.Errorf("上传内容超过剩余空间")
+		}
+		fail(status, err.Error())
+		return
+	}
+	if !upload.hasFiles {
+		if status, err := checkFields(upload.fields); err != nil {
+			fail(status, err.Error())
+			return
+		}
+		fail(http.StatusBadRequest, "没有找到上传的文件")
+		return
+	}
+
+	uploader := strings.TrimSpace(upload.fields["name"])
+	email := strings.TrimSpace(upload.fields["email"])
+	actor := requestActor(r)
+	stored, _, storeErrors := storeUploadedFiles(r, absDir, upload.files, uploadRename, func(f bufferedFile) (func(), error) {
+		fileDropsMu.Lock()
+		defer fileDropsMu.Unlock()
+		d, ok := fileDrops[id]
+		if !ok || d.RevokedAt != 0 {
+			return nil, fmt.Errorf("文件收集链接已被撤销")
+		}
+		if err := checkWritable(path.Join(d.Path, f.fileName)); err != nil {
+			return nil, err
+		}
+		if d.MaxFiles > 0 && d.UsedFiles >= d.MaxFiles {
+			return nil, fmt.Errorf("文件数量超过上限 %d", d.MaxFiles)
+		}
+		if d.MaxTotalSize > 0 && d.UsedBytes+f.fileSize > d.MaxTotalSize {
+			return nil, fmt.Errorf("总大小超过上限 %s", formatFileSize(d.MaxTotalSize))
+		}
+		d.UsedFiles++
+		d.UsedBytes += f.fileSize
+		record := FileDropUpload{
+			Name:     path.Join(d.Path, f.fileName),
+			Size:     f.fileSize,
+			Uploader: uploader,
+			Email:    email,
+			Actor:    actor,
+			Time:     time.Now().Unix(),
+		}
+		d.Uploads = append(d.Uploads, record)
+		if len(d.Uploads) > fileDropRecentMax {
+			d.Uploads = d.Uploads[len(d.Uploads)-fileDropRecentMax:]
+		}
+		if err := saveFileDrops(); err != nil {
+			log.Printf("保存文件收集记录失败: %v", err)
+		}
+		return func() { releaseFileDropUpload(id, record) }, nil
+	})
+	errorsList := append(upload.errors, storeErrors...)
+	log.Printf("文件收集链接 %s 收到 %d 个文件（上传者 %q <%s>，来自 %s）", id, len(stored), uploader, email, actor)
+
+	status = http.StatusOK
+	if len(stored) == 0 {
+		status = http.StatusBadRequest
+	}
+	if jsonOut {
+		resp := map[string]interface{}{
+			"success": len(errorsList) == 0,
+			"stored":  stored,
+		}
+		if len(errorsList) > 0 {
+			resp["errors"] = errorsList
+		}
+		writeJSON(w, status, resp)
+		return
+	}
+	fileDropsMu.Lock()
+	if d, ok := fileDrops[id]; ok {
+		snapshot = fileDropView(r, d)
+		snapshot.Uploads = nil
+	}
+	fileDropsMu.Unlock()
+	renderFileDropPage(w, status, fileDropPage{
+		Drop:   &snapshot,
+		Open:   fileDropStatus(&snapshot) == shareActive,
+		Stored: stored,
+		Errors: errorsList,
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testPart struct {
+	name, data string
+}
+
+// dropRequest builds a multipart POST to the drop id with fields followed by
+// files, in that order.
+func dropRequest(t *testing.T, id string, fields map[string]string, files ...testPart) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range files {
+		w, err := mw.CreateFormFile("files", f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/r/"+id+"?format=json", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestHandleFileDropPublic(t *testing.T) {
+	useTempRoots(t)
+	savedDrops := fileDrops
+	t.Cleanup(func() { fileDrops = savedDrops })
+	hash, err := hashSharePassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		drop     FileDrop
+		existing map[string]string
+		header   string
+		fields   map[string]string
+		files    []testPart
+		status   int
+		stored   []string
+		want     map[string]string
+		used     int
+	}{
+		{"wrong password stores nothing", FileDrop{Password: hash}, nil, "", map[string]string{"password": "nope"},
+			[]testPart{{"a.txt", "data"}}, http.StatusUnauthorized, nil, map[string]string{}, 0},
+		{"password in the header", FileDrop{Password: hash}, nil, "pw", nil,
+			[]testPart{{"a.txt", "data"}}, http.StatusOK, []string{"a.txt"}, map[string]string{"a.txt": "data"}, 1},
+		{"contact required", FileDrop{RequireContact: true}, nil, "", map[string]string{"name": "Li"},
+			[]testPart{{"a.txt", "data"}}, http.StatusBadRequest, nil, map[string]string{}, 0},
+		{"name clash keeps the existing file", FileDrop{}, map[string]string{"a.txt": "old"}, "", nil,
+			[]testPart{{"a.txt", "new"}}, http.StatusOK, []string{"a.txt"}, map[string]string{"a.txt": "old", "a (1).txt": "new"}, 1},
+		{"file count limit", FileDrop{MaxFiles: 1}, nil, "", nil,
+			[]testPart{{"a.txt", "1"}, {"b.txt", "2"}}, http.StatusOK, []string{"a.txt"}, map[string]string{"a.txt": "1"}, 1},
+		{"size limit", FileDrop{MaxTotalSize: 4}, nil, "", nil,
+			[]testPart{{"a.txt", "12345678"}}, http.StatusBadRequest, nil, map[string]string{}, 0},
+		{"extension filter", FileDrop{AllowedExts: []string{"txt"}}, nil, "", nil,
+			[]testPart{{"a.exe", "MZ"}, {"b.txt", "ok"}}, http.StatusOK, []string{"b.txt"}, map[string]string{"b.txt": "ok"}, 1},
+		{"revoked", FileDrop{RevokedAt: 1}, nil, "", nil,
+			[]testPart{{"a.txt", "data"}}, http.StatusGone, nil, map[string]string{}, 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := string(rune('a' + i))
+			dir := filepath.Join(rootDir, "drop-"+id)
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range tt.existing {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := tt.drop
+			d.ID, d.Path = id, "drop-"+id
+			fileDrops = map[string]*FileDrop{id: &d}
+
+			r := dropRequest(t, id, tt.fields, tt.files...)
+			if tt.header != "" {
+				r.Header.Set("X-Drop-Password", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handleFileDropPublic(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var resp struct {
+				Stored []string `json:"stored"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Stored, tt.stored) {
+				t.Errorf("stored = %q, want %q", resp.Stored, tt.stored)
+			}
+
+			got := map[string]string{}
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				data, _ := os.ReadFile(filepath.Join(dir, e.Name()))
+				got[e.Name()] = string(data)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("directory holds %q, want %q", got, tt.want)
+			}
+			if d.UsedFiles != tt.used || len(d.Uploads) != tt.used {
+				t.Errorf("usedFiles = %d with %d records, want %d", d.UsedFiles, len(d.Uploads), tt.used)
+			}
+		})
+	}
+}
@@ -1,3 +1,33 @@
 module fileuploader
 
 go 1.23.3
+
+require (
+	github.com/alecthomas/chroma/v2 v2.14.0
+	github.com/bodgit/sevenzip v1.6.0
+	github.com/dhowden/tag v0.0.0-20240417053706-3d75831295e8
+	github.com/klauspost/compress v1.17.9
+	github.com/microcosm-cc/bluemonday v1.0.27
+	github.com/nwaples/rardecode/v2 v2.1.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/ulikunitz/xz v0.5.12
+	github.com/yuin/goldmark v1.7.8
+	golang.org/x/crypto v0.24.0
+	golang.org/x/image v0.23.0
+	golang.org/x/text v0.21.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.1.1 // indirect
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/bodgit/plumbing v1.3.0 // indirect
+	github.com/bodgit/windows v1.0.1 // indirect
+	github.com/dlclark/regexp2 v1.11.0 // indirect
+	github.com/gorilla/css v1.0.1 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	go4.org v0.0.0-20200411211856-f5505b9728dd // indirect
+	golang.org/x/net v0.26.0 // indirect
+)
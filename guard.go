@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	protectedPaths        = []string{}
+	protectedPatterns     = []string{}
+	readOnlyPaths         = []string{}
+	deleteConfirmMinItems = 1000
+	deleteConfirmMinSize  = int64(1024 * 1024 * 1024)
+	deleteTokenTTL        = 5 * time.Minute
+)
+
+type DeletePreview struct {
+	Path            string `json:"path"`
+	Items           int    `json:"items"`
+	Bytes           int64  `json:"bytes"`
+	RequiresConfirm bool   `json:"requiresConfirm"`
+	Token           string `json:"token,omitempty"`
+	ExpiresAt       int64  `json:"expiresAt,omitempty"`
+}
+
+type deleteToken struct {
+	path    string
+	expires time.Time
+}
+
+var (
+	deleteTokensMu sync.Mutex
+	deleteTokens   = map[string]deleteToken{}
+)
+
+func matchesProtected(relPath string) bool {
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	for _, p := range protectedPaths {
+		p = strings.Trim(filepath.ToSlash(filepath.Clean(p)), "/")
+		if relPath == p {
+			return true
+		}
+	}
+	base := filepath.Base(relPath)
+	for _, pattern := range protectedPatterns {
+		if ok, _ := filepath.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProtected reports an error when relPath itself is protected or when
+// removing or renaming it would take a protected path along with it. With
+// protectedPatterns set, a directory is walked to find matching descendants.
+func checkProtected(relPath string) error {
+	if matchesProtected(relPath) {
+		return fmt.Errorf("受保护的路径不允许删除或重命名: %s", relPath)
+	}
+	prefix := filepath.ToSlash(filepath.Clean(relPath)) + "/"
+	for _, p := range protectedPaths {
+		p = strings.Trim(filepath.ToSlash(filepath.Clean(p)), "/")
+		if strings.HasPrefix(p, prefix) {
+			return fmt.Errorf("目录中包含受保护的路径: %s", p)
+		}
+	}
+	if len(protectedPatterns) == 0 {
+		return nil
+	}
+	absPath := filepath.Join(rootDir, relPath)
+	if info, err := os.Lstat(absPath); err != nil || !info.IsDir() {
+		return nil
+	}
+	return filepath.WalkDir(absPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil || path == absPath {
+			return nil
+		}
+		rel, _ := filepath.Rel(rootDir, path)
+		if matchesProtected(rel) {
+			return fmt.Errorf("目录中包含受保护的路径: %s", filepath.ToSlash(rel))
+		}
+		return nil
+	})
+}
+
+// checkWritable reports an error when the content of relPath may not be
+// changed: it lies under one of readOnlyPaths or matches protectedPatterns.
+func checkWritable(relPath string) error {
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	for _, p := range readOnlyPaths {
+		p = strings.Trim(filepath.ToSlash(filepath.Clean(p)), "/")
+		if relPath == p || strings.HasPrefix(relPath, p+"/") || p == "." {
+			return fmt.Errorf("只读路径不允许修改: %s", relPath)
+		}
+	}
+	base := filepath.Base(relPath)
+	for _, pattern := range protectedPatterns {
+		if ok, _ := filepath.Match(pattern, relPath); ok {
+			return fmt.Errorf("受保护的文件不允许修改: %s", relPath)
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return fmt.Errorf("受保护的文件不允许修改: %s", relPath)
+		}
+	}
+	return nil
+}
+
+func previewDelete(absPath string) (*DeletePreview, error) {
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	if err := checkProtected(relPath); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	preview := &DeletePreview{Path: relPath}
+	if !info.IsDir() {
+		preview.Items = 1
+		preview.Bytes = info.Size()
+		return preview, nil
+	}
+	err = filepath.Walk(absPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path == absPath {
+			return nil
+		}
+		preview.Items++
+		if !info.IsDir() {
+			preview.Bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if preview.Items >= deleteConfirmMinItems || preview.Bytes >= deleteConfirmMinSize {
+		preview.RequiresConfirm = true
+	}
+	return preview, nil
+}
+
+func issueDeleteToken(preview *DeletePreview) {
+	deleteTokensMu.Lock()
+	defer deleteTokensMu.Unlock()
+	now := time.Now()
+	for token, t := range deleteTokens {
+		if now.After(t.expires) {
+			delete(deleteTokens, token)
+		}
+	}
+	token := randomToken(16)
+	expires := now.Add(deleteTokenTTL)
+	deleteTokens[token] = deleteToken{path: preview.Path, expires: expires}
+	preview.Token = token
+	preview.ExpiresAt = expires.Unix()
+}
+
+func consumeDeleteToken(token, relPath string) bool {
+	deleteTokensMu.Lock()
+	defer deleteTokensMu.Unlock()
+	t, ok := deleteTokens[token]
+	if !ok {
+		return false
+	}
+	delete(deleteTokens, token)
+	return t.path == relPath && time.Now().Before(t.expires)
+}
+
+func handleDeletePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "file/delete-preview/")
+	if pathParam == "" {
+		writeError(w, http.StatusBadRequest, "路径不能为空")
+		return
+	}
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	preview, err := previewDelete(absPath)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("路径不存在: %v", err))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if preview.RequiresConfirm {
+		issueDeleteToken(preview)
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
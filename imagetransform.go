@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	imagePresets = map[string]string{
+		"small":  "w=320&fit=contain&fmt=jpeg&q=75",
+		"medium": "w=800&fit=contain&fmt=jpeg&q=80",
+		"large":  "w=1920&fit=contain&fmt=jpeg&q=85",
+		"web":    "w=800&fit=cover&fmt=jpeg&q=80",
+		"cover":  "w=800&h=450&fit=cover&fmt=jpeg&q=80",
+		"square": "w=400&h=400&fit=cover&fmt=jpeg&q=80",
+		"banner": "w=1200&h=300&fit=cover&gravity=top&fmt=jpeg&q=80",
+		"fill":   "w=640&h=480&fit=fill&fmt=jpeg&q=80",
+		"png":    "w=800&fit=contain&fmt=png",
+	}
+	imageCacheMaxSize = int64(512 * 1024 * 1024)
+)
+
+var imageCache = &diskCache{name: "images", maxSize: imageCacheMaxSize}
+
+type imageTransform struct {
+	Width   int
+	Height  int
+	Fit     string
+	Gravity string
+	Rotate  int
+	Format  string
+	Quality int
+}
+
+var imageTransformKeys = []string{"w", "h", "fit", "gravity", "rotate", "fmt", "q"}
+
+func parseImageTransform(values url.Values) (*imageTransform, error) {
+	t := &imageTransform{Fit: "contain", Gravity: "center", Format: "jpeg", Quality: 80}
+	var err error
+	atoi := func(key string) int {
+		v := values.Get(key)
+		if v == "" || err != nil {
+			return 0
+		}
+		n, convErr := strconv.Atoi(v)
+		if convErr != nil || n < 0 {
+			err = fmt.Errorf("参数 %s 无效", key)
+		}
+		return n
+	}
+	t.Width = atoi("w")
+	t.Height = atoi("h")
+	t.Rotate = atoi("rotate")
+	if q := atoi("q"); q > 0 {
+		t.Quality = q
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v := values.Get("fit"); v != "" {
+		t.Fit = v
+	}
+	if v := values.Get("gravity"); v != "" {
+		t.Gravity = v
+	}
+	if v := values.Get("fmt"); v != "" {
+		t.Format = v
+	}
+	switch t.Fit {
+	case "contain", "cover", "fill":
+	default:
+		return nil, fmt.Errorf("参数 fit 无效")
+	}
+	switch t.Gravity {
+	case "center", "top", "bottom", "left", "right":
+	default:
+		return nil, fmt.Errorf("参数 gravity 无效")
+	}
+	switch t.Format {
+	case "jpeg", "png":
+	default:
+		return nil, fmt.Errorf("参数 fmt 无效")
+	}
+	if t.Rotate%90 != 0 || t.Rotate >= 360 {
+		return nil, fmt.Errorf("参数 rotate 无效")
+	}
+	if t.Fit == "fill" && (t.Width == 0 || t.Height == 0) {
+		return nil, fmt.Errorf("fit=fill 需要同时指定 w 和 h")
+	}
+	if t.Fit == "cover" && t.Width == 0 && t.Height == 0 {
+		return nil, fmt.Errorf("fit=cover 需要指定 w 或 h")
+	}
+	if t.Fit != "cover" {
+		// Gravity only picks the crop window, so drop it to keep one cache
+		// entry per result.
+		t.Gravity = "center"
+	}
+	if t.Format == "png" {
+		t.Quality = 0
+	}
+	return t, nil
+}
+
+func (t *imageTransform) canonical() string {
+	parts := []string{}
+	add := func(k, v string) { parts = append(parts, k+"="+v) }
+	if t.Width > 0 {
+		add("w", strconv.Itoa(t.Width))
+	}
+	if t.Height > 0 {
+		add("h", strconv.Itoa(t.Height))
+	}
+	add("fit", t.Fit)
+	add("gravity", t.Gravity)
+	add("rotate", strconv.Itoa(t.Rotate))
+	add("fmt", t.Format)
+	if t.Quality > 0 {
+		add("q", strconv.Itoa(t.Quality))
+	}
+	return strings.Join(parts, "&")
+}
+
+// resolveImageTransform accepts either ?preset=name or explicit parameters.
+// Size, fit, format and quality must be identical to one of the presets so
+// the cache cannot be flooded with arbitrary sizes; rotate and gravity have
+// only a handful of values and may be combined with any preset.
+func resolveImageTransform(query url.Values) (*imageTransform, error) {
+	values := url.Values{}
+	if name := query.Get("preset"); name != "" {
+		def, ok := imagePresets[name]
+		if !ok {
+			return nil, fmt.Errorf("未知的图片预设: %s", name)
+		}
+		values, _ = url.ParseQuery(def)
+		for _, k := range []string{"rotate", "gravity"} {
+			if v := query.Get(k); v != "" {
+				values.Set(k, v)
+			}
+		}
+		return parseImageTransform(values)
+	}
+	for _, k := range imageTransformKeys {
+		if v := query.Get(k); v != "" {
+			values.Set(k, v)
+		}
+	}
+	t, err := parseImageTransform(values)
+	if err != nil {
+		return nil, err
+	}
+	base := *t
+	base.Rotate, base.Gravity = 0, "center"
+	want := base.canonical()
+	for _, def := range imagePresets {
+		values, _ := url.ParseQuery(def)
+		p, err := parseImageTransform(values)
+		if err != nil {
+			continue
+		}
+		p.Rotate, p.Gravity = 0, "center"
+		if p.canonical() == want {
+			return t, nil
+		}
+	}
+	names := make([]string, 0, len(imagePresets))
+	for name := range imagePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("参数组合不在允许的预设范围内，可用预设: %s", strings.Join(names, ", "))
+}
+
+func cropImage(src *image.RGBA, w, h int, gravity string) *image.RGBA {
+	b := src.Bounds()
+	w, h = min(w, b.Dx()), min(h, b.Dy())
+	x := (b.Dx() - w) / 2
+	y := (b.Dy() - h) / 2
+	switch gravity {
+	case "top":
+		y = 0
+	case "bottom":
+		y = b.Dy() - h
+	case "left":
+		x = 0
+	case "right":
+		x = b.Dx() - w
+	}
+	return src.SubImage(image.Rect(b.Min.X+x, b.Min.Y+y, b.Min.X+x+w, b.Min.Y+y+h)).(*image.RGBA)
+}
+
+func transformImage(absPath, dst string, t *imageTransform) error {
+	img, orientation, err := decodeImageFile(absPath)
+	if err != nil {
+		return err
+	}
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if orientation >= 5 {
+		sw, sh = sh, sw
+	}
+
+	maxW, maxH := t.Width, t.Height
+	if maxW == 0 {
+		maxW = sw
+	}
+	if maxH == 0 {
+		maxH = sh
+	}
+	var rw, rh int
+	cropW, cropH := maxW, maxH
+	switch t.Fit {
+	case "fill":
+		rw, rh = maxW, maxH
+	case "cover":
+		// With only one side given, the other follows the source aspect
+		// ratio and nothing is cropped.
+		if t.Width == 0 {
+			maxW = max(1, int(float64(maxH)*float64(sw)/float64(sh)+0.5))
+		}
+		if t.Height == 0 {
+			maxH = max(1, int(float64(maxW)*float64(sh)/float64(sw)+0.5))
+		}
+		cropW, cropH = maxW, maxH
+		scale := max(float64(maxW)/float64(sw), float64(maxH)/float64(sh))
+		if scale > 1 {
+			// Never upscale; shrink the crop box instead so the aspect ratio holds.
+			cropW, cropH = max(1, int(float64(maxW)/scale)), max(1, int(float64(maxH)/scale))
+			scale = 1
+		}
+		rw, rh = max(1, int(float64(sw)*scale+0.5)), max(1, int(float64(sh)*scale+0.5))
+	default:
+		rw, rh = fitSize(sw, sh, maxW, maxH)
+	}
+	if orientation >= 5 {
+		rw, rh = rh, rw
+	}
+
+	var bg color.Color = color.White
+	if t.Format == "png" {
+		bg = nil
+	}
+	out := orientImage(scaleImage(img, rw, rh, bg), orientation)
+	if t.Fit == "cover" {
+		out = cropImage(out, cropW, cropH, t.Gravity)
+	}
+	switch t.Rotate {
+	case 90:
+		out = orientImage(out, 6)
+	case 180:
+		out = orientImage(out, 3)
+	case 270:
+		out = orientImage(out, 8)
+	}
+
+	if t.Format == "jpeg" {
+		return writeJPEGAtomic(dst, out, t.Quality)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(tmp, out); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func imageCacheDir() string {
+	return imageCache.dir()
+}
+
+func handleImageTransform(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "image/")
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isImageFile(absPath) {
+		writeError(w, http.StatusBadRequest, "不支持的图片格式")
+		return
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || info.IsDir() {
+		writeError(w, http.StatusNotFound, "图片不存在")
+		return
+	}
+	t, err := resolveImageTransform(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	key := cacheKey(relPath, strconv.FormatInt(info.ModTime().UnixNano(), 10), strconv.FormatInt(info.Size(), 10), t.canonical())
+	ext := ".jpg"
+	contentType := "image/jpeg"
+	if t.Format == "png" {
+		ext = ".png"
+		contentType = "image/png"
+	}
+	cachePath := filepath.Join(imageCacheDir(), key[:2], key+ext)
+	if _, err := os.Stat(cachePath); err == nil {
+		imageCache.touch(cachePath)
+	} else {
+		err := runLimited(key, func() error {
+			if _, err := os.Stat(cachePath); err == nil {
+				return nil
+			}
+			if err := transformImage(absPath, cachePath, t); err != nil {
+				return err
+			}
+			if info, err := os.Stat(cachePath); err == nil {
+				imageCache.add(info.Size())
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("图片处理失败 %s: %v", relPath, err)
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+	serveCachedImage(w, r, cachePath, key, contentType)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	jobWorkers    = 2
+	jobKeepFinish = time.Hour
+)
+
+const (
+	jobPending   = "pending"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+type Job struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Status     string      `json:"status"`
+	Source     []string    `json:"source"`
+	Target     string      `json:"target"`
+	Entries    int64       `json:"entries"`
+	Bytes      int64       `json:"bytes"`
+	TotalBytes int64       `json:"totalBytes,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Actor      string      `json:"actor"`
+	CreatedAt  int64       `json:"createdAt"`
+	FinishedAt int64       `json:"finishedAt,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (j *Job) setTotal(bytes int64) {
+	atomic.StoreInt64(&j.TotalBytes, bytes)
+}
+
+func (j *Job) addProgress(entries, bytes int64) {
+	atomic.AddInt64(&j.Entries, entries)
+	atomic.AddInt64(&j.Bytes, bytes)
+}
+
+var (
+	jobsMu  sync.Mutex
+	jobs    = map[string]*Job{}
+	jobSlot = make(chan struct{}, jobWorkers)
+)
+
+func startJob(r *http.Request, kind string, source []string, target string, run func(j *Job) (interface{}, error)) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Job{
+		ID:        randomToken(8),
+		Kind:      kind,
+		Status:    jobPending,
+		Source:    source,
+		Target:    target,
+		Actor:     requestActor(r),
+		CreatedAt: time.Now().Unix(),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	jobsMu.Lock()
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+
+	go func() {
+		defer cancel()
+		select {
+		case jobSlot <- struct{}{}:
+		case <-ctx.Done():
+			finishJob(j, nil, ctx.Err())
+			return
+		}
+		defer func() { <-jobSlot }()
+
+		setJobStatus(j, jobRunning)
+		log.Printf("后台任务开始: %s (%s) %v -> %s", j.ID, j.Kind, j.Source, j.Target)
+		result, err := run(j)
+		finishJob(j, result, err)
+	}()
+	return j
+}
+
+func setJobStatus(j *Job, status string) {
+	jobsMu.Lock()
+	j.Status = status
+	jobsMu.Unlock()
+}
+
+func finishJob(j *Job, result interface{}, err error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j.FinishedAt = time.Now().Unix()
+	switch {
+	case err != nil && j.ctx.Err() != nil:
+		j.Status = jobCancelled
+		j.Error = "任务已取消"
+	case err != nil:
+		j.Status = jobFailed
+		j.Error = err.Error()
+	default:
+		j.Status = jobDone
+		j.Result = result
+	}
+	log.Printf("后台任务结束: %s (%s) 状态=%s %s", j.ID, j.Kind, j.Status, j.Error)
+
+	cutoff := time.Now().Add(-jobKeepFinish).Unix()
+	for id, old := range jobs {
+		if old.FinishedAt != 0 && old.FinishedAt < cutoff {
+			delete(jobs, id)
+		}
+	}
+}
+
+func snapshotJob(j *Job) Job {
+	return Job{
+		ID:         j.ID,
+		Kind:       j.Kind,
+		Status:     j.Status,
+		Source:     j.Source,
+		Target:     j.Target,
+		Entries:    atomic.LoadInt64(&j.Entries),
+		Bytes:      atomic.LoadInt64(&j.Bytes),
+		TotalBytes: atomic.LoadInt64(&j.TotalBytes),
+		Error:      j.Error,
+		Result:     j.Result,
+		Actor:      j.Actor,
+		CreatedAt:  j.CreatedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+func handleJobList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	jobsMu.Lock()
+	list := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, snapshotJob(j))
+	}
+	jobsMu.Unlock()
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt > list[b].CreatedAt
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jobs": list,
+	})
+}
+
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id := apiPathParam(r, "job/status/")
+	jobsMu.Lock()
+	j, ok := jobs[id]
+	var snap Job
+	if ok {
+		snap = snapshotJob(j)
+	}
+	jobsMu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "任务不存在")
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+func handleJobCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	jobsMu.Lock()
+	j, ok := jobs[r.FormValue("id")]
+	jobsMu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "任务不存在")
+		return
+	}
+	j.cancel()
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "已请求取消任务"})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var journalMaxEntries = 100
+
+const (
+	opRename = "rename"
+	opMove   = "move"
+	// opBatchRename groups the renames of one batch so that undo can replay
+	// them through the same staging as the batch itself.
+	opBatchRename = "batch-rename"
+	opMkdir       = "mkdir"
+	opDelete      = "delete"
+	opSymlink     = "symlink"
+)
+
+type JournalStep struct {
+	Op      string        `json:"op"`
+	Path    string        `json:"path"`
+	Target  string        `json:"target,omitempty"`
+	TrashID string        `json:"trashId,omitempty"`
+	Inode   uint64        `json:"inode,omitempty"`
+	Renames []JournalStep `json:"renames,omitempty"`
+}
+
+type JournalEntry struct {
+	ID     string        `json:"id"`
+	Op     string        `json:"op"`
+	Steps  []JournalStep `json:"steps"`
+	Actor  string        `json:"actor"`
+	Time   int64         `json:"time"`
+	Undone bool          `json:"undone"`
+}
+
+var (
+	journalMu      sync.Mutex
+	journalEntries []JournalEntry
+)
+
+func journalFile() string {
+	return filepath.Join(appRootDir, "journal.json")
+}
+
+func loadJournal() {
+	data, err := os.ReadFile(journalFile())
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &journalEntries); err != nil {
+		log.Printf("读取操作日志失败: %v", err)
+	}
+}
+
+func saveJournal() {
+	data, err := json.MarshalIndent(journalEntries, "", "  ")
+	if err != nil {
+		log.Printf("保存操作日志失败: %v", err)
+		return
+	}
+	tmp := journalFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("保存操作日志失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, journalFile()); err != nil {
+		log.Printf("保存操作日志失败: %v", err)
+	}
+}
+
+func inodeOf(absPath string) uint64 {
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return 0
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+func recordOperation(r *http.Request, op string, steps ...JournalStep) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	journalEntries = append(journalEntries, JournalEntry{
+		ID:    randomToken(8),
+		Op:    op,
+		Steps: steps,
+		Actor: requestActor(r),
+		Time:  time.Now().Unix(),
+	})
+	if len(journalEntries) > journalMaxEntries {
+		journalEntries = journalEntries[len(journalEntries)-journalMaxEntries:]
+	}
+	saveJournal()
+}
+
+// batchUndoPlan turns the renames of a batch step into a plan that moves
+// every target back to its original path.
+func batchUndoPlan(step JournalStep, reverse bool) ([]BatchRenameItem, error) {
+	items := make([]BatchRenameItem, 0, len(step.Renames))
+	for _, rn := range step.Renames {
+		absPath, err := ensurePathInRoot(rn.Path)
+		if err != nil {
+			return nil, err
+		}
+		absTarget, err := ensurePathInRoot(rn.Target)
+		if err != nil {
+			return nil, err
+		}
+		if reverse {
+			items = append(items, BatchRenameItem{Path: rn.Path, NewPath: rn.Target, absOld: absPath, absNew: absTarget})
+		} else {
+			items = append(items, BatchRenameItem{Path: rn.Target, NewPath: rn.Path, absOld: absTarget, absNew: absPath})
+		}
+	}
+	return items, nil
+}
+
+func checkBatchUndo(step JournalStep) error {
+	freed := map[string]bool{}
+	for _, rn := range step.Renames {
+		freed[rn.Target] = true
+	}
+	for _, rn := range step.Renames {
+		absTarget, err := ensurePathInRoot(rn.Target)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(absTarget); err != nil {
+			return fmt.Errorf("%s 已不存在", rn.Target)
+		}
+		if rn.Inode != 0 && inodeOf(absTarget) != rn.Inode {
+			return fmt.Errorf("%s 已被其他文件替换", rn.Target)
+		}
+		if err := checkProtected(rn.Target); err != nil {
+			return err
+		}
+		absPath, err := ensurePathInRoot(rn.Path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(absPath); err == nil && !freed[rn.Path] {
+			return fmt.Errorf("%s 已存在", rn.Path)
+		}
+	}
+	return nil
+}
+
+func checkUndoStep(step JournalStep) error {
+	if step.Op == opBatchRename {
+		return checkBatchUndo(step)
+	}
+	absPath, err := ensurePathInRoot(step.Path)
+	if err != nil {
+		return err
+	}
+	switch step.Op {
+	case opRename, opMove:
+		absTarget, err := ensurePathInRoot(step.Target)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(absTarget); err != nil {
+			return fmt.Errorf("%s 已不存在", step.Target)
+		}
+		if err := checkProtected(step.Target); err != nil {
+			return err
+		}
+		if step.Inode != 0 && inodeOf(absTarget) != step.Inode {
+			return fmt.Errorf("%s 已被其他文件替换", step.Target)
+		}
+		if _, err := os.Lstat(absPath); err == nil {
+			return fmt.Errorf("%s 已存在", step.Path)
+		}
+	case opMkdir:
+		entries, err := os.ReadDir(absPath)
+		if err != nil {
+			return fmt.Errorf("目录 %s 已不存在", step.Path)
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("目录 %s 不为空", step.Path)
+		}
+		if err := checkProtected(step.Path); err != nil {
+			return err
+		}
+	case opSymlink:
+		target, err := os.Readlink(absPath)
+		if err != nil || target != step.Target {
+			return fmt.Errorf("软链接 %s 已被修改", step.Path)
+		}
+		if err := checkProtected(step.Path); err != nil {
+			return err
+		}
+	case opDelete:
+		if _, err := findTrashItem(step.TrashID); err != nil {
+			return fmt.Errorf("回收站中已找不到 %s", step.Path)
+		}
+		if _, err := os.Lstat(absPath); err == nil {
+			return fmt.Errorf("%s 已存在", step.Path)
+		}
+	default:
+		return fmt.Errorf("不支持撤销的操作: %s", step.Op)
+	}
+	return nil
+}
+
+func undoStep(step JournalStep, actor string) error {
+	if step.Op == opBatchRename {
+		items, err := batchUndoPlan(step, false)
+		if err != nil {
+			return err
+		}
+		_, err = applyRenamePlan(items)
+		return err
+	}
+	absPath, err := ensurePathInRoot(step.Path)
+	if err != nil {
+		return err
+	}
+	switch step.Op {
+	case opRename, opMove:
+		absTarget, err := ensurePathInRoot(step.Target)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(absTarget, absPath); err != nil {
+			return err
+		}
+		renameFileStats(map[string]string{absTarget: absPath})
+		invalidateTimeline(absTarget, absPath)
+		return nil
+	case opMkdir:
+		return os.Remove(absPath)
+	case opSymlink:
+		return os.Remove(absPath)
+	case opDelete:
+		item, err := findTrashItem(step.TrashID)
+		if err != nil {
+			return err
+		}
+		_, err = restoreTrashItem(item, "", actor)
+		return err
+	}
+	return fmt.Errorf("不支持撤销的操作: %s", step.Op)
+}
+
+// redoStep re-applies a step that undoStep already reverted. It is only used
+// to roll back a partially failed undo, so the state was just checked.
+func redoStep(step *JournalStep, actor string) error {
+	if step.Op == opBatchRename {
+		items, err := batchUndoPlan(*step, true)
+		if err != nil {
+			return err
+		}
+		_, err = applyRenamePlan(items)
+		return err
+	}
+	absPath, err := ensurePathInRoot(step.Path)
+	if err != nil {
+		return err
+	}
+	switch step.Op {
+	case opRename, opMove:
+		absTarget, err := ensurePathInRoot(step.Target)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(absPath, absTarget); err != nil {
+			return err
+		}
+		renameFileStats(map[string]string{absPath: absTarget})
+		invalidateTimeline(absPath, absTarget)
+		return nil
+	case opMkdir:
+		return os.Mkdir(absPath, 0755)
+	case opSymlink:
+		return os.Symlink(step.Target, absPath)
+	case opDelete:
+		item, err := moveToTrash(absPath, actor)
+		if err != nil {
+			return err
+		}
+		step.TrashID = item.ID
+		return nil
+	}
+	return fmt.Errorf("不支持重做的操作: %s", step.Op)
+}
+
+func undoOperation(id, actor string) (*JournalEntry, error) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	index := -1
+	for i := len(journalEntries) - 1; i >= 0; i-- {
+		if journalEntries[i].Undone {
+			continue
+		}
+		if id == "" || journalEntries[i].ID == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, os.ErrNotExist
+	}
+	entry := &journalEntries[index]
+	for _, step := range entry.Steps {
+		if err := checkUndoStep(step); err != nil {
+			return nil, fmt.Errorf("文件状态已变化，无法撤销: %v", err)
+		}
+	}
+	for i := len(entry.Steps) - 1; i >= 0; i-- {
+		if err := undoStep(entry.Steps[i], actor); err != nil {
+			// Put back what was already undone so the entry stays consistent.
+			for j := i + 1; j < len(entry.Steps); j++ {
+				if redoErr := redoStep(&entry.Steps[j], actor); redoErr != nil {
+					log.Printf("撤销回滚失败 %s: %v", entry.Steps[j].Path, redoErr)
+				}
+			}
+			saveJournal()
+			return nil, fmt.Errorf("撤销失败，已回滚: %v", err)
+		}
+	}
+	entry.Undone = true
+	saveJournal()
+	log.Printf("已撤销操作: %s (%s, 操作者: %s)", entry.ID, entry.Op, actor)
+	return entry, nil
+}
+
+func handleJournalList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	journalMu.Lock()
+	entries := make([]JournalEntry, 0, len(journalEntries))
+	for i := len(journalEntries) - 1; i >= 0; i-- {
+		entries = append(entries, journalEntries[i])
+	}
+	journalMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+	})
+}
+
+func handleJournalUndo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	entry, err := undoOperation(r.FormValue("id"), requestActor(r))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "没有可撤销的操作")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "撤销成功", Data: entry})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalUndo(t *testing.T) {
+	useTempTrash(t)
+	savedEntries := journalEntries
+	journalEntries = nil
+	t.Cleanup(func() { journalEntries = savedEntries })
+	writeTestFiles(t, map[string]string{"a.txt": "data"})
+
+	exists := func(relPath string) bool {
+		_, err := os.Lstat(filepath.Join(rootDir, filepath.FromSlash(relPath)))
+		return err == nil
+	}
+	ops := []struct {
+		name string
+		do   func() int
+	}{
+		{"mkdir", func() int {
+			return postForm(handleCreateDirectory, "/api/directory/create", url.Values{"parentPath": {"."}, "name": {"d"}}).Code
+		}},
+		{"rename", func() int {
+			return postForm(handleRenameFile, "/api/file/rename", url.Values{"oldPath": {"a.txt"}, "newName": {"b.txt"}}).Code
+		}},
+		{"move", func() int {
+			return postForm(handleMoveFile, "/api/file/move", url.Values{"path": {"b.txt"}, "destination": {"d"}}).Code
+		}},
+		{"delete", func() int { return deleteFile("d/b.txt").Code }},
+	}
+	for _, op := range ops {
+		if code := op.do(); code != http.StatusOK {
+			t.Fatalf("%s: status = %d", op.name, code)
+		}
+	}
+
+	undo := func() int {
+		return postForm(handleJournalUndo, "/api/journal/undo", nil).Code
+	}
+	steps := []struct {
+		name    string
+		present []string
+		absent  []string
+	}{
+		{"undo delete", []string{"d/b.txt"}, nil},
+		{"undo move", []string{"b.txt", "d"}, []string{"d/b.txt"}},
+		{"undo rename", []string{"a.txt"}, []string{"b.txt"}},
+		{"undo mkdir", []string{"a.txt"}, []string{"d"}},
+	}
+	for _, step := range steps {
+		if code := undo(); code != http.StatusOK {
+			t.Fatalf("%s: status = %d", step.name, code)
+		}
+		for _, p := range step.present {
+			if !exists(p) {
+				t.Errorf("%s: %s missing", step.name, p)
+			}
+		}
+		for _, p := range step.absent {
+			if exists(p) {
+				t.Errorf("%s: %s still present", step.name, p)
+			}
+		}
+	}
+	if readTestFile("a.txt") != "data" {
+		t.Errorf("a.txt = %q after undoing everything", readTestFile("a.txt"))
+	}
+	if code := undo(); code != http.StatusNotFound {
+		t.Errorf("nothing left to undo: status = %d, want 404", code)
+	}
+
+	// An undo that would overwrite a file created since is refused.
+	if code := postForm(handleRenameFile, "/api/file/rename", url.Values{"oldPath": {"a.txt"}, "newName": {"c.txt"}}).Code; code != http.StatusOK {
+		t.Fatalf("rename: status = %d", code)
+	}
+	writeTestFiles(t, map[string]string{"a.txt": "new"})
+	if code := undo(); code != http.StatusConflict {
+		t.Errorf("undo onto a new file: status = %d, want 409", code)
+	}
+	if readTestFile("a.txt") != "new" || readTestFile("c.txt") != "data" {
+		t.Errorf("files changed by a refused undo: a.txt = %q, c.txt = %q", readTestFile("a.txt"), readTestFile("c.txt"))
+	}
+}
@@ -2,17 +2,25 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -34,19 +42,24 @@ var (
 	listenAddr    = "0.0.0.0:6012"
 	maxUploadSize = int64(8 * 1024 * 1024 * 1024)
 	appRootDir    = "/opt/fileuploader"
+	// Forwarding headers (X-Real-IP, X-Forwarded-*, X-Remote-User) are only
+	// believed from these proxy addresses.
+	trustedProxies = []string{"127.0.0.1", "::1"}
 )
 
 //go:embed static/* static/css/* static/js/* static/fonts/*
 var staticFiles embed.FS
 
 type FileInfo struct {
-	Name          string `json:"name"`
-	Path          string `json:"path"`
-	Size          int64  `json:"size"`
-	IsDir         bool   `json:"isDir"`
-	IsSymlink     bool   `json:"isSymlink"`
-	ModTime       int64  `json:"modTime"`
-	SymlinkTarget string `json:"symlinkTarget,omitempty"`
+	Name          string     `json:"name"`
+	Path          string     `json:"path"`
+	Size          int64      `json:"size"`
+	IsDir         bool       `json:"isDir"`
+	IsSymlink     bool       `json:"isSymlink"`
+	ModTime       int64      `json:"modTime"`
+	SymlinkTarget string     `json:"symlinkTarget,omitempty"`
+	Media         *MediaInfo `json:"media,omitempty"`
+	Stats         *FileStats `json:"stats,omitempty"`
 }
 
 type ErrorResponse struct {
@@ -92,9 +105,117 @@ func ensurePathInRoot(path string) (string, error) {
 	if strings.HasPrefix(rel, "..") || rel == ".." {
 		return "", fmt.Errorf("路径不在允许的目录范围内")
 	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if isInternalName(part) {
+			return "", fmt.Errorf("路径不在允许的目录范围内")
+		}
+	}
 	return absPath, nil
 }
 
+func isInternalName(name string) bool {
+	switch name {
+	case trashDirName, versionsDirName, transferDirName:
+		return true
+	}
+	return false
+}
+
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "_h5ai") || isInternalName(name)
+}
+
+func apiPathParam(r *http.Request, route string) string {
+	p := strings.TrimPrefix(r.URL.Path, "/filesuploader")
+	return strings.TrimPrefix(p, "/api/"+route)
+}
+
+// apiPrefix returns the API base the request came in on, so generated links
+// keep working behind the /filesuploader reverse proxy path.
+func apiPrefix(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/filesuploader/") {
+		return "/filesuploader/api/"
+	}
+	return "/api/"
+}
+
+// peerAddr returns the host of the connection's peer and whether it is one
+// of trustedProxies.
+func peerAddr(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host, slices.Contains(trustedProxies, host)
+}
+
+// clientAddr returns the client address: the peer of the connection, or the
+// address reported by X-Real-IP or the last X-Forwarded-For hop when the peer
+// is a trusted proxy.
+func clientAddr(r *http.Request) string {
+	host, trusted := peerAddr(r)
+	if !trusted {
+		return host
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	return host
+}
+
+// requestBaseURL returns scheme://host as seen by the client, honouring the
+// reverse proxy headers when they come from a trusted proxy.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if _, trusted := peerAddr(r); trusted {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+			host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	return scheme + "://" + host
+}
+
+type actorContextKey struct{}
+
+// withActor returns r carrying an identity established by the server itself,
+// such as the key of a verified signed URL, for requestActor to report.
+func withActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), actorContextKey{}, actor))
+}
+
+// requestActor names who made the request for trash, journal, version and
+// ownership records. X-Remote-User is only taken from a trusted proxy.
+func requestActor(r *http.Request) string {
+	if actor, ok := r.Context().Value(actorContextKey{}).(string); ok {
+		return actor
+	}
+	if _, trusted := peerAddr(r); trusted {
+		if user := strings.TrimSpace(r.Header.Get("X-Remote-User")); user != "" {
+			return user
+		}
+	}
+	return clientAddr(r)
+}
+
+func randomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -187,6 +308,9 @@ func listDirectory(path string) ([]FileInfo, error) {
 
 	var fileInfos []FileInfo
 	for _, entry := range entries {
+		if isInternalName(entry.Name()) {
+			continue
+		}
 		info, err := entry.Info()
 		if err != nil {
 			continue
@@ -220,7 +344,7 @@ func getDirectoryTree() ([]FileInfo, error) {
 		if path == rootDir {
 			return nil
 		}
-		if strings.HasPrefix(strings.ToLower(info.Name()), "_h5ai") {
+		if isHiddenName(info.Name()) {
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
@@ -273,10 +397,21 @@ func handleDirectoryList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
+	if r.URL.Query().Get("media") == "true" {
+		attachMediaInfo(pathParam, files)
+	}
+	if r.URL.Query().Get("stats") == "true" {
+		attachFileStats(pathParam, files)
+	}
+
+	resp := map[string]interface{}{
 		"path":  pathParam,
 		"files": files,
-	})
+	}
+	if readme := findDirectoryReadme(pathParam, apiPrefix(r)); readme != nil {
+		resp["readme"] = readme
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func handleDirectoryTree(w http.ResponseWriter, r *http.Request) {
@@ -291,13 +426,43 @@ func handleDirectoryTree(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func handleFileUpload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
+type bufferedFile struct {
+	tempPath string
+	fileName string
+	fileSize int64
+}
+
+type multipartUpload struct {
+	fields   map[string]string
+	files    []bufferedFile
+	errors   []string
+	hasFiles bool
+}
+
+// cleanup removes temp files that were not moved into place.
+func (u *multipartUpload) cleanup() {
+	for _, f := range u.files {
+		_ = os.Remove(f.tempPath)
 	}
+}
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+// uploadAbortError, returned by an accept callback, fails the whole upload
+// with status instead of rejecting a single file.
+type uploadAbortError struct {
+	status int
+	err    error
+}
+
+func (e *uploadAbortError) Error() string {
+	return e.err.Error()
+}
+
+// readMultipartUpload buffers every file part of r into temp files. Form
+// fields are collected in fields; accept may reject a file by name and the
+// fields sent before it, before its content is read, or abort the upload with
+// an *uploadAbortError. The returned status is only meaningful with an error.
+func readMultipartUpload(w http.ResponseWriter, r *http.Request, bodyLimit int64, accept func(fields map[string]string, fileName string) error) (*multipartUpload, int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, bodyLimit)
 
 	bufReader := bufio.NewReaderSize(r.Body, 1024*1024)
 	r.Body = &bufferedReadCloser{
@@ -310,71 +475,220 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 	reader, err := r.MultipartReader()
 	if err != nil {
 		log.Printf("解析multipart读取器失败: %v", err)
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("无法解析请求: %v", err))
-		return
+		return nil, http.StatusBadRequest, fmt.Errorf("无法解析请求: %v", err)
 	}
 
-	var pathParam string
-	type bufferedFile struct {
-		tempPath string
-		fileName string
-		fileSize int64
-	}
-	var bufferedFiles []bufferedFile
-	var errorsList []string
-	var hasFiles bool
-
+	upload := &multipartUpload{fields: map[string]string{}}
 	for {
 		part, err := reader.NextPart()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			upload.cleanup()
 			log.Printf("读取表单部分失败: %v", err)
 			if strings.Contains(err.Error(), "timeout") {
-				writeError(w, http.StatusRequestTimeout, "读取请求参数超时，请重试")
-				return
+				return nil, http.StatusRequestTimeout, fmt.Errorf("读取请求参数超时，请重试")
 			}
-			writeError(w, http.StatusBadRequest, "读取请求数据失败")
-			return
+			return nil, http.StatusBadRequest, fmt.Errorf("读取请求数据失败")
 		}
 
 		if part.FileName() == "" {
 			fieldName := part.FormName()
-			if fieldName == "path" {
-				pathBytes, err := io.ReadAll(part)
-				if err != nil {
-					log.Printf("读取path参数失败: %v", err)
-					writeError(w, http.StatusBadRequest, "获取上传路径失败")
-					return
-				}
-				pathParam = string(pathBytes)
-			}
+			value, err := io.ReadAll(io.LimitReader(part, 64*1024))
 			_ = part.Close()
+			if err != nil {
+				upload.cleanup()
+				log.Printf("读取%s参数失败: %v", fieldName, err)
+				return nil, http.StatusBadRequest, fmt.Errorf("获取参数 %s 失败", fieldName)
+			}
+			upload.fields[fieldName] = string(value)
 			continue
 		}
 
-		hasFiles = true
+		upload.hasFiles = true
+		fileName := filepath.Base(part.FileName())
+		if accept != nil {
+			if err := accept(upload.fields, fileName); err != nil {
+				_ = part.Close()
+				if abort, ok := err.(*uploadAbortError); ok {
+					upload.cleanup()
+					return nil, abort.status, abort.err
+				}
+				upload.errors = append(upload.errors, fmt.Sprintf("文件 %s 被拒绝: %v", fileName, err))
+				continue
+			}
+		}
 		tempPath, written, err := savePartToTempFile(part, maxUploadSize)
 		if err != nil {
-			errMsg := fmt.Sprintf("无法保存文件 %s: %v", filepath.Base(part.FileName()), err)
+			errMsg := fmt.Sprintf("无法保存文件 %s: %v", fileName, err)
 			log.Printf(errMsg)
-			errorsList = append(errorsList, errMsg)
+			upload.errors = append(upload.errors, errMsg)
 			continue
 		}
-		bufferedFiles = append(bufferedFiles, bufferedFile{
+		upload.files = append(upload.files, bufferedFile{
 			tempPath: tempPath,
-			fileName: filepath.Base(part.FileName()),
+			fileName: fileName,
 			fileSize: written,
 		})
 	}
+	return upload, 0, nil
+}
+
+// uploadMode says what storeUploadedFiles does when a name is already taken.
+type uploadMode int
+
+const (
+	uploadReplace   uploadMode = iota // snapshot the existing file and replace it
+	uploadRename                      // store under the next free "name (n).ext"
+	uploadNoReplace                   // leave the existing file and fail
+)
+
+// storeUploadedFiles moves buffered uploads into fullPath, applying the
+// directory's metadata rules and snapshotting replaced files. With
+// uploadRename, clashing names get a numeric suffix instead; stored and the
+// error messages still use the names as sent, so uploaders cannot probe which
+// names exist. reserve, if set, can veto each file right before it is moved;
+// the release function it returns is called if the file then fails to land.
+func storeUploadedFiles(r *http.Request, fullPath string, files []bufferedFile, mode uploadMode, reserve func(bufferedFile) (func(), error)) (stored []string, processed map[string][]string, errorsList []string) {
+	relDir, _ := filepath.Rel(rootDir, fullPath)
+	stripMode := metadataStripMode(relDir)
+	processed = map[string][]string{}
+	// Errors name the final path, so only trusted callers see them.
+	detail := func(err error) string {
+		if mode != uploadRename {
+			return ": " + err.Error()
+		}
+		return ""
+	}
+
+	for _, file := range files {
+		sentName := file.fileName
+		if mode == uploadRename {
+			file.fileName = uniqueFileName(fullPath, file.fileName)
+		}
+		dstPath := filepath.Join(fullPath, file.fileName)
+		if stripMode != "" {
+			stripped, err := stripMetadataFile(file.tempPath, stripMode)
+			if err != nil {
+				log.Printf("无法清除文件 %s 的元数据: %v", file.fileName, err)
+				errorsList = append(errorsList, fmt.Sprintf("无法清除文件 %s 的元数据%s", sentName, detail(err)))
+				_ = os.Remove(file.tempPath)
+				continue
+			}
+			if len(stripped) > 0 {
+				processed[sentName] = stripped
+				log.Printf("已清除文件元数据: %s %v", file.fileName, stripped)
+			}
+		}
+		release := func() {}
+		if reserve != nil {
+			var err error
+			if release, err = reserve(file); err != nil {
+				errorsList = append(errorsList, fmt.Sprintf("文件 %s 被拒绝: %v", sentName, err))
+				_ = os.Remove(file.tempPath)
+				continue
+			}
+		}
+		var prev *FileVersion
+		var err error
+		switch mode {
+		case uploadReplace:
+			prev, err = snapshotVersion(dstPath, requestActor(r))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("无法保存文件 %s 的历史版本: %v", file.fileName, err)
+				errorsList = append(errorsList, fmt.Sprintf("无法保存文件 %s 的历史版本%s", sentName, detail(err)))
+				_ = os.Remove(file.tempPath)
+				release()
+				continue
+			}
+			err = moveTempFile(file.tempPath, dstPath)
+		case uploadRename:
+			// The name picked above may be taken by a concurrent upload by
+			// now, so claim it atomically and pick again if it is.
+			var claimed string
+			if claimed, err = claimUploadName(file.tempPath, fullPath, sentName, file.fileName); err == nil {
+				file.fileName = claimed
+				dstPath = filepath.Join(fullPath, claimed)
+			}
+		case uploadNoReplace:
+			err = moveTempFileExclusive(file.tempPath, dstPath)
+			if os.IsExist(err) {
+				errorsList = append(errorsList, fmt.Sprintf("文件 %s 已存在", sentName))
+				_ = os.Remove(file.tempPath)
+				release()
+				continue
+			}
+		}
+		if err != nil {
+			log.Printf("无法移动文件 %s: %v", file.fileName, err)
+			errorsList = append(errorsList, fmt.Sprintf("无法移动文件 %s%s", sentName, detail(err)))
+			_ = os.Remove(file.tempPath)
+			revertSnapshot(dstPath, prev)
+			release()
+			continue
+		}
+		if err := os.Chmod(dstPath, 0644); err != nil {
+			log.Printf("设置权限失败 %s: %v", file.fileName, err)
+		}
+		stored = append(stored, sentName)
+		log.Printf("文件上传成功: %s -> %s（大小: %d 字节）", file.fileName, dstPath, file.fileSize)
+	}
+	if len(stored) > 0 {
+		invalidateTimeline(fullPath)
+	}
+	return stored, processed, errorsList
+}
+
+// claimUploadName moves srcPath into dir under first, or else the first free
+// "name (n).ext", without ever replacing a file: when a concurrent upload
+// claims a candidate first, the next free name is tried.
+func claimUploadName(srcPath, dir, name, first string) (string, error) {
+	candidate := first
+	for attempt := 0; attempt < 100; attempt++ {
+		err := moveTempFileExclusive(srcPath, filepath.Join(dir, candidate))
+		if !os.IsExist(err) {
+			return candidate, err
+		}
+		candidate = uniqueFileName(dir, name)
+	}
+	return "", fmt.Errorf("无法找到可用的文件名")
+}
+
+// uniqueFileName returns name, or "name (n).ext" if name already exists in dir.
+func uniqueFileName(dir, name string) string {
+	if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+		return name
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if _, err := os.Lstat(filepath.Join(dir, candidate)); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+func handleFileUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
 
-	if !hasFiles {
+	upload, status, err := readMultipartUpload(w, r, maxUploadSize, nil)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	if !upload.hasFiles {
 		log.Printf("未找到上传的文件")
 		writeError(w, http.StatusBadRequest, "没有找到上传的文件")
 		return
 	}
 
+	pathParam := upload.fields["path"]
 	if pathParam == "" {
 		pathParam = "."
 	}
@@ -382,35 +696,29 @@ func handleFileUpload(w http.ResponseWriter, r *http.Request) {
 
 	fullPath, err := ensurePathInRoot(pathParam)
 	if err != nil {
+		upload.cleanup()
 		log.Printf("路径验证失败: %v", err)
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	if err := os.MkdirAll(fullPath, 0755); err != nil {
+		upload.cleanup()
 		log.Printf("无法创建目标目录 %s: %v", fullPath, err)
 		writeError(w, http.StatusInternalServerError, "无法创建目标目录")
 		return
 	}
 
-	for _, file := range bufferedFiles {
-		dstPath := filepath.Join(fullPath, file.fileName)
-		if err := moveTempFile(file.tempPath, dstPath); err != nil {
-			errMsg := fmt.Sprintf("无法移动文件 %s: %v", file.fileName, err)
-			log.Printf(errMsg)
-			errorsList = append(errorsList, errMsg)
-			continue
-		}
-		if err := os.Chmod(dstPath, 0644); err != nil {
-			log.Printf("设置权限失败 %s: %v", file.fileName, err)
-		}
-		log.Printf("文件上传成功: %s -> %s（大小: %d 字节）", file.fileName, dstPath, file.fileSize)
-	}
+	_, processed, storeErrors := storeUploadedFiles(r, fullPath, upload.files, uploadReplace, nil)
+	errorsList := append(upload.errors, storeErrors...)
 
 	resp := map[string]interface{}{
 		"success": len(errorsList) == 0,
 		"message": "文件上传完成（部分文件可能失败）",
 	}
+	if len(processed) > 0 {
+		resp["stripped"] = processed
+	}
 	if len(errorsList) > 0 {
 		resp["errors"] = errorsList
 		log.Printf("上传完成，但有错误: %v", errorsList)
@@ -448,6 +756,47 @@ func savePartToTempFile(part *multipart.Part, maxSize int64) (string, int64, err
 	return tempFile.Name(), written, nil
 }
 
+// moveTempFileExclusive is moveTempFile for a target that must not exist yet;
+// otherwise it fails with an error satisfying os.IsExist. A hard link claims
+// the name atomically. Across filesystems, or where links are unsupported,
+// the data is copied into a file created with O_EXCL instead.
+func moveTempFileExclusive(srcPath, dstPath string) error {
+	err := os.Link(srcPath, dstPath)
+	if err == nil {
+		if err := os.Remove(srcPath); err != nil {
+			log.Printf("删除临时文件失败 %s: %v", srcPath, err)
+		}
+		return nil
+	}
+	if os.IsExist(err) {
+		return err
+	}
+
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		_ = os.Remove(dstPath)
+		return err
+	}
+	if err := dstFile.Sync(); err != nil {
+		log.Printf("目标文件同步失败 %s: %v", dstPath, err)
+	}
+	if err := os.Remove(srcPath); err != nil {
+		log.Printf("删除临时文件失败 %s: %v", srcPath, err)
+	}
+	return nil
+}
+
 func moveTempFile(srcPath, dstPath string) error {
 	if err := os.Rename(srcPath, dstPath); err == nil {
 		return nil
@@ -466,6 +815,7 @@ func moveTempFile(srcPath, dstPath string) error {
 	defer dstFile.Close()
 
 	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		_ = os.Remove(dstPath)
 		return err
 	}
 	if err := dstFile.Sync(); err != nil {
@@ -499,10 +849,15 @@ func handleCreateDirectory(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	_, statErr := os.Lstat(absPath)
 	if err := os.MkdirAll(absPath, 0755); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法创建目录: %v", err))
 		return
 	}
+	if os.IsNotExist(statErr) {
+		relPath, _ := filepath.Rel(rootDir, absPath)
+		recordOperation(r, opMkdir, JournalStep{Op: opMkdir, Path: relPath})
+	}
 	writeJSON(w, http.StatusOK, SuccessResponse{Message: "目录创建成功"})
 }
 
@@ -537,6 +892,8 @@ func handleCreateSymlink(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法创建软链接: %v", err))
 		return
 	}
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	recordOperation(r, opSymlink, JournalStep{Op: opSymlink, Path: relPath, Target: target})
 	writeJSON(w, http.StatusOK, SuccessResponse{Message: "软链接创建成功"})
 }
 
@@ -560,6 +917,11 @@ func handleRenameFile(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	relOldPath, _ := filepath.Rel(rootDir, absOldPath)
+	if err := checkProtected(relOldPath); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
 	newName = filepath.Base(newName)
 	dir := filepath.Dir(absOldPath)
 	absNewPath := filepath.Join(dir, newName)
@@ -567,13 +929,84 @@ func handleRenameFile(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "新路径不在允许的目录范围内")
 		return
 	}
+	relNewPath, _ := filepath.Rel(rootDir, absNewPath)
+	if _, err := os.Lstat(absNewPath); err == nil {
+		if err := checkProtected(relNewPath); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
 	if err := os.Rename(absOldPath, absNewPath); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法重命名文件: %v", err))
 		return
 	}
+	renameFileStats(map[string]string{absOldPath: absNewPath})
+	invalidateTimeline(absOldPath, absNewPath)
+	recordOperation(r, opRename, JournalStep{Op: opRename, Path: relOldPath, Target: relNewPath, Inode: inodeOf(absNewPath)})
 	writeJSON(w, http.StatusOK, SuccessResponse{Message: "文件重命名成功"})
 }
 
+func handleMoveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	srcPath := r.FormValue("path")
+	if srcPath == "" {
+		writeError(w, http.StatusBadRequest, "路径不能为空")
+		return
+	}
+	absSrcPath, err := ensurePathInRoot(srcPath)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	absDestDir, err := ensurePathInRoot(r.FormValue("destination"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	relSrcPath, _ := filepath.Rel(rootDir, absSrcPath)
+	if relSrcPath == "." {
+		writeError(w, http.StatusBadRequest, "不能移动根目录")
+		return
+	}
+	if info, err := os.Stat(absDestDir); err != nil || !info.IsDir() {
+		writeError(w, http.StatusBadRequest, "目标目录不存在")
+		return
+	}
+	if absDestDir == absSrcPath || strings.HasPrefix(absDestDir, absSrcPath+string(filepath.Separator)) {
+		writeError(w, http.StatusBadRequest, "不能移动到自身或其子目录中")
+		return
+	}
+	if err := checkProtected(relSrcPath); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	absNewPath := filepath.Join(absDestDir, filepath.Base(absSrcPath))
+	relNewPath, _ := filepath.Rel(rootDir, absNewPath)
+	if err := checkWritable(relNewPath); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if _, err := os.Lstat(absNewPath); err == nil {
+		writeError(w, http.StatusConflict, "目标目录中已存在同名文件")
+		return
+	}
+	if err := os.Rename(absSrcPath, absNewPath); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法移动文件: %v", err))
+		return
+	}
+	renameFileStats(map[string]string{absSrcPath: absNewPath})
+	invalidateTimeline(absSrcPath, absNewPath)
+	recordOperation(r, opMove, JournalStep{Op: opMove, Path: relSrcPath, Target: relNewPath, Inode: inodeOf(absNewPath)})
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "文件移动成功", Data: map[string]string{"path": filepath.ToSlash(relNewPath)}})
+}
+
 func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
 		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
@@ -595,23 +1028,101 @@ func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	info, err := os.Stat(absPath)
-	if err != nil {
+	preview, err := previewDelete(absPath)
+	if os.IsNotExist(err) {
 		writeError(w, http.StatusNotFound, fmt.Sprintf("路径不存在: %v", err))
 		return
 	}
-	if info.IsDir() {
-		if err := os.RemoveAll(absPath); err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法删除目录: %v", err))
-			return
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if preview.RequiresConfirm && !consumeDeleteToken(r.URL.Query().Get("token"), preview.Path) {
+		issueDeleteToken(preview)
+		writeJSON(w, http.StatusPreconditionRequired, map[string]interface{}{
+			"error":   fmt.Sprintf("目录包含 %d 个项目，共 %d 字节，请确认后再删除", preview.Items, preview.Bytes),
+			"preview": preview,
+		})
+		return
+	}
+	item, err := moveToTrash(absPath, requestActor(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法移入回收站: %v", err))
+		return
+	}
+	recordOperation(r, opDelete, JournalStep{Op: opDelete, Path: item.OriginalPath, TrashID: item.ID})
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "删除成功", Data: item})
+}
+
+func handleFileDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	absPath, err := ensurePathInRoot(apiPathParam(r, "file/download/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	serveFile(w, r, absPath, "", true, "文件不存在")
+}
+
+// serveFile streams a regular file with range support and counts the access.
+// An empty contentType is derived from the file name; attachment asks the
+// browser to save the file instead of rendering it.
+func serveFile(w http.ResponseWriter, r *http.Request, absPath, contentType string, attachment bool, notFound string) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, notFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		writeError(w, http.StatusNotFound, notFound)
+		return
+	}
+	if contentType == "" {
+		contentType = getContentType(info.Name())
+	}
+	w.Header().Set("Content-Type", contentType)
+	if attachment {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	recordFileAccess(r, absPath, info.Size())
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// countsAsDownload reports whether r fetches a file of the given size in a way
+// that should count against download limits: any GET whose ranges cover the
+// first or last byte, including suffix and open-ended ranges. Nobody can
+// assemble the whole file without touching both ends, while follow-up ranges
+// in the middle (resumes, seeking) stay free. HEAD never counts; requests
+// with If-Range or a header ServeContent may ignore count as well.
+func countsAsDownload(r *http.Request, size int64) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok || size <= 0 || r.Header.Get("If-Range") != "" {
+		return true
+	}
+	for _, ra := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(ra), "-")
+		if !ok || first == "" {
+			return true
 		}
-	} else {
-		if err := os.Remove(absPath); err != nil {
-			writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法删除文件: %v", err))
-			return
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start == 0 || last == "" {
+			return true
+		}
+		end, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || end >= size-1 {
+			return true
 		}
 	}
-	writeJSON(w, http.StatusOK, SuccessResponse{Message: "删除成功"})
+	return false
 }
 
 func getContentType(filePath string) string {
@@ -735,11 +1246,64 @@ func main() {
 	mux.HandleFunc("/api/directory/list", handleDirectoryList)
 	mux.HandleFunc("/api/directory/tree", handleDirectoryTree)
 	mux.HandleFunc("/api/file/upload", handleFileUpload)
+	mux.HandleFunc("/api/put/", handleRawUpload)
+	mux.HandleFunc("/api/transfer/", handleTransfer)
+	mux.HandleFunc("/api/transfers/list", handleTransferList)
+	mux.HandleFunc("/api/paste", handlePaste)
+	mux.HandleFunc("/api/paste/", handlePaste)
 	mux.HandleFunc("/api/directory/create", handleCreateDirectory)
 	mux.HandleFunc("/api/directory/symlink", handleCreateSymlink)
 	mux.HandleFunc("/api/file/rename", handleRenameFile)
+	mux.HandleFunc("/api/file/move", handleMoveFile)
+	mux.HandleFunc("/api/file/batch-rename", handleBatchRename)
+	mux.HandleFunc("/api/archive/extract", handleArchiveExtract)
+	mux.HandleFunc("/api/archive/compress", handleArchiveCompress)
+	mux.HandleFunc("/api/archive/list/", handleArchiveList)
+	mux.HandleFunc("/api/archive/entry/", handleArchiveEntry)
+	mux.HandleFunc("/api/thumbnail/", handleThumbnail)
+	mux.HandleFunc("/api/image/", handleImageTransform)
+	mux.HandleFunc("/api/file/upload-processors", handleUploadProcessors)
+	mux.HandleFunc("/api/file/preview/", handleTextPreview)
+	mux.HandleFunc("/api/file/save/", handleFileSave)
+	mux.HandleFunc("/api/file/create", handleFileCreate)
+	mux.HandleFunc("/api/media/info/", handleMediaInfo)
+	mux.HandleFunc("/api/media/cover/", handleMediaCover)
+	mux.HandleFunc("/api/media/stream/", handleMediaStream)
+	mux.HandleFunc("/api/playlist/", handlePlaylist)
+	mux.HandleFunc("/api/feed/", handleDirectoryFeed)
+	mux.HandleFunc("/api/photo/timeline/", handlePhotoTimeline)
+	mux.HandleFunc("/api/opds/", handleOPDS)
+	mux.HandleFunc("/api/opds/search", handleOPDSSearch)
+	mux.HandleFunc("/api/opds/opensearch.xml", handleOPDSOpenSearch)
+	mux.HandleFunc("/api/opds/download/", handleOPDSDownload)
+	mux.HandleFunc("/api/opds/cover/", handleOPDSCover)
+	mux.HandleFunc("/api/job/list", handleJobList)
+	mux.HandleFunc("/api/job/status/", handleJobStatus)
+	mux.HandleFunc("/api/job/cancel", handleJobCancel)
 	mux.HandleFunc("/api/file/delete/", handleDeleteFile)
+	mux.HandleFunc("/api/file/delete-preview/", handleDeletePreview)
+	mux.HandleFunc("/api/file/download/", handleFileDownload)
+	mux.HandleFunc("/api/stats/top", handleStatsTop)
+	mux.HandleFunc("/api/share/create", handleShareCreate)
+	mux.HandleFunc("/api/share/list", handleShareList)
+	mux.HandleFunc("/api/share/revoke", handleShareRevoke)
+	mux.HandleFunc("/api/share/qr/", handleShareQR)
+	mux.HandleFunc("/api/s/", handleSharePublic)
+	mux.HandleFunc("/api/drop/create", handleFileDropCreate)
+	mux.HandleFunc("/api/drop/list", handleFileDropList)
+	mux.HandleFunc("/api/drop/revoke", handleFileDropRevoke)
+	mux.HandleFunc("/api/r/", handleFileDropPublic)
+	mux.HandleFunc("/api/sign/create", handleSignURL)
+	mux.HandleFunc("/api/sign/keys", handleSigningKeys)
 	mux.HandleFunc("/api/auth/status", handleAuthStatus)
+	mux.HandleFunc("/api/trash/list", handleTrashList)
+	mux.HandleFunc("/api/trash/restore", handleTrashRestore)
+	mux.HandleFunc("/api/trash/purge", handleTrashPurge)
+	mux.HandleFunc("/api/version/list/", handleVersionList)
+	mux.HandleFunc("/api/version/download/", handleVersionDownload)
+	mux.HandleFunc("/api/version/restore", handleVersionRestore)
+	mux.HandleFunc("/api/journal/list", handleJournalList)
+	mux.HandleFunc("/api/journal/undo", handleJournalUndo)
 
 	mux.HandleFunc("/filesuploader", handleFilesUploaderIndex)
 	mux.HandleFunc("/filesuploader/", handleFilesUploaderIndex)
@@ -747,15 +1311,78 @@ func main() {
 	mux.HandleFunc("/filesuploader/api/directory/list", handleDirectoryList)
 	mux.HandleFunc("/filesuploader/api/directory/tree", handleDirectoryTree)
 	mux.HandleFunc("/filesuploader/api/file/upload", handleFileUpload)
+	mux.HandleFunc("/filesuploader/api/put/", handleRawUpload)
+	mux.HandleFunc("/filesuploader/api/transfer/", handleTransfer)
+	mux.HandleFunc("/filesuploader/api/transfers/list", handleTransferList)
+	mux.HandleFunc("/filesuploader/api/paste", handlePaste)
+	mux.HandleFunc("/filesuploader/api/paste/", handlePaste)
 	mux.HandleFunc("/filesuploader/api/directory/create", handleCreateDirectory)
 	mux.HandleFunc("/filesuploader/api/directory/symlink", handleCreateSymlink)
 	mux.HandleFunc("/filesuploader/api/file/rename", handleRenameFile)
+	mux.HandleFunc("/filesuploader/api/file/move", handleMoveFile)
+	mux.HandleFunc("/filesuploader/api/file/batch-rename", handleBatchRename)
+	mux.HandleFunc("/filesuploader/api/archive/extract", handleArchiveExtract)
+	mux.HandleFunc("/filesuploader/api/archive/compress", handleArchiveCompress)
+	mux.HandleFunc("/filesuploader/api/archive/list/", handleArchiveList)
+	mux.HandleFunc("/filesuploader/api/archive/entry/", handleArchiveEntry)
+	mux.HandleFunc("/filesuploader/api/thumbnail/", handleThumbnail)
+	mux.HandleFunc("/filesuploader/api/image/", handleImageTransform)
+	mux.HandleFunc("/filesuploader/api/file/upload-processors", handleUploadProcessors)
+	mux.HandleFunc("/filesuploader/api/file/preview/", handleTextPreview)
+	mux.HandleFunc("/filesuploader/api/file/save/", handleFileSave)
+	mux.HandleFunc("/filesuploader/api/file/create", handleFileCreate)
+	mux.HandleFunc("/filesuploader/api/media/info/", handleMediaInfo)
+	mux.HandleFunc("/filesuploader/api/media/cover/", handleMediaCover)
+	mux.HandleFunc("/filesuploader/api/media/stream/", handleMediaStream)
+	mux.HandleFunc("/filesuploader/api/playlist/", handlePlaylist)
+	mux.HandleFunc("/filesuploader/api/feed/", handleDirectoryFeed)
+	mux.HandleFunc("/filesuploader/api/photo/timeline/", handlePhotoTimeline)
+	mux.HandleFunc("/filesuploader/api/opds/", handleOPDS)
+	mux.HandleFunc("/filesuploader/api/opds/search", handleOPDSSearch)
+	mux.HandleFunc("/filesuploader/api/opds/opensearch.xml", handleOPDSOpenSearch)
+	mux.HandleFunc("/filesuploader/api/opds/download/", handleOPDSDownload)
+	mux.HandleFunc("/filesuploader/api/opds/cover/", handleOPDSCover)
+	mux.HandleFunc("/filesuploader/api/job/list", handleJobList)
+	mux.HandleFunc("/filesuploader/api/job/status/", handleJobStatus)
+	mux.HandleFunc("/filesuploader/api/job/cancel", handleJobCancel)
 	mux.HandleFunc("/filesuploader/api/file/delete/", handleDeleteFile)
+	mux.HandleFunc("/filesuploader/api/file/delete-preview/", handleDeletePreview)
+	mux.HandleFunc("/filesuploader/api/file/download/", handleFileDownload)
+	mux.HandleFunc("/filesuploader/api/stats/top", handleStatsTop)
+	mux.HandleFunc("/filesuploader/api/share/create", handleShareCreate)
+	mux.HandleFunc("/filesuploader/api/share/list", handleShareList)
+	mux.HandleFunc("/filesuploader/api/share/revoke", handleShareRevoke)
+	mux.HandleFunc("/filesuploader/api/share/qr/", handleShareQR)
+	mux.HandleFunc("/filesuploader/api/s/", handleSharePublic)
+	mux.HandleFunc("/filesuploader/api/drop/create", handleFileDropCreate)
+	mux.HandleFunc("/filesuploader/api/drop/list", handleFileDropList)
+	mux.HandleFunc("/filesuploader/api/drop/revoke", handleFileDropRevoke)
+	mux.HandleFunc("/filesuploader/api/r/", handleFileDropPublic)
+	mux.HandleFunc("/filesuploader/api/sign/create", handleSignURL)
+	mux.HandleFunc("/filesuploader/api/sign/keys", handleSigningKeys)
 	mux.HandleFunc("/filesuploader/api/auth/status", handleAuthStatus)
+	mux.HandleFunc("/filesuploader/api/trash/list", handleTrashList)
+	mux.HandleFunc("/filesuploader/api/trash/restore", handleTrashRestore)
+	mux.HandleFunc("/filesuploader/api/trash/purge", handleTrashPurge)
+	mux.HandleFunc("/filesuploader/api/version/list/", handleVersionList)
+	mux.HandleFunc("/filesuploader/api/version/download/", handleVersionDownload)
+	mux.HandleFunc("/filesuploader/api/version/restore", handleVersionRestore)
+	mux.HandleFunc("/filesuploader/api/journal/list", handleJournalList)
+	mux.HandleFunc("/filesuploader/api/journal/undo", handleJournalUndo)
+
+	loadJournal()
+	loadUploadProcessors()
+	loadShares()
+	loadFileDrops()
+	loadSigningKeys()
+	startTrashSweeper()
+	startTransferReaper()
+	startPasteSweeper()
+	startFileStatsFlusher()
 
 	srv := &http.Server{
 		Addr:              listenAddr,
-		Handler:           mux,
+		Handler:           withSignedURLs(mux),
 		ReadTimeout:       1800 * time.Second,
 		WriteTimeout:      1800 * time.Second,
 		IdleTimeout:       300 * time.Second,
@@ -765,7 +1392,25 @@ func main() {
 	log.Printf("文件上传服务启动 - 地址: %s, 上传目录: %s, 最大大小: %d GB",
 		listenAddr, rootDir, maxUploadSize/(1024*1024*1024))
 
-	if err := srv.ListenAndServe(); err != nil {
+	// On SIGINT/SIGTERM, let running requests finish and write out the
+	// download counters that are otherwise flushed periodically.
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Printf("正在关闭服务...")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("关闭服务失败: %v", err)
+		}
+		close(stopped)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("服务器启动失败: %v", err)
 	}
+	<-stopped
+	flushFileStats()
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// useTempRoots points rootDir and appRootDir at fresh temporary directories
+// for the duration of the test.
+func useTempRoots(t *testing.T) {
+	t.Helper()
+	savedRoot, savedApp := rootDir, appRootDir
+	rootDir, appRootDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { rootDir, appRootDir = savedRoot, savedApp })
+}
+
+func TestForwardingHeadersNeedTrustedProxy(t *testing.T) {
+	headers := map[string]string{
+		"X-Remote-User":     "admin",
+		"X-Real-IP":         "203.0.113.7",
+		"X-Forwarded-For":   "198.51.100.1, 203.0.113.9",
+		"X-Forwarded-Host":  "evil.example",
+		"X-Forwarded-Proto": "https",
+	}
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		actor   string
+		addr    string
+		baseURL string
+	}{
+		{"direct client is not believed", "192.0.2.5:5555", headers, "192.0.2.5", "192.0.2.5", "http://files.lan"},
+		{"local proxy", "127.0.0.1:4000", headers, "admin", "203.0.113.7", "https://evil.example"},
+		{"IPv6 local proxy", "[::1]:4000", headers, "admin", "203.0.113.7", "https://evil.example"},
+		{"proxy without user", "127.0.0.1:4000", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.9"}, "203.0.113.9", "203.0.113.9", "http://files.lan"},
+		{"proxy without headers", "127.0.0.1:4000", nil, "127.0.0.1", "127.0.0.1", "http://files.lan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://files.lan/api/files", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := requestActor(r); got != tt.actor {
+				t.Errorf("requestActor = %q, want %q", got, tt.actor)
+			}
+			if got := clientAddr(r); got != tt.addr {
+				t.Errorf("clientAddr = %q, want %q", got, tt.addr)
+			}
+			if got := requestBaseURL(r); got != tt.baseURL {
+				t.Errorf("requestBaseURL = %q, want %q", got, tt.baseURL)
+			}
+			if got := requestActor(withActor(r, "signed:k1")); got != "signed:k1" {
+				t.Errorf("requestActor with a server-set actor = %q", got)
+			}
+		})
+	}
+}
+
+func TestStoreUploadedFilesUniqueNames(t *testing.T) {
+	useTempRoots(t)
+	const n = 20
+	r := httptest.NewRequest(http.MethodPost, "/api/upload", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		tmp := filepath.Join(appRootDir, fmt.Sprintf("upload%d", i))
+		if err := os.WriteFile(tmp, []byte(strconv.Itoa(i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stored, _, errs := storeUploadedFiles(r, rootDir, []bufferedFile{{tempPath: tmp, fileName: "same.txt", fileSize: 1}}, uploadRename, nil)
+			if len(stored) != 1 || len(errs) != 0 {
+				t.Errorf("stored = %q, errors = %q", stored, errs)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(rootDir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(data)] = true
+	}
+	if len(entries) != n || len(seen) != n {
+		t.Errorf("%d files with %d distinct contents, want %d of each", len(entries), len(seen), n)
+	}
+}
+
+func TestStoreUploadedFilesReleasesOnFailure(t *testing.T) {
+	useTempRoots(t)
+	tmp := filepath.Join(appRootDir, "upload")
+	if err := os.WriteFile(tmp, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reserved, released := 0, 0
+	reserve := func(bufferedFile) (func(), error) {
+		reserved++
+		return func() { released++ }, nil
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/r/x", nil)
+	stored, _, errs := storeUploadedFiles(r, filepath.Join(rootDir, "missing"), []bufferedFile{{tempPath: tmp, fileName: "a.txt", fileSize: 4}}, uploadRename, reserve)
+	if len(stored) != 0 || len(errs) != 1 {
+		t.Fatalf("stored = %q, errors = %q", stored, errs)
+	}
+	if reserved != 1 || released != 1 {
+		t.Errorf("reserved %d, released %d; want 1 and 1", reserved, released)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+}
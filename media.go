@@ -0,0 +1,956 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dhowden/tag"
+)
+
+var (
+	mediaCacheSize  = 1024
+	mediaMaxMoovBox = int64(64 * 1024 * 1024)
+)
+
+type MediaInfo struct {
+	Format     string            `json:"format"`
+	Duration   float64           `json:"duration"`
+	Bitrate    int64             `json:"bitrate,omitempty"`
+	AudioCodec string            `json:"audioCodec,omitempty"`
+	VideoCodec string            `json:"videoCodec,omitempty"`
+	Width      int               `json:"width,omitempty"`
+	Height     int               `json:"height,omitempty"`
+	SampleRate int               `json:"sampleRate,omitempty"`
+	Channels   int               `json:"channels,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	HasCover   bool              `json:"hasCover"`
+}
+
+type mediaCacheEntry struct {
+	modTime int64
+	size    int64
+	info    *MediaInfo
+}
+
+var (
+	mediaCacheMu    sync.Mutex
+	mediaCache      = map[string]*mediaCacheEntry{}
+	mediaCacheOrder []string
+)
+
+func mediaFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3":
+		return "mp3"
+	case ".flac":
+		return "flac"
+	case ".ogg", ".oga", ".ogv", ".opus":
+		return "ogg"
+	case ".mp4", ".m4a", ".m4v", ".m4b", ".mov":
+		return "mp4"
+	case ".mkv", ".mka", ".webm":
+		return "mkv"
+	}
+	return ""
+}
+
+// getMediaInfo returns the cached metadata for absPath, parsing the file
+// again only when its mtime or size changed.
+func getMediaInfo(absPath string, info os.FileInfo) (*MediaInfo, error) {
+	mediaCacheMu.Lock()
+	cached, ok := mediaCache[absPath]
+	mediaCacheMu.Unlock()
+	if ok && cached.modTime == info.ModTime().UnixNano() && cached.size == info.Size() {
+		return cached.info, nil
+	}
+
+	m, err := readMediaInfo(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaCacheMu.Lock()
+	if _, exists := mediaCache[absPath]; !exists {
+		mediaCacheOrder = append(mediaCacheOrder, absPath)
+	}
+	mediaCache[absPath] = &mediaCacheEntry{modTime: info.ModTime().UnixNano(), size: info.Size(), info: m}
+	for len(mediaCacheOrder) > mediaCacheSize {
+		delete(mediaCache, mediaCacheOrder[0])
+		mediaCacheOrder = mediaCacheOrder[1:]
+	}
+	mediaCacheMu.Unlock()
+	return m, nil
+}
+
+func readMediaInfo(absPath string) (*MediaInfo, error) {
+	format := mediaFormat(absPath)
+	if format == "" {
+		return nil, fmt.Errorf("不支持的媒体格式")
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+
+	m := &MediaInfo{Format: format, Tags: map[string]string{}}
+	switch format {
+	case "mp3":
+		err = parseMP3(f, size, m)
+	case "flac":
+		err = parseFLAC(f, m)
+	case "ogg":
+		err = parseOGG(f, size, m)
+	case "mp4":
+		err = parseMP4(f, size, m)
+	case "mkv":
+		_, err = parseMKV(f, size, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if format != "mkv" {
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			if md, err := tag.ReadFrom(f); err == nil {
+				addTag(m, "title", md.Title())
+				addTag(m, "artist", md.Artist())
+				addTag(m, "album", md.Album())
+				addTag(m, "albumArtist", md.AlbumArtist())
+				addTag(m, "composer", md.Composer())
+				addTag(m, "genre", md.Genre())
+				if md.Year() > 0 {
+					addTag(m, "year", strconv.Itoa(md.Year()))
+				}
+				if n, _ := md.Track(); n > 0 {
+					addTag(m, "track", strconv.Itoa(n))
+				}
+				m.HasCover = md.Picture() != nil
+			}
+		}
+	}
+	if m.Bitrate == 0 && m.Duration > 0 {
+		m.Bitrate = int64(float64(size) * 8 / m.Duration)
+	}
+	m.Duration = math.Round(m.Duration*1000) / 1000
+	if len(m.Tags) == 0 {
+		m.Tags = nil
+	}
+	return m, nil
+}
+
+func addTag(m *MediaInfo, key, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		m.Tags[key] = value
+	}
+}
+
+var (
+	mp3Bitrates = map[[2]int][]int{
+		{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mp3SampleRates = []int{44100, 48000, 32000}
+)
+
+type mp3Frame struct {
+	version    int // 1, 2 (MPEG-2 and 2.5)
+	layer      int
+	bitrate    int // bits per second
+	sampleRate int
+	channels   int
+	samples    int
+	length     int
+}
+
+func parseMP3Header(h []byte) (mp3Frame, bool) {
+	var fr mp3Frame
+	if h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return fr, false
+	}
+	versionBits := (h[1] >> 3) & 3
+	layerBits := (h[1] >> 1) & 3
+	brIndex := int(h[2] >> 4)
+	srIndex := int(h[2]>>2) & 3
+	if versionBits == 1 || layerBits == 0 || brIndex == 0 || brIndex == 15 || srIndex == 3 {
+		return fr, false
+	}
+	fr.version = 1
+	fr.sampleRate = mp3SampleRates[srIndex]
+	switch versionBits {
+	case 2:
+		fr.version = 2
+		fr.sampleRate /= 2
+	case 0:
+		fr.version = 2
+		fr.sampleRate /= 4
+	}
+	fr.layer = 4 - int(layerBits)
+	fr.bitrate = mp3Bitrates[[2]int{fr.version, fr.layer}][brIndex] * 1000
+	fr.channels = 2
+	if h[3]>>6 == 3 {
+		fr.channels = 1
+	}
+	padding := int(h[2]>>1) & 1
+	switch {
+	case fr.layer == 1:
+		fr.samples = 384
+		fr.length = (12*fr.bitrate/fr.sampleRate + padding) * 4
+	case fr.layer == 3 && fr.version == 2:
+		fr.samples = 576
+		fr.length = 72*fr.bitrate/fr.sampleRate + padding
+	default:
+		fr.samples = 1152
+		fr.length = 144*fr.bitrate/fr.sampleRate + padding
+	}
+	return fr, fr.length > 4
+}
+
+func parseMP3(f io.ReaderAt, size int64, m *MediaInfo) error {
+	var id3 [10]byte
+	offset := int64(0)
+	if _, err := f.ReadAt(id3[:], 0); err == nil && string(id3[:3]) == "ID3" {
+		offset = 10 + (int64(id3[6]&0x7f)<<21 | int64(id3[7]&0x7f)<<14 | int64(id3[8]&0x7f)<<7 | int64(id3[9]&0x7f))
+		if id3[5]&0x10 != 0 {
+			offset += 10
+		}
+	}
+	buf := make([]byte, 64*1024)
+	n, _ := f.ReadAt(buf, offset)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		fr, ok := parseMP3Header(buf[i : i+4])
+		if !ok {
+			continue
+		}
+		// Require a second frame right behind the first to avoid false syncs.
+		if next := i + fr.length; next+4 <= len(buf) {
+			if _, ok := parseMP3Header(buf[next : next+4]); !ok {
+				continue
+			}
+		}
+		m.AudioCodec = fmt.Sprintf("MP%d", fr.layer)
+		if fr.layer == 3 {
+			m.AudioCodec = "MP3"
+		}
+		m.SampleRate = fr.sampleRate
+		m.Channels = fr.channels
+
+		sideInfo := 32
+		switch {
+		case fr.version == 1 && fr.channels == 1:
+			sideInfo = 17
+		case fr.version == 2 && fr.channels == 2:
+			sideInfo = 17
+		case fr.version == 2:
+			sideInfo = 9
+		}
+		frames := 0
+		if x := i + 4 + sideInfo; x+12 <= len(buf) {
+			tagName := string(buf[x : x+4])
+			if (tagName == "Xing" || tagName == "Info") && binary.BigEndian.Uint32(buf[x+4:])&1 != 0 {
+				frames = int(binary.BigEndian.Uint32(buf[x+8:]))
+			}
+		}
+		if v := i + 4 + 32; frames == 0 && v+18 <= len(buf) && string(buf[v:v+4]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(buf[v+14:]))
+		}
+
+		audioBytes := size - offset - int64(i)
+		var tail [3]byte
+		if _, err := f.ReadAt(tail[:], size-128); err == nil && string(tail[:]) == "TAG" {
+			audioBytes -= 128
+		}
+		if frames > 0 {
+			m.Duration = float64(frames) * float64(fr.samples) / float64(fr.sampleRate)
+			m.Bitrate = int64(float64(audioBytes) * 8 / m.Duration)
+		} else {
+			m.Bitrate = int64(fr.bitrate)
+			m.Duration = float64(audioBytes) * 8 / float64(fr.bitrate)
+		}
+		return nil
+	}
+	return fmt.Errorf("未找到MP3音频帧")
+}
+
+func parseFLAC(f io.ReaderAt, m *MediaInfo) error {
+	var hdr [42]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil {
+		return err
+	}
+	if string(hdr[:4]) != "fLaC" || hdr[4]&0x7f != 0 {
+		return fmt.Errorf("无效的FLAC文件")
+	}
+	v := binary.BigEndian.Uint64(hdr[18:26])
+	m.AudioCodec = "FLAC"
+	m.SampleRate = int(v >> 44)
+	m.Channels = int((v>>41)&7) + 1
+	if total := v & (1<<36 - 1); m.SampleRate > 0 {
+		m.Duration = float64(total) / float64(m.SampleRate)
+	}
+	return nil
+}
+
+func parseOGG(f io.ReaderAt, size int64, m *MediaInfo) error {
+	page := make([]byte, 27+255+64)
+	n, _ := f.ReadAt(page, 0)
+	page = page[:n]
+	if len(page) < 28 || string(page[:4]) != "OggS" {
+		return fmt.Errorf("无效的OGG文件")
+	}
+	start := 27 + int(page[26])
+	if start+20 > len(page) {
+		return fmt.Errorf("无效的OGG文件")
+	}
+	pkt := page[start:]
+
+	rate := 0
+	preSkip := int64(0)
+	switch {
+	case bytes.HasPrefix(pkt, []byte("\x01vorbis")) && len(pkt) >= 24:
+		m.AudioCodec = "Vorbis"
+		m.Channels = int(pkt[11])
+		m.SampleRate = int(binary.LittleEndian.Uint32(pkt[12:]))
+		m.Bitrate = int64(int32(binary.LittleEndian.Uint32(pkt[20:])))
+		rate = m.SampleRate
+	case bytes.HasPrefix(pkt, []byte("OpusHead")):
+		m.AudioCodec = "Opus"
+		m.Channels = int(pkt[9])
+		preSkip = int64(binary.LittleEndian.Uint16(pkt[10:]))
+		m.SampleRate = int(binary.LittleEndian.Uint32(pkt[12:]))
+		rate = 48000
+	case bytes.HasPrefix(pkt, []byte("\x7fFLAC")) && len(pkt) >= 35:
+		m.AudioCodec = "FLAC"
+		v := binary.BigEndian.Uint64(pkt[27:35])
+		m.SampleRate = int(v >> 44)
+		m.Channels = int((v>>41)&7) + 1
+		rate = m.SampleRate
+	case bytes.HasPrefix(pkt, []byte("\x80theora")):
+		m.VideoCodec = "Theora"
+		return nil
+	default:
+		return fmt.Errorf("不支持的OGG编码")
+	}
+	if m.Bitrate <= 0 {
+		m.Bitrate = 0
+	}
+
+	tailSize := min(size, 64*1024)
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return err
+	}
+	if i := bytes.LastIndex(tail, []byte("OggS")); i >= 0 && i+14 <= len(tail) && rate > 0 {
+		granule := int64(binary.LittleEndian.Uint64(tail[i+6:]))
+		if granule > preSkip {
+			m.Duration = float64(granule-preSkip) / float64(rate)
+		}
+	}
+	return nil
+}
+
+var mp4Codecs = map[string]string{
+	"avc1": "H.264", "avc3": "H.264", "hvc1": "HEVC", "hev1": "HEVC", "av01": "AV1",
+	"vp09": "VP9", "mp4v": "MPEG-4", "mp4a": "AAC", "alac": "ALAC", "Opus": "Opus",
+	"ac-3": "AC-3", "ec-3": "E-AC-3", "fLaC": "FLAC", ".mp3": "MP3",
+}
+
+type mp4Box struct {
+	typ  string
+	data []byte
+}
+
+func mp4Boxes(data []byte) []mp4Box {
+	var boxes []mp4Box
+	for len(data) >= 8 {
+		size := int64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		hdr := int64(8)
+		switch size {
+		case 0:
+			size = int64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size = int64(binary.BigEndian.Uint64(data[8:]))
+			hdr = 16
+		}
+		if size < hdr || size > int64(len(data)) {
+			return boxes
+		}
+		boxes = append(boxes, mp4Box{typ: typ, data: data[hdr:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+func findMP4Box(data []byte, path ...string) []byte {
+	for _, name := range path {
+		found := false
+		for _, b := range mp4Boxes(data) {
+			if b.typ == name {
+				data, found = b.data, true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return data
+}
+
+func parseMP4(f io.ReaderAt, size int64, m *MediaInfo) error {
+	var moov []byte
+	for off := int64(0); off+8 <= size; {
+		var hdr [16]byte
+		if _, err := f.ReadAt(hdr[:8], off); err != nil {
+			return err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr[:4]))
+		hdrLen := int64(8)
+		if boxSize == 1 {
+			if _, err := f.ReadAt(hdr[8:16], off+8); err != nil {
+				return err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			hdrLen = 16
+		} else if boxSize == 0 {
+			boxSize = size - off
+		}
+		if boxSize < hdrLen {
+			break
+		}
+		if string(hdr[4:8]) == "moov" {
+			if boxSize-hdrLen > mediaMaxMoovBox {
+				return fmt.Errorf("moov 元数据过大")
+			}
+			moov = make([]byte, boxSize-hdrLen)
+			if _, err := f.ReadAt(moov, off+hdrLen); err != nil {
+				return err
+			}
+			break
+		}
+		off += boxSize
+	}
+	if moov == nil {
+		return fmt.Errorf("未找到MP4元数据")
+	}
+
+	if mvhd := findMP4Box(moov, "mvhd"); len(mvhd) >= 32 {
+		var timescale, duration uint64
+		if mvhd[0] == 1 {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+			duration = binary.BigEndian.Uint64(mvhd[24:])
+		} else {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+			duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+		}
+		if timescale > 0 {
+			m.Duration = float64(duration) / float64(timescale)
+		}
+	}
+	for _, trak := range mp4Boxes(moov) {
+		if trak.typ != "trak" {
+			continue
+		}
+		hdlr := findMP4Box(trak.data, "mdia", "hdlr")
+		stsd := findMP4Box(trak.data, "mdia", "minf", "stbl", "stsd")
+		if len(hdlr) < 12 || len(stsd) < 16 {
+			continue
+		}
+		entry := stsd[8:]
+		fourcc := string(entry[4:8])
+		codec := mp4Codecs[fourcc]
+		if codec == "" {
+			codec = fourcc
+		}
+		switch string(hdlr[8:12]) {
+		case "vide":
+			if m.VideoCodec == "" && len(entry) >= 36 {
+				m.VideoCodec = codec
+				m.Width = int(binary.BigEndian.Uint16(entry[32:]))
+				m.Height = int(binary.BigEndian.Uint16(entry[34:]))
+			}
+		case "soun":
+			if m.AudioCodec == "" && len(entry) >= 36 {
+				m.AudioCodec = codec
+				m.Channels = int(binary.BigEndian.Uint16(entry[24:]))
+				m.SampleRate = int(binary.BigEndian.Uint32(entry[32:]) >> 16)
+			}
+		}
+	}
+	return nil
+}
+
+// EBML element IDs used by the Matroska parser.
+const (
+	mkvEBML          = 0x1A45DFA3
+	mkvDocType       = 0x4282
+	mkvSegment       = 0x18538067
+	mkvInfo          = 0x1549A966
+	mkvTimecodeScale = 0x2AD7B1
+	mkvDuration      = 0x4489
+	mkvTitle         = 0x7BA9
+	mkvTracks        = 0x1654AE6B
+	mkvTrackEntry    = 0xAE
+	mkvTrackType     = 0x83
+	mkvCodecID       = 0x86
+	mkvVideo         = 0xE0
+	mkvPixelWidth    = 0xB0
+	mkvPixelHeight   = 0xBA
+	mkvAudio         = 0xE1
+	mkvSamplingFreq  = 0xB5
+	mkvChannels      = 0x9F
+	mkvTags          = 0x1254C367
+	mkvTag           = 0x7373
+	mkvSimpleTag     = 0x67C8
+	mkvTagName       = 0x45A3
+	mkvTagString     = 0x4487
+	mkvAttachments   = 0x1941A469
+	mkvAttachedFile  = 0x61A7
+	mkvFileName      = 0x466E
+	mkvFileMimeType  = 0x4660
+	mkvFileData      = 0x465C
+	mkvCluster       = 0x1F43B675
+)
+
+const (
+	mkvMaxLeafSize = 1024 * 1024
+	mkvUnknownSize = -1
+	mkvMaxElements = 100000
+)
+
+var mkvCodecs = map[string]string{
+	"V_MPEG4/ISO/AVC": "H.264", "V_MPEGH/ISO/HEVC": "HEVC", "V_VP8": "VP8", "V_VP9": "VP9", "V_AV1": "AV1",
+	"A_AAC": "AAC", "A_OPUS": "Opus", "A_VORBIS": "Vorbis", "A_FLAC": "FLAC", "A_AC3": "AC-3",
+	"A_EAC3": "E-AC-3", "A_DTS": "DTS", "A_MPEG/L3": "MP3", "A_TRUEHD": "TrueHD",
+}
+
+type mkvCover struct {
+	offset int64
+	size   int64
+	mime   string
+}
+
+func readEBMLVint(f io.ReaderAt, off int64, keepMarker bool) (int64, int, error) {
+	var first [1]byte
+	if _, err := f.ReadAt(first[:], off); err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, fmt.Errorf("无效的EBML数据")
+	}
+	buf := make([]byte, length)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return 0, 0, err
+	}
+	if !keepMarker {
+		buf[0] &= byte(0xFF >> length)
+	}
+	var v int64
+	for _, b := range buf {
+		v = v<<8 | int64(b)
+	}
+	if !keepMarker && v == int64(1)<<(7*length)-1 {
+		return mkvUnknownSize, length, nil
+	}
+	return v, length, nil
+}
+
+func ebmlChildren(f io.ReaderAt, start, end int64, fn func(id, off, size int64) (bool, error)) error {
+	for off, count := start, 0; off < end && count < mkvMaxElements; count++ {
+		id, idLen, err := readEBMLVint(f, off, true)
+		if err != nil {
+			return nil
+		}
+		size, sizeLen, err := readEBMLVint(f, off+int64(idLen), false)
+		if err != nil {
+			return nil
+		}
+		dataOff := off + int64(idLen+sizeLen)
+		if size == mkvUnknownSize {
+			size = end - dataOff
+		}
+		more, err := fn(id, dataOff, size)
+		if err != nil || !more {
+			return err
+		}
+		off = dataOff + size
+	}
+	return nil
+}
+
+func ebmlBytes(f io.ReaderAt, off, size int64) []byte {
+	if size <= 0 || size > mkvMaxLeafSize {
+		return nil
+	}
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return nil
+	}
+	return buf
+}
+
+func ebmlUint(f io.ReaderAt, off, size int64) uint64 {
+	var v uint64
+	for _, b := range ebmlBytes(f, off, min(size, 8)) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(f io.ReaderAt, off, size int64) float64 {
+	b := ebmlBytes(f, off, size)
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func ebmlString(f io.ReaderAt, off, size int64) string {
+	return strings.TrimRight(string(ebmlBytes(f, off, size)), "\x00")
+}
+
+// parseMKV reads the Matroska/WebM header elements and returns the location
+// of an attached cover picture, if any. Clusters are skipped without reading.
+func parseMKV(f io.ReaderAt, size int64, m *MediaInfo) (*mkvCover, error) {
+	var cover *mkvCover
+	timecodeScale := 1000000.0
+	duration := 0.0
+	isMKV := false
+
+	err := ebmlChildren(f, 0, size, func(id, off, elSize int64) (bool, error) {
+		switch id {
+		case mkvEBML:
+			isMKV = true
+			return true, ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+				if id == mkvDocType && ebmlString(f, off, elSize) == "webm" {
+					m.Format = "webm"
+				}
+				return true, nil
+			})
+		case mkvSegment:
+			if !isMKV {
+				return false, nil
+			}
+			return false, ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+				switch id {
+				case mkvInfo:
+					return true, ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+						switch id {
+						case mkvTimecodeScale:
+							timecodeScale = float64(ebmlUint(f, off, elSize))
+						case mkvDuration:
+							duration = ebmlFloat(f, off, elSize)
+						case mkvTitle:
+							addTag(m, "title", ebmlString(f, off, elSize))
+						}
+						return true, nil
+					})
+				case mkvTracks:
+					return true, ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+						if id == mkvTrackEntry {
+							parseMKVTrack(f, off, elSize, m)
+						}
+						return true, nil
+					})
+				case mkvTags:
+					return true, ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+						if id == mkvTag {
+							parseMKVTag(f, off, elSize, m)
+						}
+						return true, nil
+					})
+				case mkvAttachments:
+					return true, ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+						if id == mkvAttachedFile && cover == nil {
+							cover = parseMKVAttachment(f, off, elSize)
+						}
+						return true, nil
+					})
+				case mkvCluster:
+					// Clusters of unknown size cannot be skipped.
+					return off+elSize < size, nil
+				}
+				return true, nil
+			})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !isMKV {
+		return nil, fmt.Errorf("无效的MKV文件")
+	}
+	m.Duration = duration * timecodeScale / 1e9
+	m.HasCover = cover != nil
+	return cover, nil
+}
+
+func parseMKVTrack(f io.ReaderAt, start, size int64, m *MediaInfo) {
+	var trackType uint64
+	var codec string
+	var width, height, channels int
+	var rate float64
+	_ = ebmlChildren(f, start, start+size, func(id, off, elSize int64) (bool, error) {
+		switch id {
+		case mkvTrackType:
+			trackType = ebmlUint(f, off, elSize)
+		case mkvCodecID:
+			codec = ebmlString(f, off, elSize)
+		case mkvVideo:
+			_ = ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+				switch id {
+				case mkvPixelWidth:
+					width = int(ebmlUint(f, off, elSize))
+				case mkvPixelHeight:
+					height = int(ebmlUint(f, off, elSize))
+				}
+				return true, nil
+			})
+		case mkvAudio:
+			_ = ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+				switch id {
+				case mkvSamplingFreq:
+					rate = ebmlFloat(f, off, elSize)
+				case mkvChannels:
+					channels = int(ebmlUint(f, off, elSize))
+				}
+				return true, nil
+			})
+		}
+		return true, nil
+	})
+	if name, ok := mkvCodecs[codec]; ok {
+		codec = name
+	}
+	switch trackType {
+	case 1:
+		if m.VideoCodec == "" {
+			m.VideoCodec, m.Width, m.Height = codec, width, height
+		}
+	case 2:
+		if m.AudioCodec == "" {
+			m.AudioCodec, m.SampleRate, m.Channels = codec, int(rate), channels
+		}
+	}
+}
+
+func parseMKVTag(f io.ReaderAt, start, size int64, m *MediaInfo) {
+	_ = ebmlChildren(f, start, start+size, func(id, off, elSize int64) (bool, error) {
+		if id != mkvSimpleTag {
+			return true, nil
+		}
+		var name, value string
+		_ = ebmlChildren(f, off, off+elSize, func(id, off, elSize int64) (bool, error) {
+			switch id {
+			case mkvTagName:
+				name = ebmlString(f, off, elSize)
+			case mkvTagString:
+				value = ebmlString(f, off, elSize)
+			}
+			return true, nil
+		})
+		switch strings.ToUpper(name) {
+		case "TITLE":
+			addTag(m, "title", value)
+		case "ARTIST":
+			addTag(m, "artist", value)
+		case "ALBUM":
+			addTag(m, "album", value)
+		case "GENRE":
+			addTag(m, "genre", value)
+		case "DATE_RELEASED", "DATE_RECORDED":
+			addTag(m, "year", value)
+		case "PART_NUMBER":
+			addTag(m, "track", value)
+		case "COMPOSER":
+			addTag(m, "composer", value)
+		}
+		return true, nil
+	})
+}
+
+func parseMKVAttachment(f io.ReaderAt, start, size int64) *mkvCover {
+	var name, mimeType string
+	var dataOff, dataSize int64
+	_ = ebmlChildren(f, start, start+size, func(id, off, elSize int64) (bool, error) {
+		switch id {
+		case mkvFileName:
+			name = ebmlString(f, off, elSize)
+		case mkvFileMimeType:
+			mimeType = ebmlString(f, off, elSize)
+		case mkvFileData:
+			dataOff, dataSize = off, elSize
+		}
+		return true, nil
+	})
+	if dataSize == 0 || !strings.HasPrefix(mimeType, "image/") || !strings.HasPrefix(strings.ToLower(name), "cover") {
+		return nil
+	}
+	return &mkvCover{offset: dataOff, size: dataSize, mime: mimeType}
+}
+
+// coverImageTypes are the sniffed types a cover image is served inline as.
+// Anything else, SVG and HTML included, could run script on this origin, so
+// it is sent as a sandboxed download instead.
+var coverImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// setCoverHeaders sets the content headers for an embedded cover image. The
+// type is sniffed from data; the type claimed by the container is ignored.
+func setCoverHeaders(w http.ResponseWriter, data []byte) {
+	h := w.Header()
+	if contentType := http.DetectContentType(data); coverImageTypes[contentType] {
+		h.Set("Content-Type", contentType)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Content-Disposition", "attachment")
+	}
+	h.Set("Content-Security-Policy", "sandbox")
+	h.Set("X-Content-Type-Options", "nosniff")
+}
+
+func readMediaCover(absPath string) ([]byte, error) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if mediaFormat(absPath) == "mkv" {
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		cover, err := parseMKV(f, st.Size(), &MediaInfo{Tags: map[string]string{}})
+		if err != nil || cover == nil || cover.size > mediaMaxMoovBox {
+			return nil, fmt.Errorf("没有封面图片")
+		}
+		data := make([]byte, cover.size)
+		if _, err := f.ReadAt(data, cover.offset); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	md, err := tag.ReadFrom(f)
+	if err != nil || md.Picture() == nil {
+		return nil, fmt.Errorf("没有封面图片")
+	}
+	return md.Picture().Data, nil
+}
+
+// attachMediaInfo fills the Media field of media files in a listing. Files
+// that cannot be parsed are left without metadata.
+func attachMediaInfo(dir string, files []FileInfo) {
+	absDir, err := ensurePathInRoot(dir)
+	if err != nil {
+		return
+	}
+	for i := range files {
+		if files[i].IsDir || mediaFormat(files[i].Name) == "" {
+			continue
+		}
+		absPath := filepath.Join(absDir, files[i].Name)
+		info, err := os.Stat(absPath)
+		if err != nil {
+			continue
+		}
+		if m, err := getMediaInfo(absPath, info); err == nil {
+			files[i].Media = m
+		}
+	}
+}
+
+func openMediaParam(w http.ResponseWriter, pathParam string) (string, os.FileInfo, bool) {
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", nil, false
+	}
+	if mediaFormat(absPath) == "" {
+		writeError(w, http.StatusBadRequest, "不支持的媒体格式")
+		return "", nil, false
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || info.IsDir() {
+		writeError(w, http.StatusNotFound, "文件不存在")
+		return "", nil, false
+	}
+	return absPath, info, true
+}
+
+func handleMediaInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "media/info/")
+	absPath, info, ok := openMediaParam(w, pathParam)
+	if !ok {
+		return
+	}
+	m, err := getMediaInfo(absPath, info)
+	if err != nil {
+		log.Printf("读取媒体信息失败 %s: %v", pathParam, err)
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("无法读取媒体信息: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"path":  pathParam,
+		"media": m,
+	})
+}
+
+func handleMediaCover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "media/cover/")
+	absPath, info, ok := openMediaParam(w, pathParam)
+	if !ok {
+		return
+	}
+	data, err := readMediaCover(absPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	setCoverHeaders(w, data)
+	w.Header().Set("ETag", `"`+cacheKey(absPath, strconv.FormatInt(info.ModTime().UnixNano(), 10))+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(data))
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMediaFormat(t *testing.T) {
+	tests := map[string]string{
+		"a.mp3": "mp3", "B.FLAC": "flac", "c.opus": "ogg", "d.ogv": "ogg", "e.m4b": "mp4",
+		"f.mov": "mp4", "g.webm": "mkv", "h.mka": "mkv", "i.wav": "", "mp3": "",
+	}
+	for name, want := range tests {
+		if got := mediaFormat(name); got != want {
+			t.Errorf("mediaFormat(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// approx compares durations after the rounding readMediaInfo applies.
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 0.0005
+}
+
+// mp3Frames repeats one frame header, padded to the frame length; first, if
+// set, replaces the start of the first frame's payload.
+func mp3Frames(header []byte, length, count int, first []byte) []byte {
+	var b []byte
+	for i := 0; i < count; i++ {
+		frame := make([]byte, length)
+		copy(frame, header)
+		if i == 0 {
+			copy(frame[4:], first)
+		}
+		b = append(b, frame...)
+	}
+	return b
+}
+
+func TestParseMP3(t *testing.T) {
+	mpeg1 := []byte{0xFF, 0xFB, 0x90, 0x00} // MPEG-1 layer III, 128 kbps, 44.1 kHz, stereo
+	mpeg2 := []byte{0xFF, 0xF3, 0x80, 0xC0} // MPEG-2 layer III, 64 kbps, 22.05 kHz, mono
+	xing := append(make([]byte, 32), "Xing\x00\x00\x00\x01\x00\x00\x00\x64"...)
+	vbrDuration := 100 * 1152 / 44100.0
+	id3 := append([]byte("ID3\x03\x00\x00\x00\x00\x00\x14"), make([]byte, 20)...)
+	tests := []struct {
+		name     string
+		data     []byte
+		wantErr  bool
+		codec    string
+		rate     int
+		channels int
+		duration float64
+		bitrate  int64
+	}{
+		{"CBR", mp3Frames(mpeg1, 417, 10, nil), false, "MP3", 44100, 2, 4170 * 8 / 128000.0, 128000},
+		{"CBR after ID3v2", append(id3, mp3Frames(mpeg1, 417, 10, nil)...), false, "MP3", 44100, 2, 4170 * 8 / 128000.0, 128000},
+		{"CBR with ID3v1", append(mp3Frames(mpeg1, 417, 10, nil), append([]byte("TAG"), make([]byte, 125)...)...), false, "MP3", 44100, 2, 4170 * 8 / 128000.0, 128000},
+		{"Xing VBR", mp3Frames(mpeg1, 417, 10, xing), false, "MP3", 44100, 2, vbrDuration, int64(4170 * 8 / vbrDuration)},
+		{"MPEG-2 mono", mp3Frames(mpeg2, 208, 10, nil), false, "MP3", 22050, 1, 2080 * 8 / 64000.0, 64000},
+		{"no frames", bytes.Repeat([]byte{0x55}, 1000), true, "", 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaInfo{Tags: map[string]string{}}
+			err := parseMP3(bytes.NewReader(tt.data), int64(len(tt.data)), m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMP3 error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if m.AudioCodec != tt.codec || m.SampleRate != tt.rate || m.Channels != tt.channels {
+				t.Errorf("got %s %d Hz %d ch, want %s %d Hz %d ch", m.AudioCodec, m.SampleRate, m.Channels, tt.codec, tt.rate, tt.channels)
+			}
+			if !approx(m.Duration, tt.duration) || m.Bitrate != tt.bitrate {
+				t.Errorf("duration %v bitrate %d, want %v and %d", m.Duration, m.Bitrate, tt.duration, tt.bitrate)
+			}
+		})
+	}
+}
+
+func flacFile(rate, channels int, samples uint64) []byte {
+	b := []byte("fLaC\x80\x00\x00\x22")
+	info := make([]byte, 34)
+	v := uint64(rate)<<44 | uint64(channels-1)<<41 | 15<<36 | samples
+	binary.BigEndian.PutUint64(info[10:], v)
+	return append(b, info...)
+}
+
+func TestParseFLAC(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantErr  bool
+		rate     int
+		channels int
+		duration float64
+	}{
+		{"stereo CD", flacFile(44100, 2, 441000), false, 44100, 2, 10},
+		{"hi-res 6ch", flacFile(96000, 6, 48000), false, 96000, 6, 0.5},
+		{"first block not STREAMINFO", append([]byte("fLaC\x04"), make([]byte, 40)...), true, 0, 0, 0},
+		{"not FLAC", append([]byte("ID3\x04"), make([]byte, 40)...), true, 0, 0, 0},
+		{"truncated", []byte("fLaC"), true, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaInfo{}
+			err := parseFLAC(bytes.NewReader(tt.data), m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFLAC error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (m.AudioCodec != "FLAC" || m.SampleRate != tt.rate || m.Channels != tt.channels || !approx(m.Duration, tt.duration)) {
+				t.Errorf("got %+v", m)
+			}
+		})
+	}
+}
+
+func oggPage(granule uint64, packet []byte) []byte {
+	b := []byte("OggS\x00\x02")
+	b = binary.LittleEndian.AppendUint64(b, granule)
+	b = append(b, make([]byte, 12)...)
+	b = append(b, 1, byte(len(packet)))
+	return append(b, packet...)
+}
+
+func TestParseOGG(t *testing.T) {
+	vorbis := []byte("\x01vorbis\x00\x00\x00\x00\x02")
+	vorbis = binary.LittleEndian.AppendUint32(vorbis, 44100)
+	vorbis = binary.LittleEndian.AppendUint32(vorbis, 0)
+	vorbis = binary.LittleEndian.AppendUint32(vorbis, 160000)
+	vorbis = append(vorbis, make([]byte, 8)...)
+
+	opus := []byte("OpusHead\x01\x01")
+	opus = binary.LittleEndian.AppendUint16(opus, 312)
+	opus = binary.LittleEndian.AppendUint32(opus, 44100)
+	opus = append(opus, 0, 0, 0, 0)
+
+	oggFlac := append([]byte("\x7fFLAC\x01\x00\x00\x01fLaC"), flacFile(48000, 2, 0)[4:]...)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantErr  bool
+		audio    string
+		video    string
+		rate     int
+		channels int
+		duration float64
+		bitrate  int64
+	}{
+		{"Vorbis", append(oggPage(0, vorbis), oggPage(441000, []byte("audio"))...), false, "Vorbis", "", 44100, 2, 10, 160000},
+		{"Opus pre-skip", append(oggPage(0, opus), oggPage(48000*5+312, []byte("audio"))...), false, "Opus", "", 44100, 1, 5, 0},
+		{"FLAC in Ogg", append(oggPage(0, oggFlac), oggPage(96000, []byte("audio"))...), false, "FLAC", "", 48000, 2, 2, 0},
+		{"Theora", oggPage(0, append([]byte("\x80theora"), make([]byte, 40)...)), false, "", "Theora", 0, 0, 0, 0},
+		{"unknown codec", oggPage(0, append([]byte("\x01speexx"), make([]byte, 40)...)), true, "", "", 0, 0, 0, 0},
+		{"not Ogg", append([]byte("RIFF"), make([]byte, 60)...), true, "", "", 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaInfo{}
+			err := parseOGG(bytes.NewReader(tt.data), int64(len(tt.data)), m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOGG error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			want := MediaInfo{AudioCodec: tt.audio, VideoCodec: tt.video, SampleRate: tt.rate, Channels: tt.channels, Bitrate: tt.bitrate}
+			got := *m
+			got.Duration = 0
+			if !reflect.DeepEqual(got, want) || !approx(m.Duration, tt.duration) {
+				t.Errorf("got %+v, want %+v with duration %v", m, want, tt.duration)
+			}
+		})
+	}
+}
+
+func mp4Box32(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+func mp4Mvhd(version byte, timescale uint32, duration uint64) []byte {
+	b := []byte{version, 0, 0, 0}
+	if version == 1 {
+		b = append(b, make([]byte, 16)...)
+		b = binary.BigEndian.AppendUint32(b, timescale)
+		b = binary.BigEndian.AppendUint64(b, duration)
+	} else {
+		b = append(b, make([]byte, 8)...)
+		b = binary.BigEndian.AppendUint32(b, timescale)
+		b = binary.BigEndian.AppendUint32(b, uint32(duration))
+	}
+	return mp4Box32("mvhd", append(b, make([]byte, 80)...))
+}
+
+func mp4Trak(handler, fourcc string, a, b uint16, rate uint32) []byte {
+	entry := make([]byte, 36)
+	copy(entry[4:], fourcc)
+	if handler == "vide" {
+		binary.BigEndian.PutUint16(entry[32:], a)
+		binary.BigEndian.PutUint16(entry[34:], b)
+	} else {
+		binary.BigEndian.PutUint16(entry[24:], a)
+		binary.BigEndian.PutUint32(entry[32:], rate<<16)
+	}
+	binary.BigEndian.PutUint32(entry, uint32(len(entry)))
+	hdlr := append(make([]byte, 8), handler...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+	stsd := append([]byte{0, 0, 0, 0, 0, 0, 0, 1}, entry...)
+	return mp4Box32("trak", mp4Box32("mdia",
+		mp4Box32("hdlr", hdlr),
+		mp4Box32("minf", mp4Box32("stbl", mp4Box32("stsd", stsd))),
+	))
+}
+
+func TestParseMP4(t *testing.T) {
+	ftyp := mp4Box32("ftyp", []byte("isom\x00\x00\x02\x00isomavc1"))
+	mdat := mp4Box32("mdat", make([]byte, 64))
+	largeMdat := append(append([]byte{0, 0, 0, 1}, "mdat"...), binary.BigEndian.AppendUint64(nil, 16+32)...)
+	largeMdat = append(largeMdat, make([]byte, 32)...)
+	moov := mp4Box32("moov", mp4Mvhd(0, 1000, 90500), mp4Trak("vide", "avc1", 1280, 720, 0), mp4Trak("soun", "mp4a", 2, 0, 48000))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		want    MediaInfo
+	}{
+		{"moov first", bytes.Join([][]byte{ftyp, moov, mdat}, nil), false,
+			MediaInfo{Duration: 90.5, VideoCodec: "H.264", Width: 1280, Height: 720, AudioCodec: "AAC", Channels: 2, SampleRate: 48000}},
+		{"moov after 64-bit mdat", bytes.Join([][]byte{ftyp, largeMdat, moov}, nil), false,
+			MediaInfo{Duration: 90.5, VideoCodec: "H.264", Width: 1280, Height: 720, AudioCodec: "AAC", Channels: 2, SampleRate: 48000}},
+		{"version 1 mvhd, audio only", bytes.Join([][]byte{ftyp, mp4Box32("moov", mp4Mvhd(1, 44100, 44100*3), mp4Trak("soun", "alac", 1, 0, 44100))}, nil), false,
+			MediaInfo{Duration: 3, AudioCodec: "ALAC", Channels: 1, SampleRate: 44100}},
+		{"unknown codec keeps fourcc", bytes.Join([][]byte{mp4Box32("moov", mp4Mvhd(0, 600, 600), mp4Trak("vide", "xyz1", 640, 480, 0))}, nil), false,
+			MediaInfo{Duration: 1, VideoCodec: "xyz1", Width: 640, Height: 480}},
+		{"no moov", bytes.Join([][]byte{ftyp, mdat}, nil), true, MediaInfo{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaInfo{}
+			err := parseMP4(bytes.NewReader(tt.data), int64(len(tt.data)), m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMP4 error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(*m, tt.want) {
+				t.Errorf("got %+v, want %+v", *m, tt.want)
+			}
+		})
+	}
+}
+
+// ebml encodes one element; IDs carry their length marker already.
+func ebml(id uint32, payload ...[]byte) []byte {
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> shift); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+	body := bytes.Join(payload, nil)
+	if len(body) < 0x7F {
+		b = append(b, 0x80|byte(len(body)))
+	} else {
+		b = append(b, 0x01)
+		b = append(b, binary.BigEndian.AppendUint64(nil, uint64(len(body)))[1:]...)
+	}
+	return append(b, body...)
+}
+
+// ebmlUnknown encodes a master element of unknown size.
+func ebmlUnknown(id uint32, payload ...[]byte) []byte {
+	b := ebml(id)
+	b = append(b[:len(b)-1], 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	return append(b, bytes.Join(payload, nil)...)
+}
+
+func ebmlU(id uint32, v uint64) []byte {
+	return ebml(id, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func ebmlF(id uint32, v float64) []byte {
+	return ebml(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func ebmlF32(id uint32, v float32) []byte {
+	return ebml(id, binary.BigEndian.AppendUint32(nil, math.Float32bits(v)))
+}
+
+func ebmlS(id uint32, s string) []byte {
+	return ebml(id, []byte(s))
+}
+
+func TestParseMKV(t *testing.T) {
+	header := func(docType string) []byte {
+		return ebml(mkvEBML, ebmlS(mkvDocType, docType))
+	}
+	info := ebml(mkvInfo, ebmlU(mkvTimecodeScale, 1000000), ebmlF(mkvDuration, 12345), ebmlS(mkvTitle, "Movie"))
+	tracks := ebml(mkvTracks,
+		ebml(mkvTrackEntry, ebmlU(mkvTrackType, 1), ebmlS(mkvCodecID, "V_VP9"), ebml(mkvVideo, ebmlU(mkvPixelWidth, 1920), ebmlU(mkvPixelHeight, 1080))),
+		ebml(mkvTrackEntry, ebmlU(mkvTrackType, 2), ebmlS(mkvCodecID, "A_OPUS"), ebml(mkvAudio, ebmlF32(mkvSamplingFreq, 48000), ebmlU(mkvChannels, 2))),
+		ebml(mkvTrackEntry, ebmlU(mkvTrackType, 2), ebmlS(mkvCodecID, "A_AAC"), ebml(mkvAudio, ebmlF32(mkvSamplingFreq, 44100), ebmlU(mkvChannels, 6))),
+	)
+	tags := ebml(mkvTags, ebml(mkvTag,
+		ebml(mkvSimpleTag, ebmlS(mkvTagName, "ARTIST"), ebmlS(mkvTagString, "Someone")),
+		ebml(mkvSimpleTag, ebmlS(mkvTagName, "DATE_RELEASED"), ebmlS(mkvTagString, "2020")),
+	))
+	attachment := func(name, mimeType string) []byte {
+		return ebml(mkvAttachments, ebml(mkvAttachedFile, ebmlS(mkvFileName, name), ebmlS(mkvFileMimeType, mimeType), ebmlS(mkvFileData, "IMAGEDATA")))
+	}
+	cluster := ebml(mkvCluster, make([]byte, 200))
+	full := MediaInfo{
+		Format: "webm", Duration: 12.345, VideoCodec: "VP9", Width: 1920, Height: 1080,
+		AudioCodec: "Opus", SampleRate: 48000, Channels: 2, HasCover: true,
+		Tags: map[string]string{"title": "Movie", "artist": "Someone", "year": "2020"},
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantErr   bool
+		want      MediaInfo
+		wantCover string
+	}{
+		{"webm with everything", append(header("webm"), ebml(mkvSegment, info, tracks, tags, attachment("cover.jpg", "image/jpeg"), cluster)...), false, full, "image/jpeg"},
+		{"metadata after cluster", append(header("webm"), ebml(mkvSegment, info, cluster, tracks, tags, attachment("cover.jpg", "image/jpeg"))...), false, full, "image/jpeg"},
+		{"unknown-size segment and cluster", append(header("matroska"), ebmlUnknown(mkvSegment, info, ebmlUnknown(mkvCluster, make([]byte, 50)))...), false,
+			MediaInfo{Format: "mkv", Duration: 12.345, Tags: map[string]string{"title": "Movie"}}, ""},
+		{"attachments that are not covers", append(header("matroska"), ebml(mkvSegment, attachment("font.ttf", "font/ttf"), attachment("cover.txt", "text/plain"))...), false,
+			MediaInfo{Format: "mkv", Tags: map[string]string{}}, ""},
+		{"segment before header", append(ebml(mkvSegment, info), header("webm")...), true, MediaInfo{}, ""},
+		{"not EBML", []byte("RIFF\x00\x00\x00\x00AVI LIST"), true, MediaInfo{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaInfo{Format: "mkv", Tags: map[string]string{}}
+			r := bytes.NewReader(tt.data)
+			cover, err := parseMKV(r, int64(len(tt.data)), m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMKV error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			m.Duration = math.Round(m.Duration*1000) / 1000
+			if !reflect.DeepEqual(*m, tt.want) {
+				t.Errorf("got %+v, want %+v", *m, tt.want)
+			}
+			if tt.wantCover == "" {
+				if cover != nil {
+					t.Errorf("unexpected cover %+v", cover)
+				}
+				return
+			}
+			if cover == nil || cover.mime != tt.wantCover {
+				t.Fatalf("cover = %+v, want %s", cover, tt.wantCover)
+			}
+			data := make([]byte, cover.size)
+			if _, err := r.ReadAt(data, cover.offset); err != nil || string(data) != "IMAGEDATA" {
+				t.Errorf("cover data = %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestHandleMediaCover(t *testing.T) {
+	savedRoot := rootDir
+	rootDir = t.TempDir()
+	defer func() { rootDir = savedRoot }()
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+	mkv := func(mimeType string, data []byte) []byte {
+		return append(ebml(mkvEBML, ebmlS(mkvDocType, "matroska")), ebml(mkvSegment,
+			ebml(mkvAttachments, ebml(mkvAttachedFile, ebmlS(mkvFileName, "cover"), ebmlS(mkvFileMimeType, mimeType), ebml(mkvFileData, data))))...)
+	}
+	tests := []struct {
+		name        string
+		data        []byte
+		status      int
+		contentType string
+		attachment  bool
+	}{
+		{"PNG served inline", mkv("image/png", png), http.StatusOK, "image/png", false},
+		{"PNG claimed as JPEG", mkv("image/jpeg", png), http.StatusOK, "image/png", false},
+		{"SVG downloaded", mkv("image/svg+xml", svg), http.StatusOK, "application/octet-stream", true},
+		{"HTML downloaded", mkv("image/jpeg", []byte("<html><script>alert(1)</script>")), http.StatusOK, "application/octet-stream", true},
+		{"no cover", mkv("font/ttf", png), http.StatusNotFound, "", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("video%d.mkv", i)
+			if err := os.WriteFile(filepath.Join(rootDir, name), tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			handleMediaCover(w, httptest.NewRequest(http.MethodGet, "/api/media/cover/"+name, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			h := w.Header()
+			if h.Get("Content-Type") != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", h.Get("Content-Type"), tt.contentType)
+			}
+			if got := h.Get("Content-Disposition") == "attachment"; got != tt.attachment {
+				t.Errorf("Content-Disposition = %q", h.Get("Content-Disposition"))
+			}
+			if h.Get("Content-Security-Policy") != "sandbox" || h.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("missing CSP or nosniff: %v", h)
+			}
+		})
+	}
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// In stripLocation mode EXIF GPS is blanked field by field, but XMP packets
+// that mention any location key and JPEG APP13 (Photoshop/IPTC) blocks are
+// dropped whole, so non-location XMP and IPTC data such as captions go with
+// them. stripAll removes everything except the EXIF orientation.
+const (
+	stripLocation = "location"
+	stripAll      = "all"
+)
+
+var (
+	uploadProcessorsMu sync.Mutex
+	uploadProcessors   = map[string]string{}
+)
+
+var xmpLocationKeys = [][]byte{
+	[]byte("GPS"), []byte("photoshop:City"), []byte("photoshop:State"), []byte("photoshop:Country"),
+	[]byte("Iptc4xmpCore:Location"), []byte("Iptc4xmpExt:LocationCreated"), []byte("Iptc4xmpExt:LocationShown"),
+}
+
+func uploadProcessorsFile() string {
+	return filepath.Join(appRootDir, "upload_processors.json")
+}
+
+func loadUploadProcessors() {
+	data, err := os.ReadFile(uploadProcessorsFile())
+	if err != nil {
+		return
+	}
+	uploadProcessorsMu.Lock()
+	defer uploadProcessorsMu.Unlock()
+	if err := json.Unmarshal(data, &uploadProcessors); err != nil {
+		log.Printf("读取上传处理规则失败: %v", err)
+	}
+}
+
+func saveUploadProcessors() error {
+	data, err := json.MarshalIndent(uploadProcessors, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(uploadProcessorsFile(), data, 0644)
+}
+
+// metadataStripMode returns the rule of the nearest configured ancestor of
+// relDir, so a rule on "public" also covers "public/2024".
+func metadataStripMode(relDir string) string {
+	uploadProcessorsMu.Lock()
+	defer uploadProcessorsMu.Unlock()
+	dir := filepath.ToSlash(filepath.Clean(relDir))
+	for {
+		if mode, ok := uploadProcessors[dir]; ok {
+			return mode
+		}
+		if dir == "." || dir == "/" || dir == "" {
+			return ""
+		}
+		dir = filepath.ToSlash(filepath.Dir(dir))
+	}
+}
+
+func stripMetadataFile(tempPath, mode string) ([]string, error) {
+	src, err := os.Open(tempPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	br := bufio.NewReaderSize(src, 64*1024)
+	magic, _ := br.Peek(12)
+
+	var process func(r *bufio.Reader, w io.Writer, mode string) ([]string, error)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xFF, 0xD8}):
+		process = stripJPEG
+	case bytes.HasPrefix(magic, []byte("\x89PNG\r\n\x1a\n")):
+		process = stripPNG
+	case len(magic) == 12 && string(magic[:4]) == "RIFF" && string(magic[8:12]) == "WEBP":
+		process = func(_ *bufio.Reader, w io.Writer, mode string) ([]string, error) {
+			return stripWebP(src, w, mode)
+		}
+	default:
+		return nil, nil
+	}
+
+	dst, err := os.CreateTemp(filepath.Dir(tempPath), "fileuploader-strip-*")
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriterSize(dst, 64*1024)
+	stripped, err := process(br, bw, mode)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || len(stripped) == 0 {
+		_ = os.Remove(dst.Name())
+		return nil, err
+	}
+	if err := os.Rename(dst.Name(), tempPath); err != nil {
+		_ = os.Remove(dst.Name())
+		return nil, err
+	}
+	return stripped, nil
+}
+
+// stripGPSFromTIFF blanks the GPS IFD of an EXIF/TIFF block in place.
+func stripGPSFromTIFF(tiff []byte) bool {
+	if len(tiff) < 8 {
+		return false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:8]))
+	ptr, ok := ifd0[exifTagGPSIFD]
+	if !ok || len(ptr.value) < 4 {
+		return false
+	}
+	offset := order.Uint32(ptr.value)
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return false
+	}
+	for _, e := range readIFD(tiff, order, offset) {
+		for i := range e.value {
+			e.value[i] = 0
+		}
+	}
+	count := uint64(order.Uint16(tiff[offset:]))
+	end := min(uint64(offset)+2+count*12, uint64(len(tiff)))
+	for i := uint64(offset) + 2; i < end; i++ {
+		tiff[i] = 0
+	}
+	order.PutUint16(tiff[offset:], 0)
+	return true
+}
+
+func orientationOnlyEXIF(tiff []byte) []byte {
+	info, err := parseEXIF(tiff)
+	if err != nil || info.Orientation <= 1 {
+		return nil
+	}
+	var b bytes.Buffer
+	b.WriteString("II*\x00")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(8))
+	_ = binary.Write(&b, binary.LittleEndian, uint16(1))
+	_ = binary.Write(&b, binary.LittleEndian, []uint16{exifTagOrientation, 3})
+	_ = binary.Write(&b, binary.LittleEndian, uint32(1))
+	_ = binary.Write(&b, binary.LittleEndian, []uint16{uint16(info.Orientation), 0})
+	_ = binary.Write(&b, binary.LittleEndian, uint32(0))
+	return b.Bytes()
+}
+
+func xmpHasLocation(xmp []byte) bool {
+	for _, key := range xmpLocationKeys {
+		if bytes.Contains(xmp, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripJPEG cleans the primary image and then any further images appended
+// after its EOI, as MPF files (multi-frame previews, depth maps) do. The
+// offsets of those images are recorded in the primary image, so they are
+// cleaned in place: metadata segments are zeroed rather than removed and
+// keep their length. Anything else after the primary image is copied as is.
+func stripJPEG(r *bufio.Reader, w io.Writer, mode string) ([]string, error) {
+	var stripped []string
+	note := func(s string) {
+		for _, existing := range stripped {
+			if existing == s {
+				return
+			}
+		}
+		stripped = append(stripped, s)
+	}
+	if err := stripJPEGImage(r, w, mode, false, note); err != nil {
+		return nil, err
+	}
+	for {
+		if next, err := r.Peek(2); err != nil || next[0] != 0xFF || next[1] != 0xD8 {
+			break
+		}
+		if err := stripJPEGImage(r, w, mode, true, note); err != nil {
+			return nil, err
+		}
+	}
+	_, err := io.Copy(w, r)
+	return stripped, err
+}
+
+// nextJPEGMarker reads the next marker and returns its kind. Fill bytes
+// before it are passed through.
+func nextJPEGMarker(r *bufio.Reader, w io.Writer) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("JPEG结构损坏")
+	}
+	for {
+		kind, err := r.ReadByte()
+		if err != nil || kind != 0xFF {
+			return kind, err
+		}
+		if _, err := w.Write([]byte{0xFF}); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// copyJPEGScan copies entropy-coded data up to the next marker and leaves
+// the marker unread. Stuffed zero bytes, restart markers and fill bytes
+// belong to the data.
+func copyJPEGScan(r *bufio.Reader, w io.Writer) error {
+	for {
+		chunk, err := r.ReadSlice(0xFF)
+		if err == bufio.ErrBufferFull || err == io.EOF {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			if err == io.EOF {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk[:len(chunk)-1]); err != nil {
+			return err
+		}
+		if err := r.UnreadByte(); err != nil {
+			return err
+		}
+		next, err := r.Peek(2)
+		if err != nil {
+			// The caller copies the unread rest.
+			return err
+		}
+		n := 2
+		switch kind := next[1]; {
+		case kind == 0xFF:
+			n = 1
+		case kind != 0x00 && (kind < 0xD0 || kind > 0xD7):
+			return nil
+		}
+		if _, err := w.Write(next[:n]); err != nil {
+			return err
+		}
+		if _, err := r.Discard(n); err != nil {
+			return err
+		}
+	}
+}
+
+// stripJPEGImage copies one image from SOI to EOI, dropping or, inPlace,
+// zeroing the metadata segments.
+func stripJPEGImage(r *bufio.Reader, w io.Writer, mode string, inPlace bool, note func(string)) error {
+	writeSegment := func(kind byte, data []byte) error {
+		hdr := []byte{0xFF, kind, byte((len(data) + 2) >> 8), byte(len(data) + 2)}
+		if _, err := w.Write(hdr); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	}
+	drop := func(kind byte, data []byte, label string) error {
+		note(label)
+		if !inPlace {
+			return nil
+		}
+		return writeSegment(kind, make([]byte, len(data)))
+	}
+
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+	for {
+		kind, err := nextJPEGMarker(r, w)
+		if err != nil {
+			return err
+		}
+		if kind == 0xD9 {
+			_, err := w.Write([]byte{0xFF, kind})
+			return err
+		}
+		if kind == 0x01 || (kind >= 0xD0 && kind <= 0xD8) {
+			if _, err := w.Write([]byte{0xFF, kind}); err != nil {
+				return err
+			}
+			continue
+		}
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(lenBuf[:])) - 2
+		if length < 0 {
+			return fmt.Errorf("JPEG结构损坏")
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		switch {
+		case kind == 0xDA:
+			if err := writeSegment(kind, data); err != nil {
+				return err
+			}
+			if err := copyJPEGScan(r, w); err == io.EOF {
+				// Truncated after the scan started: keep what is there.
+				return nil
+			} else if err != nil {
+				return err
+			}
+			continue
+		case kind == 0xE1 && bytes.HasPrefix(data, []byte("Exif\x00\x00")):
+			if mode == stripAll {
+				minimal := orientationOnlyEXIF(data[6:])
+				if inPlace || minimal == nil {
+					if err := drop(kind, data, "EXIF"); err != nil {
+						return err
+					}
+					continue
+				}
+				note("EXIF")
+				data = append([]byte("Exif\x00\x00"), minimal...)
+			} else if stripGPSFromTIFF(data[6:]) {
+				note("EXIF GPS")
+			}
+		case kind == 0xE1 && bytes.HasPrefix(data, []byte("http://ns.adobe.com/")):
+			if mode == stripAll || xmpHasLocation(data) {
+				if err := drop(kind, data, "XMP"); err != nil {
+					return err
+				}
+				continue
+			}
+		case kind == 0xED:
+			if err := drop(kind, data, "IPTC"); err != nil {
+				return err
+			}
+			continue
+		case kind == 0xFE && mode == stripAll:
+			if err := drop(kind, data, "JPEG注释"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeSegment(kind, data); err != nil {
+			return err
+		}
+	}
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	_, err := w.Write(sum[:])
+	return err
+}
+
+func stripPNG(r *bufio.Reader, w io.Writer, mode string) ([]string, error) {
+	var stripped []string
+	var sig [8]byte
+	if _, err := io.ReadFull(r, sig[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sig[:]); err != nil {
+		return nil, err
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return stripped, nil
+			}
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(hdr[:4])
+		typ := string(hdr[4:8])
+		if typ == "IDAT" || length > 64*1024*1024 {
+			if _, err := w.Write(hdr[:]); err != nil {
+				return nil, err
+			}
+			if _, err := io.CopyN(w, r, int64(length)+4); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(4); err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "eXIf":
+			if mode == stripAll {
+				stripped = append(stripped, "EXIF")
+				continue
+			}
+			if stripGPSFromTIFF(data) {
+				stripped = append(stripped, "EXIF GPS")
+			}
+		case "iTXt", "tEXt", "zTXt":
+			isXMP := bytes.HasPrefix(data, []byte("XML:com.adobe.xmp\x00"))
+			if mode == stripAll || (isXMP && xmpHasLocation(data)) {
+				label := "PNG文本"
+				if isXMP {
+					label = "XMP"
+				}
+				stripped = append(stripped, label)
+				continue
+			}
+		case "tIME":
+			if mode == stripAll {
+				stripped = append(stripped, "PNG时间")
+				continue
+			}
+		}
+		if err := writePNGChunk(w, typ, data); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// webpChunkHeader reads the next chunk header; ok is false at the end of
+// the file.
+func webpChunkHeader(r *bufio.Reader) (typ string, size uint32, ok bool, err error) {
+	var ch [8]byte
+	if _, err := io.ReadFull(r, ch[:]); err != nil {
+		if err == io.EOF {
+			return "", 0, false, nil
+		}
+		return "", 0, false, err
+	}
+	size = binary.LittleEndian.Uint32(ch[4:])
+	if size > 1<<30 {
+		return "", 0, false, fmt.Errorf("WebP结构损坏")
+	}
+	return string(ch[:4]), size, true, nil
+}
+
+// skipWebPPadding discards the pad byte after an odd-sized chunk; some
+// encoders leave it out at the end of the file.
+func skipWebPPadding(r *bufio.Reader, size uint32) error {
+	if size%2 == 0 {
+		return nil
+	}
+	if _, err := r.Discard(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func writeWebPChunk(w io.Writer, typ string, data []byte) error {
+	var ch [8]byte
+	copy(ch[:4], typ)
+	binary.LittleEndian.PutUint32(ch[4:], uint32(len(data)))
+	if _, err := w.Write(ch[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if len(data)%2 == 1 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// stripWebP makes two passes over src: the first reads only the small
+// metadata chunks to decide what to drop and how large the result will be,
+// the second streams the image chunks through unchanged. The RIFF size in the
+// header has to be known before anything is written.
+func stripWebP(src io.ReadSeeker, w io.Writer, mode string) ([]string, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(src, 64*1024)
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	var stripped []string
+	dropped := map[int]bool{}
+	replaced := map[int][]byte{}
+	vp8x := -1
+	hasEXIF, hasXMP := false, false
+	var total uint32 = 4
+	for i := 0; ; i++ {
+		typ, size, ok, err := webpChunkHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		switch typ {
+		case "EXIF", "XMP ", "VP8X":
+			if size > 64*1024*1024 {
+				return nil, fmt.Errorf("WebP元数据过大")
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			switch {
+			case typ == "VP8X":
+				vp8x = i
+				replaced[i] = data
+			case typ == "EXIF" && mode == stripAll:
+				stripped = append(stripped, "EXIF")
+				dropped[i] = true
+			case typ == "EXIF":
+				tiff := data
+				if bytes.HasPrefix(tiff, []byte("Exif\x00\x00")) {
+					tiff = tiff[6:]
+				}
+				if stripGPSFromTIFF(tiff) {
+					stripped = append(stripped, "EXIF GPS")
+					replaced[i] = data
+				}
+			case mode == stripAll || xmpHasLocation(data):
+				stripped = append(stripped, "XMP")
+				dropped[i] = true
+			}
+		default:
+			if _, err := r.Discard(int(size)); err != nil {
+				return nil, err
+			}
+		}
+		if err := skipWebPPadding(r, size); err != nil {
+			return nil, err
+		}
+		if dropped[i] {
+			continue
+		}
+		hasEXIF = hasEXIF || typ == "EXIF"
+		hasXMP = hasXMP || typ == "XMP "
+		total += 8 + size + size%2
+	}
+	if len(stripped) == 0 {
+		return nil, nil
+	}
+	if data := replaced[vp8x]; len(data) > 0 {
+		if !hasEXIF {
+			data[0] &^= 0x08
+		}
+		if !hasXMP {
+			data[0] &^= 0x04
+		}
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r.Reset(src)
+	if _, err := r.Discard(12); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(hdr[4:8], total)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		typ, size, ok, err := webpChunkHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return stripped, nil
+		}
+		if data, ok := replaced[i]; ok || dropped[i] {
+			if _, err := r.Discard(int(size)); err != nil {
+				return nil, err
+			}
+			if ok && !dropped[i] {
+				if err := writeWebPChunk(w, typ, data); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			var ch [8]byte
+			copy(ch[:4], typ)
+			binary.LittleEndian.PutUint32(ch[4:], size)
+			if _, err := w.Write(ch[:]); err != nil {
+				return nil, err
+			}
+			if _, err := io.CopyN(w, r, int64(size)); err != nil {
+				return nil, err
+			}
+			if size%2 == 1 {
+				if _, err := w.Write([]byte{0}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := skipWebPPadding(r, size); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func handleUploadProcessors(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		uploadProcessorsMu.Lock()
+		type rule struct {
+			Path string `json:"path"`
+			Mode string `json:"mode"`
+		}
+		rules := make([]rule, 0, len(uploadProcessors))
+		for p, mode := range uploadProcessors {
+			rules = append(rules, rule{Path: p, Mode: mode})
+		}
+		uploadProcessorsMu.Unlock()
+		sort.Slice(rules, func(i, j int) bool { return rules[i].Path < rules[j].Path })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"rules": rules,
+		})
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, "无法解析请求")
+			return
+		}
+		absPath, err := ensurePathInRoot(r.FormValue("path"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		mode := strings.TrimSpace(r.FormValue("mode"))
+		if mode != "" && mode != stripLocation && mode != stripAll {
+			writeError(w, http.StatusBadRequest, "mode 只能是 location、all 或空")
+			return
+		}
+		relPath, _ := filepath.Rel(rootDir, absPath)
+		relPath = filepath.ToSlash(relPath)
+		uploadProcessorsMu.Lock()
+		if mode == "" {
+			delete(uploadProcessors, relPath)
+		} else {
+			uploadProcessors[relPath] = mode
+		}
+		err = saveUploadProcessors()
+		uploadProcessorsMu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法保存上传处理规则: %v", err))
+			return
+		}
+		log.Printf("上传处理规则已更新: %s -> %q", relPath, mode)
+		writeJSON(w, http.StatusOK, SuccessResponse{Message: "上传处理规则已保存"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
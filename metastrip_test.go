@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testIFDEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// testTIFF builds small EXIF/TIFF blocks in one byte order.
+type testTIFF struct {
+	order binary.ByteOrder
+}
+
+func (t testTIFF) short(tag, v uint16) testIFDEntry {
+	b := make([]byte, 2)
+	t.order.PutUint16(b, v)
+	return testIFDEntry{tag: tag, typ: 3, count: 1, value: b}
+}
+
+func (t testTIFF) long(tag uint16, v uint32) testIFDEntry {
+	b := make([]byte, 4)
+	t.order.PutUint32(b, v)
+	return testIFDEntry{tag: tag, typ: 4, count: 1, value: b}
+}
+
+func (t testTIFF) ascii(tag uint16, s string) testIFDEntry {
+	return testIFDEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), value: []byte(s + "\x00")}
+}
+
+// rational takes numerator/denominator pairs.
+func (t testTIFF) rational(tag uint16, pairs ...uint32) testIFDEntry {
+	b := make([]byte, 4*len(pairs))
+	for i, v := range pairs {
+		t.order.PutUint32(b[i*4:], v)
+	}
+	return testIFDEntry{tag: tag, typ: 5, count: uint32(len(pairs) / 2), value: b}
+}
+
+// gps returns a GPS IFD for the given whole-degree coordinates.
+func (t testTIFF) gps(latRef string, lat uint32, lonRef string, lon uint32) []testIFDEntry {
+	return []testIFDEntry{
+		t.ascii(exifTagGPSLatitudeRef, latRef),
+		t.rational(exifTagGPSLatitude, lat, 1, 0, 1, 0, 1),
+		t.ascii(exifTagGPSLongitudeRef, lonRef),
+		t.rational(exifTagGPSLongitude, lon, 1, 0, 1, 0, 1),
+	}
+}
+
+// build lays out the sub-IFDs first so IFD0 can point at them.
+func (t testTIFF) build(ifd0, exifIFD, gpsIFD []testIFDEntry) []byte {
+	buf := make([]byte, 8)
+	if t.order == binary.LittleEndian {
+		copy(buf, "II*\x00")
+	} else {
+		copy(buf, "MM\x00*")
+	}
+	writeIFD := func(entries []testIFDEntry) uint32 {
+		off := uint32(len(buf))
+		dataOff := off + 2 + uint32(len(entries))*12 + 4
+		ifd := make([]byte, dataOff-off)
+		t.order.PutUint16(ifd, uint16(len(entries)))
+		var extra []byte
+		for i, e := range entries {
+			p := 2 + i*12
+			t.order.PutUint16(ifd[p:], e.tag)
+			t.order.PutUint16(ifd[p+2:], e.typ)
+			t.order.PutUint32(ifd[p+4:], e.count)
+			if len(e.value) <= 4 {
+				copy(ifd[p+8:], e.value)
+			} else {
+				t.order.PutUint32(ifd[p+8:], dataOff+uint32(len(extra)))
+				extra = append(extra, e.value...)
+			}
+		}
+		buf = append(buf, ifd...)
+		buf = append(buf, extra...)
+		return off
+	}
+	entries := append([]testIFDEntry(nil), ifd0...)
+	if exifIFD != nil {
+		entries = append(entries, t.long(exifTagExifIFD, writeIFD(exifIFD)))
+	}
+	if gpsIFD != nil {
+		entries = append(entries, t.long(exifTagGPSIFD, writeIFD(gpsIFD)))
+	}
+	// writeIFD grows buf, so index it only afterwards.
+	ifd0Off := writeIFD(entries)
+	t.order.PutUint32(buf[4:], ifd0Off)
+	return buf
+}
+
+var (
+	xmpWithLocation = "<x:xmpmeta><rdf:Description exif:GPSLatitude=\"1,0N\"/></x:xmpmeta>"
+	xmpPlain        = "<x:xmpmeta><rdf:Description dc:title=\"t\"/></x:xmpmeta>"
+)
+
+func testJPEG(segments ...[]byte) []byte {
+	b := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		b = append(b, s...)
+	}
+	return append(b, 0xFF, 0xDA, 0x00, 0x02, 0x11, 0x22, 0xFF, 0xD9)
+}
+
+func jpegSegment(kind byte, data []byte) []byte {
+	return append([]byte{0xFF, kind, byte((len(data) + 2) >> 8), byte(len(data) + 2)}, data...)
+}
+
+// jpegLabels lists the segments of a JPEG up to the scan, with the EXIF and
+// XMP APP1 blocks told apart.
+func jpegLabels(t *testing.T, b []byte) ([]string, []byte) {
+	t.Helper()
+	var labels []string
+	var exif []byte
+	for pos := 2; pos+4 <= len(b); {
+		kind := b[pos+1]
+		if kind == 0xDA {
+			return append(labels, "SOS"), exif
+		}
+		length := int(binary.BigEndian.Uint16(b[pos+2:]))
+		data := b[pos+4 : pos+2+length]
+		label := fmt.Sprintf("%02X", kind)
+		switch {
+		case kind == 0xE1 && bytes.HasPrefix(data, []byte("Exif\x00\x00")):
+			label, exif = "Exif", data[6:]
+		case kind == 0xE1:
+			label = "XMP"
+		}
+		labels = append(labels, label)
+		pos += 2 + length
+	}
+	t.Fatal("JPEG without scan")
+	return nil, nil
+}
+
+func testPNG(chunks ...[2]string) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	for _, c := range chunks {
+		_ = writePNGChunk(&b, c[0], []byte(c[1]))
+	}
+	return b.Bytes()
+}
+
+// pngChunks lists the chunk types of a PNG and checks every CRC.
+func pngChunks(t *testing.T, b []byte) ([]string, map[string][]byte) {
+	t.Helper()
+	var types []string
+	data := map[string][]byte{}
+	for pos := 8; pos < len(b); {
+		length := int(binary.BigEndian.Uint32(b[pos:]))
+		typ := string(b[pos+4 : pos+8])
+		body := b[pos+8 : pos+8+length]
+		if crc32.ChecksumIEEE(b[pos+4:pos+8+length]) != binary.BigEndian.Uint32(b[pos+8+length:]) {
+			t.Errorf("bad CRC in %s chunk", typ)
+		}
+		types = append(types, typ)
+		data[typ] = body
+		pos += 12 + length
+	}
+	return types, data
+}
+
+func testWebP(chunks ...[2]string) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for _, c := range chunks {
+		_ = writeWebPChunk(&body, c[0], []byte(c[1]))
+	}
+	b := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(b[4:], uint32(body.Len()))
+	return append(b, body.Bytes()...)
+}
+
+// webpChunks lists the chunk types of a WebP and checks the RIFF size.
+func webpChunks(t *testing.T, b []byte) ([]string, map[string][]byte) {
+	t.Helper()
+	if got := binary.LittleEndian.Uint32(b[4:]); int(got) != len(b)-8 {
+		t.Errorf("RIFF size %d, file has %d bytes after the header", got, len(b)-8)
+	}
+	var types []string
+	data := map[string][]byte{}
+	for pos := 12; pos+8 <= len(b); {
+		size := int(binary.LittleEndian.Uint32(b[pos+4:]))
+		typ := string(b[pos : pos+4])
+		types = append(types, typ)
+		data[typ] = b[pos+8 : pos+8+size]
+		pos += 8 + size + size%2
+	}
+	return types, data
+}
+
+func TestStripGPSFromTIFF(t *testing.T) {
+	le, be := testTIFF{binary.LittleEndian}, testTIFF{binary.BigEndian}
+	tests := []struct {
+		name    string
+		tiff    []byte
+		want    bool
+		wantOri int
+	}{
+		{"little endian with GPS", le.build([]testIFDEntry{le.short(exifTagOrientation, 6)}, nil, le.gps("N", 31, "E", 121)), true, 6},
+		{"big endian with GPS", be.build([]testIFDEntry{be.short(exifTagOrientation, 3)}, nil, be.gps("S", 33, "W", 70)), true, 3},
+		{"no GPS", le.build([]testIFDEntry{le.short(exifTagOrientation, 8)}, nil, nil), false, 8},
+		{"GPS pointer at 4 GiB", le.build([]testIFDEntry{le.short(exifTagOrientation, 6), le.long(exifTagGPSIFD, 0xFFFFFFFF)}, nil, nil), false, 6},
+		{"GPS pointer just below 4 GiB", le.build([]testIFDEntry{le.long(exifTagGPSIFD, 0xFFFFFFF0)}, nil, nil), false, 0},
+		{"bad byte order", []byte("XX*\x00\x08\x00\x00\x00\x00\x00"), false, 0},
+		{"too short", []byte("II*"), false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripGPSFromTIFF(tt.tiff); got != tt.want {
+				t.Fatalf("stripGPSFromTIFF = %v, want %v", got, tt.want)
+			}
+			info, err := parseEXIF(tt.tiff)
+			if err != nil {
+				return
+			}
+			if info.HasGPS {
+				t.Error("GPS still readable after stripping")
+			}
+			if info.Orientation != tt.wantOri {
+				t.Errorf("orientation = %d, want %d", info.Orientation, tt.wantOri)
+			}
+		})
+	}
+}
+
+func TestOrientationOnlyEXIF(t *testing.T) {
+	le := testTIFF{binary.LittleEndian}
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"rotated", le.build([]testIFDEntry{le.short(exifTagOrientation, 6), le.ascii(exifTagDateTime, "2024:05:01 10:00:00")}, nil, le.gps("N", 1, "E", 2)), 6},
+		{"upright", le.build([]testIFDEntry{le.short(exifTagOrientation, 1)}, nil, nil), 0},
+		{"no orientation", le.build([]testIFDEntry{le.ascii(exifTagDateTime, "2024:05:01 10:00:00")}, nil, nil), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := orientationOnlyEXIF(tt.tiff)
+			if tt.want == 0 {
+				if got != nil {
+					t.Fatalf("orientationOnlyEXIF = %x, want nil", got)
+				}
+				return
+			}
+			info, err := parseEXIF(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Orientation != tt.want || info.HasGPS || !info.DateTime.IsZero() {
+				t.Errorf("minimal EXIF = %+v, want orientation %d only", info, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripMetadataFile(t *testing.T) {
+	le := testTIFF{binary.LittleEndian}
+	exifGPS := func() []byte {
+		return le.build([]testIFDEntry{le.short(exifTagOrientation, 6)}, nil, le.gps("N", 31, "E", 121))
+	}
+	exifPlain := le.build([]testIFDEntry{le.short(exifTagOrientation, 6)}, nil, nil)
+	xmpHeader := "http://ns.adobe.com/xap/1.0/\x00"
+
+	jpeg := testJPEG(
+		jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifGPS()...)),
+		jpegSegment(0xE1, []byte(xmpHeader+xmpWithLocation)),
+		jpegSegment(0xED, []byte("Photoshop 3.0\x00caption")),
+		jpegSegment(0xFE, []byte("comment")),
+	)
+	png := testPNG(
+		[2]string{"IHDR", "0123456789abc"},
+		[2]string{"eXIf", string(exifGPS())},
+		[2]string{"tEXt", "Comment\x00hello"},
+		[2]string{"iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00" + xmpWithLocation},
+		[2]string{"tIME", "\x07\xe8\x05\x01\x0a\x00\x00"},
+		[2]string{"IDAT", "pixels"},
+		[2]string{"IEND", ""},
+	)
+	webp := testWebP(
+		[2]string{"VP8X", "\x0c\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+		[2]string{"VP8 ", "frame"},
+		[2]string{"EXIF", string(exifGPS())},
+		[2]string{"XMP ", xmpWithLocation},
+	)
+
+	tests := []struct {
+		name         string
+		input        []byte
+		mode         string
+		wantStripped []string
+		check        func(t *testing.T, out []byte)
+	}{
+		{"jpeg location", jpeg, stripLocation, []string{"EXIF GPS", "XMP", "IPTC"}, func(t *testing.T, out []byte) {
+			labels, exif := jpegLabels(t, out)
+			if want := []string{"Exif", "FE", "SOS"}; !reflect.DeepEqual(labels, want) {
+				t.Errorf("segments = %v, want %v", labels, want)
+			}
+			if info, err := parseEXIF(exif); err != nil || info.HasGPS || info.Orientation != 6 {
+				t.Errorf("EXIF after stripping = %+v, %v", info, err)
+			}
+		}},
+		{"jpeg all", jpeg, stripAll, []string{"EXIF", "XMP", "IPTC", "JPEG注释"}, func(t *testing.T, out []byte) {
+			labels, exif := jpegLabels(t, out)
+			if want := []string{"Exif", "SOS"}; !reflect.DeepEqual(labels, want) {
+				t.Errorf("segments = %v, want %v", labels, want)
+			}
+			if info, err := parseEXIF(exif); err != nil || info.Orientation != 6 {
+				t.Errorf("orientation not kept: %+v, %v", info, err)
+			}
+			if !bytes.HasSuffix(out, []byte{0xFF, 0xDA, 0x00, 0x02, 0x11, 0x22, 0xFF, 0xD9}) {
+				t.Error("scan data changed")
+			}
+		}},
+		{"jpeg fill bytes before a marker", append([]byte{0xFF, 0xD8, 0xFF}, jpeg[2:]...), stripLocation, []string{"EXIF GPS", "XMP", "IPTC"}, func(t *testing.T, out []byte) {
+			if _, exif := jpegLabels(t, append([]byte{0xFF, 0xD8}, out[3:]...)); exif == nil {
+				t.Fatal("EXIF segment lost")
+			} else if info, err := parseEXIF(exif); err != nil || info.HasGPS {
+				t.Errorf("EXIF after stripping = %+v, %v", info, err)
+			}
+		}},
+		{"jpeg scan data kept", func() []byte {
+			b := testJPEG(jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifGPS()...)))
+			return append(b[:len(b)-2], 0x33, 0xFF, 0x00, 0x44, 0xFF, 0xD0, 0x55, 0xFF, 0xFF, 0xD9)
+		}(), stripLocation, []string{"EXIF GPS"}, func(t *testing.T, out []byte) {
+			if !bytes.HasSuffix(out, []byte{0xFF, 0xDA, 0x00, 0x02, 0x11, 0x22, 0x33, 0xFF, 0x00, 0x44, 0xFF, 0xD0, 0x55, 0xFF, 0xFF, 0xD9}) {
+				t.Errorf("scan data changed: % x", out)
+			}
+		}},
+		{"jpeg truncated scan", func() []byte {
+			b := testJPEG(jpegSegment(0xED, []byte("Photoshop 3.0\x00caption")))
+			return b[:len(b)-1]
+		}(), stripLocation, []string{"IPTC"}, func(t *testing.T, out []byte) {
+			if !bytes.HasSuffix(out, []byte{0x11, 0x22, 0xFF}) {
+				t.Errorf("scan data changed: % x", out)
+			}
+		}},
+		{"jpeg nothing to strip", testJPEG(
+			jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifPlain...)),
+			jpegSegment(0xE1, []byte(xmpHeader+xmpPlain)),
+		), stripLocation, nil, nil},
+		{"png location", png, stripLocation, []string{"EXIF GPS", "XMP"}, func(t *testing.T, out []byte) {
+			types, data := pngChunks(t, out)
+			if want := []string{"IHDR", "eXIf", "tEXt", "tIME", "IDAT", "IEND"}; !reflect.DeepEqual(types, want) {
+				t.Errorf("chunks = %v, want %v", types, want)
+			}
+			if info, err := parseEXIF(data["eXIf"]); err != nil || info.HasGPS {
+				t.Errorf("EXIF after stripping = %+v, %v", info, err)
+			}
+		}},
+		{"png all", png, stripAll, []string{"EXIF", "PNG文本", "XMP", "PNG时间"}, func(t *testing.T, out []byte) {
+			types, _ := pngChunks(t, out)
+			if want := []string{"IHDR", "IDAT", "IEND"}; !reflect.DeepEqual(types, want) {
+				t.Errorf("chunks = %v, want %v", types, want)
+			}
+		}},
+		{"webp location", webp, stripLocation, []string{"EXIF GPS", "XMP"}, func(t *testing.T, out []byte) {
+			types, data := webpChunks(t, out)
+			if want := []string{"VP8X", "VP8 ", "EXIF"}; !reflect.DeepEqual(types, want) {
+				t.Errorf("chunks = %v, want %v", types, want)
+			}
+			if flags := data["VP8X"][0]; flags != 0x08 {
+				t.Errorf("VP8X flags = %#x, want EXIF bit only", flags)
+			}
+			if info, err := parseEXIF(data["EXIF"]); err != nil || info.HasGPS {
+				t.Errorf("EXIF after stripping = %+v, %v", info, err)
+			}
+			if string(data["VP8 "]) != "frame" {
+				t.Errorf("image chunk = %q", data["VP8 "])
+			}
+		}},
+		{"webp all", webp, stripAll, []string{"EXIF", "XMP"}, func(t *testing.T, out []byte) {
+			types, data := webpChunks(t, out)
+			if want := []string{"VP8X", "VP8 "}; !reflect.DeepEqual(types, want) {
+				t.Errorf("chunks = %v, want %v", types, want)
+			}
+			if flags := data["VP8X"][0]; flags != 0 {
+				t.Errorf("VP8X flags = %#x, want 0", flags)
+			}
+		}},
+		{"not an image", []byte("plain text file"), stripAll, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "upload")
+			if err := os.WriteFile(path, tt.input, 0600); err != nil {
+				t.Fatal(err)
+			}
+			stripped, err := stripMetadataFile(path, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stripped, tt.wantStripped) {
+				t.Errorf("stripped = %q, want %q", stripped, tt.wantStripped)
+			}
+			out, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.check == nil {
+				if !bytes.Equal(out, tt.input) {
+					t.Error("file rewritten although nothing was stripped")
+				}
+				return
+			}
+			tt.check(t, out)
+		})
+	}
+}
+
+func TestStripJPEGEmbeddedImages(t *testing.T) {
+	le := testTIFF{binary.LittleEndian}
+	exifGPS := append([]byte("Exif\x00\x00"), le.build([]testIFDEntry{le.short(exifTagOrientation, 6)}, nil, le.gps("N", 31, "E", 121))...)
+	primary := testJPEG(jpegSegment(0xE1, exifGPS), jpegSegment(0xE2, []byte("MPF\x00offsets")))
+	preview := testJPEG(jpegSegment(0xE1, exifGPS), jpegSegment(0xFE, []byte("comment")))
+	trailer := []byte("motion photo \xFF\xD8 video")
+	input := append(append(append([]byte(nil), primary...), preview...), trailer...)
+
+	tests := []struct {
+		mode         string
+		wantStripped []string
+		previewEXIF  bool
+	}{
+		{stripLocation, []string{"EXIF GPS"}, true},
+		{stripAll, []string{"EXIF", "JPEG注释"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var out bytes.Buffer
+			stripped, err := stripJPEG(bufio.NewReader(bytes.NewReader(input)), &out, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stripped, tt.wantStripped) {
+				t.Errorf("stripped = %q, want %q", stripped, tt.wantStripped)
+			}
+			b := out.Bytes()
+			if !bytes.HasSuffix(b, trailer) {
+				t.Fatal("data after the embedded image changed")
+			}
+			// The preview keeps its size so the MPF offsets stay valid.
+			got := b[len(b)-len(trailer)-len(preview) : len(b)-len(trailer)]
+			if !bytes.HasPrefix(got, []byte{0xFF, 0xD8}) {
+				t.Fatalf("preview moved or resized: % x", got[:4])
+			}
+			exif, err := findJPEGExif(bufio.NewReader(bytes.NewReader(got)))
+			if !tt.previewEXIF {
+				if err == nil {
+					t.Error("preview EXIF kept")
+				}
+				if bytes.Contains(got, []byte("comment")) {
+					t.Error("preview comment kept")
+				}
+				return
+			}
+			if info, err := parseEXIF(exif); err != nil || info.HasGPS {
+				t.Errorf("preview EXIF after stripping = %+v, %v", info, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var (
+	booksDirName    = "books"
+	opdsSearchLimit = 100
+	opdsBookFormats = map[string]string{
+		".epub": "application/epub+zip",
+		".pdf":  "application/pdf",
+		".mobi": "application/x-mobipocket-ebook",
+		".azw3": "application/vnd.amazon.ebook",
+		".fb2":  "application/x-fictionbook+xml",
+		".cbz":  "application/vnd.comicbook+zip",
+		".txt":  "text/plain; charset=utf-8",
+	}
+)
+
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsRelAcquisition  = "http://opds-spec.org/acquisition"
+	opdsRelImage        = "http://opds-spec.org/image"
+	opdsRelThumbnail    = "http://opds-spec.org/image/thumbnail"
+)
+
+type epubMeta struct {
+	Title       string
+	Authors     []string
+	Language    string
+	Description string
+	Issued      string
+	Identifier  string
+	CoverPath   string
+	CoverType   string
+}
+
+type opfPackage struct {
+	Metadata struct {
+		Titles      []string `xml:"title"`
+		Creators    []string `xml:"creator"`
+		Language    string   `xml:"language"`
+		Description string   `xml:"description"`
+		Date        string   `xml:"date"`
+		Identifiers []string `xml:"identifier"`
+		Metas       []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest struct {
+		Items []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			MediaType  string `xml:"media-type,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"item"`
+	} `xml:"manifest"`
+}
+
+type epubCacheEntry struct {
+	modTime int64
+	size    int64
+	meta    *epubMeta
+}
+
+var epubCacheSize = 1024
+
+var (
+	epubCacheMu    sync.Mutex
+	epubCache      = map[string]*epubCacheEntry{}
+	epubCacheOrder []string
+)
+
+var opdsTextPolicy = bluemonday.StrictPolicy()
+
+func readZipFile(zr *zip.Reader, name string, limit int64) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		if f.UncompressedSize64 > uint64(limit) {
+			return nil, fmt.Errorf("%s 过大", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, limit))
+	}
+	return nil, fs.ErrNotExist
+}
+
+// parseEPUB reads the OPF package document referenced by
+// META-INF/container.xml and extracts the catalog metadata.
+func parseEPUB(absPath string) (*epubMeta, error) {
+	zr, err := zip.OpenReader(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := readZipFile(&zr.Reader, "META-INF/container.xml", 1024*1024)
+	if err != nil {
+		return nil, fmt.Errorf("缺少 container.xml: %v", err)
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(data, &container); err != nil || len(container.Rootfiles) == 0 {
+		return nil, fmt.Errorf("无法解析 container.xml")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	data, err = readZipFile(&zr.Reader, opfPath, 4*1024*1024)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取 OPF: %v", err)
+	}
+	var pkg opfPackage
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		return nil, fmt.Errorf("无法解析 OPF: %v", err)
+	}
+
+	meta := &epubMeta{Language: strings.TrimSpace(pkg.Metadata.Language), Issued: strings.TrimSpace(pkg.Metadata.Date)}
+	if len(pkg.Metadata.Titles) > 0 {
+		meta.Title = strings.TrimSpace(pkg.Metadata.Titles[0])
+	}
+	for _, c := range pkg.Metadata.Creators {
+		if c = strings.TrimSpace(c); c != "" {
+			meta.Authors = append(meta.Authors, c)
+		}
+	}
+	if len(pkg.Metadata.Identifiers) > 0 {
+		meta.Identifier = strings.TrimSpace(pkg.Metadata.Identifiers[0])
+	}
+	meta.Description = strings.TrimSpace(opdsTextPolicy.Sanitize(pkg.Metadata.Description))
+
+	coverID := ""
+	for _, m := range pkg.Metadata.Metas {
+		if m.Name == "cover" {
+			coverID = m.Content
+		}
+	}
+	for _, item := range pkg.Manifest.Items {
+		isCover := strings.Contains(" "+item.Properties+" ", " cover-image ") || (coverID != "" && item.ID == coverID)
+		if !isCover || !coverImageTypes[item.MediaType] {
+			continue
+		}
+		href, err := url.PathUnescape(item.Href)
+		if err != nil {
+			href = item.Href
+		}
+		meta.CoverPath = path.Join(path.Dir(opfPath), href)
+		meta.CoverType = item.MediaType
+		break
+	}
+	return meta, nil
+}
+
+func getEPUBMeta(absPath string, info os.FileInfo) *epubMeta {
+	epubCacheMu.Lock()
+	cached, ok := epubCache[absPath]
+	epubCacheMu.Unlock()
+	if ok && cached.modTime == info.ModTime().UnixNano() && cached.size == info.Size() {
+		return cached.meta
+	}
+	meta, err := parseEPUB(absPath)
+	if err != nil {
+		log.Printf("解析EPUB失败 %s: %v", absPath, err)
+		meta = nil
+	}
+	epubCacheMu.Lock()
+	if _, exists := epubCache[absPath]; !exists {
+		epubCacheOrder = append(epubCacheOrder, absPath)
+	}
+	epubCache[absPath] = &epubCacheEntry{modTime: info.ModTime().UnixNano(), size: info.Size(), meta: meta}
+	for len(epubCacheOrder) > epubCacheSize {
+		delete(epubCache, epubCacheOrder[0])
+		epubCacheOrder = epubCacheOrder[1:]
+	}
+	epubCacheMu.Unlock()
+	return meta
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Title  string `xml:"title,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID       string       `xml:"id"`
+	Title    string       `xml:"title"`
+	Updated  string       `xml:"updated"`
+	Authors  []atomAuthor `xml:"author,omitempty"`
+	Ident    string       `xml:"dc:identifier,omitempty"`
+	Language string       `xml:"dc:language,omitempty"`
+	Issued   string       `xml:"dc:issued,omitempty"`
+	Summary  string       `xml:"summary,omitempty"`
+	Content  *atomContent `xml:"content,omitempty"`
+	Links    []atomLink   `xml:"link"`
+}
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	Xmlns     string      `xml:"xmlns,attr"`
+	XmlnsDC   string      `xml:"xmlns:dc,attr,omitempty"`
+	XmlnsOPDS string      `xml:"xmlns:opds,attr,omitempty"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Author    *atomAuthor `xml:"author,omitempty"`
+	Links     []atomLink  `xml:"link"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+func newAtomFeed(id, title string) *atomFeed {
+	return &atomFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		ID:      id,
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  &atomAuthor{Name: "fileuploader"},
+	}
+}
+
+func newOPDSFeed(id, title string) *atomFeed {
+	feed := newAtomFeed(id, title)
+	feed.XmlnsDC = "http://purl.org/dc/terms/"
+	feed.XmlnsOPDS = "http://opds-spec.org/2010/catalog"
+	return feed
+}
+
+func writeAtom(w http.ResponseWriter, contentType string, feed *atomFeed) {
+	w.Header().Set("Content-Type", contentType+";charset=utf-8")
+	_, _ = io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Printf("输出Atom订阅失败: %v", err)
+	}
+}
+
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+func booksRoot() (string, error) {
+	absPath, err := ensurePathInRoot(booksDirName)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(absPath); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("图书目录不存在: %s", booksDirName)
+	}
+	return absPath, nil
+}
+
+// resolveBookPath maps a catalog path (relative to the books directory) to
+// an absolute path, refusing anything outside of it.
+func resolveBookPath(rel string) (string, string, error) {
+	root, err := booksRoot()
+	if err != nil {
+		return "", "", err
+	}
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+	absPath, err := ensurePathInRoot(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", "", err
+	}
+	return absPath, rel, nil
+}
+
+func bookEntry(prefix, rel string, info os.FileInfo, absPath string) atomEntry {
+	ext := strings.ToLower(filepath.Ext(info.Name()))
+	entry := atomEntry{
+		ID:      "urn:fileuploader:book:" + rel,
+		Title:   strings.TrimSuffix(info.Name(), filepath.Ext(info.Name())),
+		Updated: info.ModTime().UTC().Format(time.RFC3339),
+		Links: []atomLink{{
+			Rel:   opdsRelAcquisition,
+			Href:  prefix + "opds/download/" + escapePath(rel),
+			Type:  opdsBookFormats[ext],
+			Title: info.Name(),
+		}},
+	}
+	if ext != ".epub" {
+		return entry
+	}
+	meta := getEPUBMeta(absPath, info)
+	if meta == nil {
+		return entry
+	}
+	if meta.Title != "" {
+		entry.Title = meta.Title
+	}
+	for _, a := range meta.Authors {
+		entry.Authors = append(entry.Authors, atomAuthor{Name: a})
+	}
+	entry.Language = meta.Language
+	entry.Issued = meta.Issued
+	if meta.Description != "" {
+		entry.Summary = meta.Description
+	}
+	entry.Ident = meta.Identifier
+	if meta.CoverPath != "" {
+		cover := prefix + "opds/cover/" + escapePath(rel)
+		entry.Links = append(entry.Links,
+			atomLink{Rel: opdsRelImage, Href: cover, Type: meta.CoverType},
+			atomLink{Rel: opdsRelThumbnail, Href: cover, Type: meta.CoverType})
+	}
+	return entry
+}
+
+func isBookFile(name string) bool {
+	_, ok := opdsBookFormats[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// opdsDirHref is the catalog URL of a books directory. Subdirectories live
+// under opds/browse/ so that names like "search" or "cover" do not collide
+// with the other OPDS routes.
+func opdsDirHref(prefix, rel string) string {
+	if rel == "" || rel == "." {
+		return prefix + "opds/"
+	}
+	return prefix + "opds/browse/" + escapePath(rel) + "/"
+}
+
+func feedLinks(prefix, rel, selfHref, selfType string) []atomLink {
+	links := []atomLink{
+		{Rel: "self", Href: selfHref, Type: selfType},
+		{Rel: "start", Href: prefix + "opds/", Type: opdsNavigationType},
+		{Rel: "search", Href: prefix + "opds/opensearch.xml", Type: "application/opensearchdescription+xml"},
+	}
+	if rel != "" {
+		links = append(links, atomLink{Rel: "up", Href: opdsDirHref(prefix, path.Dir(rel)), Type: opdsNavigationType})
+	}
+	return links
+}
+
+// handleOPDS serves the catalog root at opds/ and subdirectories at
+// opds/browse/<dir>: a navigation feed when the directory has
+// subdirectories, otherwise an acquisition feed with its books. The
+// books of a mixed directory are listed with ?books=true.
+func handleOPDS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	dirParam := apiPathParam(r, "opds/")
+	if dirParam != "" {
+		rest, ok := strings.CutPrefix(dirParam, "browse/")
+		if !ok && dirParam != "browse" {
+			writeError(w, http.StatusNotFound, "目录不存在")
+			return
+		}
+		dirParam = rest
+	}
+	absDir, rel, err := resolveBookPath(dirParam)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "目录不存在")
+		return
+	}
+	prefix := apiPrefix(r)
+	title := "图书馆"
+	if rel != "" {
+		title = path.Base(rel)
+	}
+	selfHref := opdsDirHref(prefix, rel)
+
+	var dirs, books []os.FileInfo
+	for _, e := range entries {
+		if isHiddenName(e.Name()) || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(absDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			dirs = append(dirs, info)
+		} else if isBookFile(e.Name()) {
+			books = append(books, info)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
+	sort.Slice(books, func(i, j int) bool { return books[i].Name() < books[j].Name() })
+
+	if len(dirs) == 0 || r.URL.Query().Get("books") == "true" {
+		if len(dirs) > 0 {
+			selfHref += "?books=true"
+		}
+		feed := newOPDSFeed("urn:fileuploader:books:"+rel+":acquisition", title)
+		feed.Links = feedLinks(prefix, rel, selfHref, opdsAcquisitionType)
+		for _, info := range books {
+			childRel := path.Join(rel, info.Name())
+			feed.Entries = append(feed.Entries, bookEntry(prefix, childRel, info, filepath.Join(absDir, info.Name())))
+		}
+		writeAtom(w, opdsAcquisitionType, feed)
+		return
+	}
+
+	feed := newOPDSFeed("urn:fileuploader:books:"+rel, title)
+	feed.Links = feedLinks(prefix, rel, selfHref, opdsNavigationType)
+	for _, info := range dirs {
+		childRel := path.Join(rel, info.Name())
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      "urn:fileuploader:books:" + childRel,
+			Title:   info.Name(),
+			Updated: info.ModTime().UTC().Format(time.RFC3339),
+			Content: &atomContent{Type: "text", Text: "目录: " + info.Name()},
+			Links:   []atomLink{{Rel: "subsection", Href: opdsDirHref(prefix, childRel), Type: opdsNavigationType}},
+		})
+	}
+	if len(books) > 0 {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      "urn:fileuploader:books:" + rel + ":acquisition",
+			Title:   "本目录中的图书",
+			Updated: time.Now().UTC().Format(time.RFC3339),
+			Content: &atomContent{Type: "text", Text: fmt.Sprintf("共 %d 本", len(books))},
+			Links:   []atomLink{{Rel: "subsection", Href: selfHref + "?books=true", Type: opdsAcquisitionType}},
+		})
+	}
+	writeAtom(w, opdsNavigationType, feed)
+}
+
+func handleOPDSSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	root, err := booksRoot()
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	query := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	prefix := apiPrefix(r)
+	feed := newOPDSFeed("urn:fileuploader:books:search:"+query, "搜索: "+query)
+	feed.Links = feedLinks(prefix, "", prefix+"opds/search?q="+url.QueryEscape(query), opdsAcquisitionType)
+	if query == "" {
+		writeAtom(w, opdsAcquisitionType, feed)
+		return
+	}
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != root && (isHiddenName(d.Name()) || strings.HasPrefix(d.Name(), ".")) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isBookFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		entry := bookEntry(prefix, filepath.ToSlash(rel), info, p)
+		haystack := strings.ToLower(d.Name() + "\x00" + entry.Title)
+		for _, a := range entry.Authors {
+			haystack += "\x00" + strings.ToLower(a.Name)
+		}
+		if strings.Contains(haystack, query) {
+			feed.Entries = append(feed.Entries, entry)
+		}
+		if len(feed.Entries) >= opdsSearchLimit {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	writeAtom(w, opdsAcquisitionType, feed)
+}
+
+func handleOPDSOpenSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	prefix := apiPrefix(r)
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml;charset=utf-8")
+	fmt.Fprintf(w, `%s<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/">
+  <ShortName>fileuploader</ShortName>
+  <Description>搜索图书</Description>
+  <InputEncoding>UTF-8</InputEncoding>
+  <OutputEncoding>UTF-8</OutputEncoding>
+  <Url type="%s" template="%sopds/search?q={searchTerms}"/>
+</OpenSearchDescription>
+`, xml.Header, opdsAcquisitionType, prefix)
+}
+
+func handleOPDSDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	absPath, _, err := resolveBookPath(apiPathParam(r, "opds/download/"))
+	if err != nil || !isBookFile(absPath) {
+		writeError(w, http.StatusNotFound, "图书不存在")
+		return
+	}
+	serveFile(w, r, absPath, opdsBookFormats[strings.ToLower(filepath.Ext(absPath))], true, "图书不存在")
+}
+
+func handleOPDSCover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	absPath, _, err := resolveBookPath(apiPathParam(r, "opds/cover/"))
+	if err != nil || strings.ToLower(filepath.Ext(absPath)) != ".epub" {
+		writeError(w, http.StatusNotFound, "封面不存在")
+		return
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "封面不存在")
+		return
+	}
+	meta := getEPUBMeta(absPath, info)
+	if meta == nil || meta.CoverPath == "" {
+		writeError(w, http.StatusNotFound, "封面不存在")
+		return
+	}
+	zr, err := zip.OpenReader(absPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "封面不存在")
+		return
+	}
+	defer zr.Close()
+	data, err := readZipFile(&zr.Reader, meta.CoverPath, 32*1024*1024)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "封面不存在")
+		return
+	}
+	setCoverHeaders(w, data)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testEPUB writes an EPUB whose manifest declares cover.img with mediaType.
+func testEPUB(t *testing.T, absPath, mediaType string, cover []byte) {
+	t.Helper()
+	f, err := os.Create(absPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"META-INF/container.xml", []byte(`<container><rootfiles><rootfile full-path="OEBPS/content.opf"/></rootfiles></container>`)},
+		{"OEBPS/content.opf", []byte(fmt.Sprintf(`<package><metadata><title>Book</title></metadata><manifest>
+<item id="c" href="cover.img" media-type=%q properties="cover-image"/></manifest></package>`, mediaType))},
+		{"OEBPS/cover.img", cover},
+	}
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(file.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleOPDSCover(t *testing.T) {
+	savedRoot := rootDir
+	rootDir = t.TempDir()
+	defer func() { rootDir = savedRoot }()
+	if err := os.Mkdir(filepath.Join(rootDir, booksDirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	jpeg := []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00")
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+	tests := []struct {
+		name        string
+		mediaType   string
+		cover       []byte
+		status      int
+		contentType string
+	}{
+		{"JPEG served inline", "image/jpeg", jpeg, http.StatusOK, "image/jpeg"},
+		{"SVG is not a cover", "image/svg+xml", svg, http.StatusNotFound, ""},
+		{"HTML claimed as PNG", "image/png", []byte("<html><script>alert(1)</script>"), http.StatusOK, "application/octet-stream"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("book%d.epub", i)
+			testEPUB(t, filepath.Join(rootDir, booksDirName, name), tt.mediaType, tt.cover)
+			w := httptest.NewRecorder()
+			handleOPDSCover(w, httptest.NewRequest(http.MethodGet, "/api/opds/cover/"+name, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			h := w.Header()
+			if h.Get("Content-Type") != tt.contentType || h.Get("Content-Security-Policy") != "sandbox" {
+				t.Errorf("headers = %v, want Content-Type %q with a sandbox CSP", h, tt.contentType)
+			}
+			if tt.contentType == "application/octet-stream" && h.Get("Content-Disposition") != "attachment" {
+				t.Errorf("non-image cover not sent as an attachment: %v", h)
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2/lexers"
+)
+
+var (
+	pasteDirName    = "paste"
+	pasteMaxSize    = int64(1024 * 1024)
+	pasteSweepTick  = 10 * time.Minute
+	pasteDefaultExt = ".txt"
+)
+
+type Paste struct {
+	ID        string `json:"id"`
+	Title     string `json:"title,omitempty"`
+	Path      string `json:"path"`
+	Language  string `json:"language,omitempty"`
+	Size      int64  `json:"size"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	Author    string `json:"author"`
+	Created   int64  `json:"created"`
+	URL       string `json:"url,omitempty"`
+	RawURL    string `json:"rawUrl,omitempty"`
+}
+
+var (
+	pastesMu sync.Mutex
+	pastes   = map[string]*Paste{}
+)
+
+func pastesFile() string {
+	return filepath.Join(appRootDir, "pastes.json")
+}
+
+func loadPastes() {
+	data, err := os.ReadFile(pastesFile())
+	if err != nil {
+		return
+	}
+	pastesMu.Lock()
+	defer pastesMu.Unlock()
+	if err := json.Unmarshal(data, &pastes); err != nil {
+		log.Printf("读取粘贴记录失败: %v", err)
+	}
+}
+
+// savePastes must be called with pastesMu held.
+func savePastes() error {
+	data, err := json.MarshalIndent(pastes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := pastesFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, pastesFile())
+}
+
+// newPasteID picks an ID that is neither indexed nor on disk, so a random
+// collision cannot overwrite (and version) an existing paste.
+func newPasteID(ext string) (string, error) {
+	pastesMu.Lock()
+	defer pastesMu.Unlock()
+	for i := 0; i < 10; i++ {
+		id := randomToken(5)
+		if _, taken := pastes[id]; taken {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(rootDir, pasteDirName, id+ext)); !os.IsNotExist(err) {
+			continue
+		}
+		return id, nil
+	}
+	return "", fmt.Errorf("无法分配粘贴 ID")
+}
+
+func pasteExpired(p *Paste) bool {
+	return p.ExpiresAt != 0 && time.Now().Unix() >= p.ExpiresAt
+}
+
+// removePaste must be called with pastesMu held.
+func removePaste(p *Paste, reason string) {
+	if absPath, err := ensurePathInRoot(p.Path); err == nil {
+		if err := os.Remove(absPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("删除粘贴文件失败 %s: %v", absPath, err)
+			return
+		}
+		dropFileStats(absPath)
+	}
+	delete(pastes, p.ID)
+	if err := savePastes(); err != nil {
+		log.Printf("保存粘贴记录失败: %v", err)
+	}
+	log.Printf("粘贴已删除: %s（%s）", p.ID, reason)
+}
+
+func startPasteSweeper() {
+	loadPastes()
+	go func() {
+		for {
+			pastesMu.Lock()
+			for _, p := range pastes {
+				if pasteExpired(p) {
+					removePaste(p, "已过期")
+				}
+			}
+			pastesMu.Unlock()
+			time.Sleep(pasteSweepTick)
+		}
+	}()
+}
+
+func pasteView(r *http.Request, p *Paste) Paste {
+	v := *p
+	v.URL = requestBaseURL(r) + apiPrefix(r) + "paste/" + p.ID
+	v.RawURL = v.URL + "/raw"
+	return v
+}
+
+// pasteExtension maps a language hint to a file extension so pastes are
+// recognisable when browsing the paste directory.
+func pasteExtension(lang string) (string, string) {
+	if lang == "" {
+		return "", pasteDefaultExt
+	}
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return lang, pasteDefaultExt
+	}
+	config := lexer.Config()
+	for _, pattern := range config.Filenames {
+		if ext := strings.TrimPrefix(pattern, "*"); strings.HasPrefix(ext, ".") && !strings.ContainsAny(ext, "*?[") {
+			return config.Name, ext
+		}
+	}
+	return config.Name, pasteDefaultExt
+}
+
+// readPasteContent accepts a form with a content field (or a file part), or
+// the raw request body as sent by `curl --data-binary @file`. curl labels raw
+// bodies as urlencoded, so such a body only counts as a form when it has a
+// content field.
+func readPasteContent(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, pasteMaxSize+64*1024)
+	tooLarge := fmt.Errorf("内容超过 %d KB", pasteMaxSize/1024)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(pasteMaxSize); err != nil {
+			if strings.Contains(err.Error(), "request body too large") {
+				return "", tooLarge
+			}
+			return "", fmt.Errorf("无法解析请求: %v", err)
+		}
+		if content := r.FormValue("content"); content != "" {
+			return checkPasteContent(content)
+		}
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			return "", fmt.Errorf("内容不能为空")
+		}
+		f, err := files[0].Open()
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return "", err
+		}
+		return checkPasteContent(string(data))
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", tooLarge
+	}
+	if mediaType == "application/x-www-form-urlencoded" {
+		if form, err := url.ParseQuery(string(data)); err == nil && form.Has("content") {
+			r.PostForm = form
+			r.Form = url.Values{}
+			for k, v := range r.URL.Query() {
+				r.Form[k] = v
+			}
+			for k, v := range form {
+				r.Form[k] = v
+			}
+			return checkPasteContent(form.Get("content"))
+		}
+	}
+	return checkPasteContent(string(data))
+}
+
+func checkPasteContent(content string) (string, error) {
+	if int64(len(content)) > pasteMaxSize {
+		return "", fmt.Errorf("内容超过 %d KB", pasteMaxSize/1024)
+	}
+	if strings.TrimSpace(content) == "" {
+		return "", fmt.Errorf("内容不能为空")
+	}
+	if !utf8.ValidString(content) {
+		return "", fmt.Errorf("内容必须是 UTF-8 文本")
+	}
+	return content, nil
+}
+
+// handlePaste serves the pastebin:
+//
+//	POST   paste               create from a content field or the raw body
+//	GET    paste/              list pastes
+//	GET    paste/<id>          highlighted HTML view (?format=json for metadata)
+//	GET    paste/<id>/raw      plain text
+//	DELETE paste/<id>          delete
+func handlePaste(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(apiPathParam(r, "paste"), "/")
+	id, sub, _ := strings.Cut(rest, "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		createPaste(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		listPastes(w, r)
+	case id != "" && sub == "" && r.Method == http.MethodGet:
+		showPaste(w, r, id, false)
+	case id != "" && sub == "raw" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		showPaste(w, r, id, true)
+	case id != "" && sub == "" && r.Method == http.MethodDelete:
+		pastesMu.Lock()
+		p, ok := pastes[id]
+		if ok {
+			removePaste(p, "由 "+requestActor(r)+" 删除")
+		}
+		pastesMu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "粘贴不存在")
+			return
+		}
+		writeJSON(w, http.StatusOK, SuccessResponse{Message: "粘贴已删除"})
+	case sub != "" && sub != "raw":
+		writeError(w, http.StatusNotFound, "粘贴不存在")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func createPaste(w http.ResponseWriter, r *http.Request) {
+	content, err := readPasteContent(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Parameters may come from the query string when the body is raw text.
+	param := func(name string) string {
+		if v := r.FormValue(name); v != "" {
+			return v
+		}
+		return r.URL.Query().Get(name)
+	}
+	expiresAt, err := parseShareExpiry(param("expiresAt"), param("expiresIn"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		writeError(w, http.StatusBadRequest, "过期时间必须晚于当前时间")
+		return
+	}
+	lang, ext := pasteExtension(strings.TrimSpace(param("lang")))
+	id, err := newPasteID(ext)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	relPath := filepath.ToSlash(filepath.Join(pasteDirName, id+ext))
+	absPath, err := ensurePathInRoot(relPath)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkWritable(relPath); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		writeError(w, http.StatusInternalServerError, "无法创建粘贴目录")
+		return
+	}
+	if err := writeFileAtomic(absPath, []byte(content), 0644, requestActor(r), true); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("保存粘贴失败: %v", err))
+		return
+	}
+
+	title := strings.TrimSpace(param("title"))
+	if len(title) > 200 {
+		title = string(trimPartialRune([]byte(title[:200])))
+	}
+	p := &Paste{
+		ID:        id,
+		Title:     title,
+		Path:      relPath,
+		Language:  lang,
+		Size:      int64(len(content)),
+		ExpiresAt: expiresAt,
+		Author:    requestActor(r),
+		Created:   time.Now().Unix(),
+	}
+	pastesMu.Lock()
+	pastes[id] = p
+	err = savePastes()
+	view := pasteView(r, p)
+	pastesMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("保存粘贴记录失败: %v", err))
+		return
+	}
+	log.Printf("新建粘贴: %s（%s，%d 字节，来自 %s）", relPath, lang, p.Size, p.Author)
+
+	if wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, view.URL)
+		return
+	}
+	writeJSON(w, http.StatusCreated, SuccessResponse{Message: "粘贴已创建", Data: view})
+}
+
+func listPastes(w http.ResponseWriter, r *http.Request) {
+	pastesMu.Lock()
+	list := make([]Paste, 0, len(pastes))
+	for _, p := range pastes {
+		if !pasteExpired(p) {
+			list = append(list, pasteView(r, p))
+		}
+	}
+	pastesMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pastes": list,
+	})
+}
+
+var pastePageTemplate = template.Must(template.New("paste").Funcs(template.FuncMap{
+	"date": func(t int64) string { return time.Unix(t, 0).Format("2006-01-02 15:04") },
+}).Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Paste.Title}}{{.Paste.Title}}{{else}}粘贴 {{.Paste.ID}}{{end}}</title>
+<style>
+body{font-family:-apple-system,"Segoe UI","PingFang SC","Microsoft YaHei",sans-serif;max-width:1100px;margin:1.5em auto;padding:0 1em;color:#222}
+.meta{color:#666;font-size:.9em;margin-bottom:1em}.meta a{color:#1565c0}
+pre{overflow-x:auto;font-size:13px;line-height:1.45;padding:.8em;border:1px solid #eee}
+</style>
+</head>
+<body>
+<h3>{{if .Paste.Title}}{{.Paste.Title}}{{else}}粘贴 {{.Paste.ID}}{{end}}</h3>
+<div class="meta">{{if .Language}}{{.Language}} · {{end}}{{.Paste.Size}} 字节 · {{date .Paste.Created}}{{if .Paste.ExpiresAt}} · {{date .Paste.ExpiresAt}} 过期{{end}} · <a href="{{.Paste.RawURL}}">原始文本</a></div>
+{{if .HTML}}{{.HTML}}{{else}}<pre>{{.Content}}</pre>{{end}}
+</body>
+</html>
+`))
+
+func showPaste(w http.ResponseWriter, r *http.Request, id string, raw bool) {
+	pastesMu.Lock()
+	p, ok := pastes[id]
+	var view Paste
+	if ok {
+		view = pasteView(r, p)
+	}
+	pastesMu.Unlock()
+	if !ok || pasteExpired(&view) {
+		writeError(w, http.StatusNotFound, "粘贴不存在或已过期")
+		return
+	}
+	if !raw && r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, view)
+		return
+	}
+	absPath, err := ensurePathInRoot(view.Path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "粘贴不存在或已过期")
+		return
+	}
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "粘贴不存在或已过期")
+		return
+	}
+	if raw {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(data)
+		}
+		return
+	}
+
+	content := string(data)
+	lang := view.Language
+	if lang == "" {
+		if lexer := lexers.Analyse(content); lexer != nil {
+			lang = lexer.Config().Name
+		}
+	}
+	highlighted, name, err := highlightCode(filepath.Base(view.Path), lang, content)
+	if err != nil {
+		log.Printf("粘贴语法高亮失败 %s: %v", id, err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if err := pastePageTemplate.Execute(w, map[string]interface{}{
+		"Paste":    view,
+		"Language": name,
+		"HTML":     template.HTML(highlighted),
+		"Content":  content,
+	}); err != nil {
+		log.Printf("渲染粘贴页面失败: %v", err)
+	}
+}
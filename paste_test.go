@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasteLifecycle(t *testing.T) {
+	useTempRoots(t)
+	savedPastes := pastes
+	pastes = map[string]*Paste{"old": {ID: "old", Path: "paste/old.txt", ExpiresAt: time.Now().Add(-time.Minute).Unix()}}
+	t.Cleanup(func() { pastes = savedPastes })
+
+	serve := func(method, target, contentType string, body io.Reader) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, body)
+		r.Header.Set("Accept", "application/json")
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		handlePaste(w, r)
+		return w
+	}
+
+	rejected := []struct {
+		name        string
+		contentType string
+		body        string
+		query       string
+	}{
+		{"empty", "text/plain", "  \n", ""},
+		{"not UTF-8", "text/plain", "\xff\xfe", ""},
+		{"expiry in the past", "text/plain", "x", "?expiresAt=1"},
+		{"too large", "text/plain", strings.Repeat("x", int(pasteMaxSize)+1), ""},
+	}
+	for _, tt := range rejected {
+		if w := serve(http.MethodPost, "/api/paste"+tt.query, tt.contentType, strings.NewReader(tt.body)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400: %s", tt.name, w.Code, w.Body)
+		}
+	}
+
+	content := "<script>alert(1)</script>\nprint('hi')\n"
+	form := url.Values{"content": {content}, "lang": {"python"}, "title": {"Demo"}}
+	w := serve(http.MethodPost, "/api/paste", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		Data Paste `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	p := created.Data
+	if p.Title != "Demo" || p.Language != "Python" || !strings.HasSuffix(p.Path, ".py") || p.Size != int64(len(content)) {
+		t.Errorf("created paste = %+v", p)
+	}
+	absPath := filepath.Join(rootDir, filepath.FromSlash(p.Path))
+	if data, err := os.ReadFile(absPath); err != nil || string(data) != content {
+		t.Fatalf("paste file holds %q, %v", data, err)
+	}
+
+	w = serve(http.MethodGet, "/api/paste/", "", nil)
+	var list struct {
+		Pastes []Paste `json:"pastes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Pastes) != 1 || list.Pastes[0].ID != p.ID {
+		t.Errorf("list = %+v, want only %s", list.Pastes, p.ID)
+	}
+
+	w = serve(http.MethodGet, "/api/paste/"+p.ID+"/raw", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != content || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("raw: status %d, type %q, body %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	w = serve(http.MethodGet, "/api/paste/"+p.ID, "", nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "<script>alert") {
+		t.Errorf("HTML view: status %d, script not escaped: %v", w.Code, strings.Contains(w.Body.String(), "<script>alert"))
+	}
+	if w := serve(http.MethodGet, "/api/paste/old/raw", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expired paste: status = %d, want 404", w.Code)
+	}
+	if w := serve(http.MethodGet, "/api/paste/"+p.ID+"/other", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown sub path: status = %d, want 404", w.Code)
+	}
+
+	if w := serve(http.MethodDelete, "/api/paste/"+p.ID, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: status = %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(absPath); !os.IsNotExist(err) {
+		t.Errorf("paste file left after delete: %v", err)
+	}
+	if w := serve(http.MethodGet, "/api/paste/"+p.ID+"/raw", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("deleted paste: status = %d, want 404", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/api/paste/"+p.ID, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status = %d, want 404", w.Code)
+	}
+}
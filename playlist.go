@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	playlistMaxDepth   = 8
+	playlistMaxEntries = 5000
+	playlistExtraExts  = map[string]bool{
+		".wav": true, ".aac": true, ".wma": true, ".ape": true, ".avi": true, ".ts": true,
+		".m2ts": true, ".flv": true, ".wmv": true, ".3gp": true, ".mpg": true, ".mpeg": true,
+	}
+)
+
+type playlistTrack struct {
+	file     FileInfo
+	url      string
+	title    string
+	artist   string
+	album    string
+	duration float64
+}
+
+func isMediaFile(name string) bool {
+	return mediaFormat(name) != "" || playlistExtraExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// collectMediaFiles lists media files below dir through listDirectory, so
+// the same path validation and hidden-entry filtering apply. Symlinked
+// directories are not followed to avoid cycles.
+func collectMediaFiles(dir string, recursive bool, depth int, out *[]FileInfo) error {
+	files, err := listDirectory(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if len(*out) >= playlistMaxEntries {
+			return nil
+		}
+		if f.IsDir {
+			if recursive && !f.IsSymlink && depth < playlistMaxDepth {
+				if err := collectMediaFiles(f.Path, true, depth+1, out); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if isMediaFile(f.Name) {
+			*out = append(*out, f)
+		}
+	}
+	return nil
+}
+
+func buildPlaylistTracks(r *http.Request, files []FileInfo) []playlistTrack {
+	base := requestBaseURL(r) + apiPrefix(r) + "media/stream/"
+	tracks := make([]playlistTrack, 0, len(files))
+	for _, f := range files {
+		t := playlistTrack{
+			file:  f,
+			url:   base + escapePath(f.Path),
+			title: strings.TrimSuffix(f.Name, filepath.Ext(f.Name)),
+		}
+		if mediaFormat(f.Name) != "" {
+			if absPath, err := ensurePathInRoot(f.Path); err == nil {
+				if info, err := os.Stat(absPath); err == nil {
+					if m, err := getMediaInfo(absPath, info); err == nil {
+						t.duration = m.Duration
+						if m.Tags["title"] != "" {
+							t.title = m.Tags["title"]
+						}
+						t.artist = m.Tags["artist"]
+						t.album = m.Tags["album"]
+					}
+				}
+			}
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+func writeM3U8(w io.Writer, tracks []playlistTrack) {
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, t := range tracks {
+		title := t.title
+		if t.artist != "" {
+			title = t.artist + " - " + title
+		}
+		duration := -1
+		if t.duration > 0 {
+			duration = int(t.duration + 0.5)
+		}
+		fmt.Fprintf(w, "#EXTINF:%d,%s\n%s\n", duration, strings.ReplaceAll(title, "\n", " "), t.url)
+	}
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func writeXSPF(w io.Writer, title string, tracks []playlistTrack) error {
+	pl := xspfPlaylist{Version: "1", Xmlns: "http://xspf.org/ns/0/", Title: title}
+	for _, t := range tracks {
+		pl.Tracks = append(pl.Tracks, xspfTrack{
+			Location: t.url,
+			Title:    t.title,
+			Creator:  t.artist,
+			Album:    t.album,
+			Duration: int64(t.duration * 1000),
+		})
+	}
+	_, _ = io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(pl)
+}
+
+func handlePlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "playlist/")
+	if pathParam == "" {
+		pathParam = "."
+	}
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "m3u8"
+	}
+	if format != "m3u8" && format != "xspf" {
+		writeError(w, http.StatusBadRequest, "format 只能是 m3u8 或 xspf")
+		return
+	}
+
+	var files []FileInfo
+	if err := collectMediaFiles(pathParam, query.Get("recursive") == "true", 0, &files); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if query.Get("shuffle") == "true" {
+		rand.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+	}
+	tracks := buildPlaylistTracks(r, files)
+
+	name := path.Base(strings.TrimSuffix(filepath.ToSlash(pathParam), "/"))
+	if name == "." || name == "/" || name == "" {
+		name = "playlist"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name + "." + format}))
+	if format == "xspf" {
+		w.Header().Set("Content-Type", "application/xspf+xml; charset=utf-8")
+		_ = writeXSPF(w, name, tracks)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl; charset=utf-8")
+	writeM3U8(w, tracks)
+}
+
+func handleMediaStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	absPath, err := ensurePathInRoot(apiPathParam(r, "media/stream/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isMediaFile(absPath) {
+		writeError(w, http.StatusBadRequest, "不支持的媒体格式")
+		return
+	}
+	serveFile(w, r, absPath, "", false, "文件不存在")
+}
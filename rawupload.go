@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type RawUploadResult struct {
+	Path     string   `json:"path"`
+	Size     int64    `json:"size"`
+	SHA256   string   `json:"sha256"`
+	URL      string   `json:"url"`
+	Stripped []string `json:"stripped,omitempty"`
+}
+
+// wantsPlainText reports whether the reply should be plain text: either asked
+// for with ?format=text, or the client is a command line tool that did not
+// ask for JSON.
+func wantsPlainText(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "text"
+	}
+	if strings.Contains(r.Header.Get("Accept"), "json") {
+		return false
+	}
+	ua := strings.ToLower(r.Header.Get("User-Agent"))
+	return strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "wget/") || strings.HasPrefix(ua, "httpie/")
+}
+
+func hashFile(absPath string) (string, error) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// receiveRawBody streams the request body into a temp file, hashing it on
+// the way. The returned status is only meaningful with an error.
+func receiveRawBody(w http.ResponseWriter, r *http.Request) (string, int64, string, int, error) {
+	tooLarge := fmt.Errorf("文件太大（超过 %d GB）", maxUploadSize/(1024*1024*1024))
+	if r.ContentLength > maxUploadSize {
+		return "", 0, "", http.StatusRequestEntityTooLarge, tooLarge
+	}
+	tempFile, err := os.CreateTemp("", "fileuploader-*")
+	if err != nil {
+		return "", 0, "", http.StatusInternalServerError, err
+	}
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tempFile, h), http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		if strings.Contains(err.Error(), "request body too large") {
+			return "", 0, "", http.StatusRequestEntityTooLarge, tooLarge
+		}
+		log.Printf("读取上传内容失败: %v", err)
+		return "", 0, "", http.StatusBadRequest, fmt.Errorf("读取上传内容失败")
+	}
+	if r.ContentLength >= 0 && written != r.ContentLength {
+		_ = os.Remove(tempFile.Name())
+		return "", 0, "", http.StatusBadRequest, fmt.Errorf("上传内容不完整")
+	}
+	return tempFile.Name(), written, hex.EncodeToString(h.Sum(nil)), 0, nil
+}
+
+// handleRawUpload stores the request body as put/<path>, so plain
+// `curl -T file URL/dir/` works without multipart encoding: curl appends the
+// local file name to a URL ending in a slash, and a path that still ends in
+// one is rejected. ?overwrite=false refuses to replace a file, including one
+// created while the body was still being received.
+func handleRawUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	plain := wantsPlainText(r)
+	fail := func(status int, msg string) {
+		if plain {
+			http.Error(w, "错误: "+msg, status)
+			return
+		}
+		writeError(w, status, msg)
+	}
+
+	pathParam := apiPathParam(r, "put/")
+	if pathParam == "" || strings.HasSuffix(pathParam, "/") {
+		fail(http.StatusBadRequest, "缺少文件名")
+		return
+	}
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	relPath = filepath.ToSlash(relPath)
+	if err := checkWritable(relPath); err != nil {
+		fail(http.StatusForbidden, err.Error())
+		return
+	}
+	fileName := filepath.Base(absPath)
+	if isHiddenName(fileName) {
+		fail(http.StatusBadRequest, "文件名不允许")
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") != "false"
+	mode := uploadReplace
+	if !overwrite {
+		mode = uploadNoReplace
+	}
+	// Checked up front to spare streaming the body; the final placement
+	// checks again.
+	if info, err := os.Lstat(absPath); err == nil {
+		if info.IsDir() {
+			fail(http.StatusConflict, "目标是一个目录")
+			return
+		}
+		if !overwrite {
+			fail(http.StatusConflict, "文件已存在")
+			return
+		}
+	}
+
+	tempPath, written, sum, status, err := receiveRawBody(w, r)
+	if err != nil {
+		log.Printf("接收上传内容失败 %s: %v", relPath, err)
+		fail(status, err.Error())
+		return
+	}
+	dir := filepath.Dir(absPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		_ = os.Remove(tempPath)
+		log.Printf("无法创建目标目录 %s: %v", dir, err)
+		fail(http.StatusInternalServerError, "无法创建目标目录")
+		return
+	}
+
+	stored, processed, errorsList := storeUploadedFiles(r, dir, []bufferedFile{{
+		tempPath: tempPath,
+		fileName: fileName,
+		fileSize: written,
+	}}, mode, nil)
+	if len(stored) == 0 {
+		status := http.StatusInternalServerError
+		if _, err := os.Lstat(absPath); err == nil && !overwrite {
+			status = http.StatusConflict
+		}
+		fail(status, strings.Join(errorsList, "; "))
+		return
+	}
+
+	result := RawUploadResult{
+		Path:     relPath,
+		Size:     written,
+		SHA256:   sum,
+		URL:      requestBaseURL(r) + apiPrefix(r) + "file/download/" + escapePath(relPath),
+		Stripped: processed[fileName],
+	}
+	// Metadata stripping rewrites the file, so report what is on disk.
+	if len(result.Stripped) > 0 {
+		if info, err := os.Stat(absPath); err == nil {
+			result.Size = info.Size()
+		}
+		if sum, err := hashFile(absPath); err == nil {
+			result.SHA256 = sum
+		}
+	}
+
+	if plain {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s\n路径: %s\n大小: %d 字节\nSHA256: %s\n", result.URL, result.Path, result.Size, result.SHA256)
+		return
+	}
+	writeJSON(w, http.StatusCreated, SuccessResponse{Message: "上传成功", Data: result})
+}
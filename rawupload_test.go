@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// racingBody creates path with "racer" on its first read, like a second
+// upload landing while this one is still streaming.
+type racingBody struct {
+	path string
+	r    io.Reader
+	done bool
+}
+
+func (b *racingBody) Read(p []byte) (int, error) {
+	if !b.done {
+		b.done = true
+		if err := os.WriteFile(b.path, []byte("racer"), 0644); err != nil {
+			return 0, err
+		}
+	}
+	return b.r.Read(p)
+}
+
+func TestHandleRawUpload(t *testing.T) {
+	useTempRoots(t)
+	for name, data := range map[string]string{"old.txt": "old", "keep.txt": "racer"} {
+		if err := os.WriteFile(filepath.Join(rootDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(rootDir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		query  string
+		race   bool
+		status int
+		want   string
+	}{
+		{"new file", "sub/new.txt", "", false, http.StatusCreated, "body"},
+		{"replaces by default", "old.txt", "", false, http.StatusCreated, "body"},
+		{"overwrite=false on an existing file", "keep.txt", "?overwrite=false", false, http.StatusConflict, "racer"},
+		{"file created during the upload", "raced.txt", "?overwrite=false", true, http.StatusConflict, "racer"},
+		{"created during the upload, overwrite allowed", "raced2.txt", "", true, http.StatusCreated, "body"},
+		{"directory", "dir", "", false, http.StatusConflict, ""},
+		{"no file name", "dir/", "", false, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			absPath := filepath.Join(rootDir, tt.target)
+			var body io.Reader = strings.NewReader("body")
+			if tt.race {
+				body = &racingBody{path: absPath, r: body}
+			}
+			r := httptest.NewRequest(http.MethodPut, "/api/put/"+tt.target+tt.query, body)
+			r.ContentLength = 4
+			w := httptest.NewRecorder()
+			handleRawUpload(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.want == "" {
+				return
+			}
+			if data, err := os.ReadFile(absPath); err != nil || string(data) != tt.want {
+				t.Errorf("%s holds %q (%v), want %q", tt.target, data, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+var (
+	readmeNames   = []string{"README.md", "readme.md", "Readme.md", "index.md"}
+	readmeMaxSize = int64(256 * 1024)
+)
+
+var (
+	readmeMarkdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+	readmePolicy   = bluemonday.UGCPolicy()
+)
+
+type DirectoryReadme struct {
+	Name string `json:"name"`
+	HTML string `json:"html"`
+}
+
+// rewriteReadmeURL maps a relative link in a README to the API URL that
+// serves the target, so links keep working inside the embedded UI.
+func rewriteReadmeURL(dest, dir, apiPrefix string, image bool) string {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(dest, "//") || u.Path == "" {
+		return dest
+	}
+	rel := path.Join(dir, u.Path)
+	if strings.HasPrefix(u.Path, "/") {
+		rel = path.Clean(strings.TrimPrefix(u.Path, "/"))
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "#"
+	}
+	absPath, err := ensurePathInRoot(rel)
+	if err != nil {
+		return "#"
+	}
+	escaped := (&url.URL{Path: rel}).EscapedPath()
+	switch {
+	case image && isImageFile(rel):
+		return apiPrefix + "image/" + escaped + "?preset=large"
+	case image:
+		return "#"
+	}
+	if info, err := os.Stat(absPath); err == nil && info.IsDir() {
+		return apiPrefix + "directory/list/" + escaped
+	}
+	if isImageFile(rel) {
+		return apiPrefix + "image/" + escaped + "?preset=large"
+	}
+	return apiPrefix + "file/preview/" + escaped
+}
+
+func renderReadme(source []byte, dir, apiPrefix string) string {
+	doc := readmeMarkdown.Parser().Parse(text.NewReader(source))
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node := n.(type) {
+		case *ast.Link:
+			node.Destination = []byte(rewriteReadmeURL(string(node.Destination), dir, apiPrefix, false))
+		case *ast.Image:
+			node.Destination = []byte(rewriteReadmeURL(string(node.Destination), dir, apiPrefix, true))
+		}
+		return ast.WalkContinue, nil
+	})
+	var buf bytes.Buffer
+	if err := readmeMarkdown.Renderer().Render(&buf, source, doc); err != nil {
+		return ""
+	}
+	return readmePolicy.Sanitize(buf.String())
+}
+
+// findDirectoryReadme renders the first README-like file in relDir, or
+// returns nil when there is none.
+func findDirectoryReadme(relDir, apiPrefix string) *DirectoryReadme {
+	absDir, err := ensurePathInRoot(relDir)
+	if err != nil {
+		return nil
+	}
+	for _, name := range readmeNames {
+		info, err := os.Stat(filepath.Join(absDir, name))
+		if err != nil || !info.Mode().IsRegular() || info.Size() > readmeMaxSize {
+			continue
+		}
+		source, err := os.ReadFile(filepath.Join(absDir, name))
+		if err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(rootDir, absDir)
+		return &DirectoryReadme{Name: name, HTML: renderReadme(source, filepath.ToSlash(rel), apiPrefix)}
+	}
+	return nil
+}
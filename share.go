@@ -0,0 +1,651 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var shareRecentMax = 50
+
+const (
+	shareActive    = "active"
+	shareExpired   = "expired"
+	shareRevoked   = "revoked"
+	shareExhausted = "exhausted"
+)
+
+type ShareDownload struct {
+	Path  string `json:"path"`
+	Actor string `json:"actor"`
+	Time  int64  `json:"time"`
+}
+
+type Share struct {
+	ID           string          `json:"id"`
+	Path         string          `json:"path"`
+	IsDir        bool            `json:"isDir"`
+	Password     string          `json:"password,omitempty"`
+	HasPassword  bool            `json:"hasPassword"`
+	ExpiresAt    int64           `json:"expiresAt,omitempty"`
+	MaxDownloads int             `json:"maxDownloads,omitempty"`
+	Downloads    int             `json:"downloads"`
+	Creator      string          `json:"creator"`
+	Created      int64           `json:"created"`
+	RevokedAt    int64           `json:"revokedAt,omitempty"`
+	Recent       []ShareDownload `json:"recent,omitempty"`
+	Status       string          `json:"status,omitempty"`
+	URL          string          `json:"url,omitempty"`
+}
+
+var (
+	sharesMu sync.Mutex
+	shares   = map[string]*Share{}
+)
+
+func sharesFile() string {
+	return filepath.Join(appRootDir, "shares.json")
+}
+
+func loadShares() {
+	data, err := os.ReadFile(sharesFile())
+	if err != nil {
+		return
+	}
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	if err := json.Unmarshal(data, &shares); err != nil {
+		log.Printf("读取分享链接失败: %v", err)
+	}
+}
+
+// saveShares must be called with sharesMu held.
+func saveShares() error {
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := sharesFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sharesFile())
+}
+
+// sharePasswordMaxLen is the longest password bcrypt accepts.
+const sharePasswordMaxLen = 72
+
+func hashSharePassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkSharePassword verifies password against a bcrypt hash, or against the
+// salted SHA-256 "salt$hex" form stored by earlier versions.
+func checkSharePassword(stored, password string) bool {
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	salt, _, ok := strings.Cut(stored, "$")
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(salt + "\x00" + password))
+	return subtle.ConstantTimeCompare([]byte(salt+"$"+hex.EncodeToString(sum[:])), []byte(stored)) == 1
+}
+
+// shareCookieValue is derived from the stored password hash, so changing or
+// removing the password invalidates earlier cookies.
+func shareCookieValue(s *Share) string {
+	sum := sha256.Sum256([]byte(s.ID + "\x00" + s.Password))
+	return hex.EncodeToString(sum[:16])
+}
+
+func shareStatus(s *Share) string {
+	switch {
+	case s.RevokedAt != 0:
+		return shareRevoked
+	case s.ExpiresAt != 0 && time.Now().Unix() >= s.ExpiresAt:
+		return shareExpired
+	case s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads:
+		return shareExhausted
+	}
+	return shareActive
+}
+
+// shareView returns a copy of s safe to send to the client.
+func shareView(r *http.Request, s *Share) Share {
+	v := *s
+	v.HasPassword = s.Password != ""
+	v.Password = ""
+	v.Status = shareStatus(s)
+	v.URL = requestBaseURL(r) + apiPrefix(r) + "s/" + s.ID
+	v.Recent = append([]ShareDownload(nil), s.Recent...)
+	return v
+}
+
+func parseShareExpiry(expiresAt, expiresIn string) (int64, error) {
+	if expiresAt != "" {
+		if n, err := strconv.ParseInt(expiresAt, 10, 64); err == nil {
+			return n, nil
+		}
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return 0, fmt.Errorf("参数 expiresAt 应为 RFC3339 时间或 Unix 时间戳")
+		}
+		return t.Unix(), nil
+	}
+	if expiresIn != "" {
+		if days, ok := strings.CutSuffix(expiresIn, "d"); ok {
+			n, err := strconv.Atoi(days)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("参数 expiresIn 无效")
+			}
+			return time.Now().Add(time.Duration(n) * 24 * time.Hour).Unix(), nil
+		}
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("参数 expiresIn 无效")
+		}
+		return time.Now().Add(d).Unix(), nil
+	}
+	return 0, nil
+}
+
+func handleShareCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	pathParam := strings.Trim(r.FormValue("path"), "/")
+	if pathParam == "" {
+		writeError(w, http.StatusBadRequest, "不能分享根目录")
+		return
+	}
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "文件不存在")
+		return
+	}
+	expiresAt, err := parseShareExpiry(r.FormValue("expiresAt"), r.FormValue("expiresIn"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		writeError(w, http.StatusBadRequest, "过期时间必须晚于当前时间")
+		return
+	}
+	maxDownloads := 0
+	if v := r.FormValue("maxDownloads"); v != "" {
+		maxDownloads, err = strconv.Atoi(v)
+		if err != nil || maxDownloads < 0 {
+			writeError(w, http.StatusBadRequest, "参数 maxDownloads 无效")
+			return
+		}
+	}
+
+	password := r.FormValue("password")
+	if len(password) > sharePasswordMaxLen {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("密码不能超过 %d 字节", sharePasswordMaxLen))
+		return
+	}
+
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	s := &Share{
+		ID:           randomToken(16),
+		Path:         filepath.ToSlash(relPath),
+		IsDir:        info.IsDir(),
+		ExpiresAt:    expiresAt,
+		MaxDownloads: maxDownloads,
+		Creator:      requestActor(r),
+		Created:      time.Now().Unix(),
+	}
+	if password != "" {
+		if s.Password, err = hashSharePassword(password); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法保存分享密码: %v", err))
+			return
+		}
+	}
+	sharesMu.Lock()
+	shares[s.ID] = s
+	err = saveShares()
+	view := shareView(r, s)
+	sharesMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法保存分享链接: %v", err))
+		return
+	}
+	log.Printf("创建分享链接: %s -> %s（创建者 %s）", s.ID, s.Path, s.Creator)
+	writeJSON(w, http.StatusCreated, SuccessResponse{Message: "分享链接已创建", Data: view})
+}
+
+func handleShareList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	filter := strings.Trim(r.URL.Query().Get("path"), "/")
+	sharesMu.Lock()
+	list := make([]Share, 0, len(shares))
+	for _, s := range shares {
+		if filter != "" && s.Path != filter && !strings.HasPrefix(s.Path, filter+"/") {
+			continue
+		}
+		list = append(list, shareView(r, s))
+	}
+	sharesMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"shares": list,
+	})
+}
+
+// handleShareRevoke disables a link; ?delete=true also drops its record.
+func handleShareRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	id := r.FormValue("id")
+	sharesMu.Lock()
+	s, ok := shares[id]
+	if !ok {
+		sharesMu.Unlock()
+		writeError(w, http.StatusNotFound, "分享链接不存在")
+		return
+	}
+	if r.FormValue("delete") == "true" {
+		delete(shares, id)
+	} else if s.RevokedAt == 0 {
+		s.RevokedAt = time.Now().Unix()
+	}
+	err := saveShares()
+	sharesMu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法保存分享链接: %v", err))
+		return
+	}
+	log.Printf("分享链接已撤销: %s -> %s（操作者 %s）", s.ID, s.Path, requestActor(r))
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "分享链接已撤销"})
+}
+
+func handleShareQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id := strings.TrimSuffix(apiPathParam(r, "share/qr/"), ".png")
+	sharesMu.Lock()
+	s, ok := shares[id]
+	var view Share
+	if ok {
+		view = shareView(r, s)
+	}
+	sharesMu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "分享链接不存在")
+		return
+	}
+	size := 256
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 64 || n > 1024 {
+			writeError(w, http.StatusBadRequest, "参数 size 应在 64 到 1024 之间")
+			return
+		}
+		size = n
+	}
+	png, err := qrcode.Encode(view.URL, qrcode.Medium, size)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("生成二维码失败: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	_, _ = w.Write(png)
+}
+
+// resolveSharedPath maps a path inside a share to an absolute path. Symlinks
+// are resolved so a link inside a shared folder cannot expose files outside
+// of it.
+func resolveSharedPath(s *Share, sub string) (string, error) {
+	absShare, err := ensurePathInRoot(s.Path)
+	if err != nil {
+		return "", err
+	}
+	sub = strings.Trim(path.Clean("/"+sub), "/")
+	if sub == "" {
+		return absShare, nil
+	}
+	if !s.IsDir {
+		return "", fmt.Errorf("路径不在分享范围内")
+	}
+	for _, part := range strings.Split(sub, "/") {
+		if isHiddenName(part) {
+			return "", fmt.Errorf("路径不在分享范围内")
+		}
+	}
+	absPath := filepath.Join(absShare, filepath.FromSlash(sub))
+	realShare, err := filepath.EvalSymlinks(absShare)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realShare, realPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("路径不在分享范围内")
+	}
+	return absPath, nil
+}
+
+func shareAuthorized(r *http.Request, s *Share) bool {
+	if s.Password == "" {
+		return true
+	}
+	if c, err := r.Cookie("share_" + s.ID); err == nil {
+		if subtle.ConstantTimeCompare([]byte(c.Value), []byte(shareCookieValue(s))) == 1 {
+			return true
+		}
+	}
+	password := r.Header.Get("X-Share-Password")
+	return password != "" && checkSharePassword(s.Password, password)
+}
+
+func wantsShareJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	accept := r.Header.Get("Accept")
+	return !strings.Contains(accept, "text/html") && (accept == "" || strings.Contains(accept, "json"))
+}
+
+var sharePageTemplate = template.Must(template.New("share").Funcs(template.FuncMap{
+	"size": formatFileSize,
+	"date": func(t int64) string { return time.Unix(t, 0).Format("2006-01-02 15:04") },
+}).Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+<style>
+body{font-family:-apple-system,"Segoe UI","PingFang SC","Microsoft YaHei",sans-serif;max-width:860px;margin:2em auto;padding:0 1em;color:#222}
+table{width:100%;border-collapse:collapse}td{padding:.4em;border-bottom:1px solid #eee}
+td.s{text-align:right;color:#666;white-space:nowrap}a{color:#1565c0;text-decoration:none}
+.note{color:#666;font-size:.9em}.err{color:#c62828}
+</style>
+</head>
+<body>
+<h2>{{.Title}}</h2>
+{{if .Error}}<p class="err">{{.Error}}</p>{{end}}
+{{if .AskPassword}}
+<form method="post"><p>此分享需要密码：</p><input type="password" name="password" autofocus> <button type="submit">确定</button></form>
+{{else}}
+{{if .Parent}}<p><a href="{{.Parent}}">⬆ 上级目录</a></p>{{end}}
+{{if .Entries}}<table>
+{{range .Entries}}<tr><td>{{if .IsDir}}📁 <a href="{{.Href}}">{{.Name}}/</a>{{else}}📄 <a href="{{.Href}}">{{.Name}}</a>{{end}}</td><td class="s">{{if not .IsDir}}{{size .Size}}{{end}}</td><td class="s">{{date .ModTime}}</td></tr>
+{{end}}</table>{{end}}
+{{end}}
+{{if or .ExpiresAt .Remaining}}<p class="note">{{if .ExpiresAt}}有效期至 {{date .ExpiresAt}}。{{end}}{{if .Remaining}}剩余下载次数 {{.Remaining}}。{{end}}</p>{{end}}
+</body>
+</html>
+`))
+
+type sharePageEntry struct {
+	FileInfo
+	Href string
+}
+
+type sharePage struct {
+	Title       string
+	Error       string
+	AskPassword bool
+	Parent      string
+	Entries     []sharePageEntry
+	ExpiresAt   int64
+	Remaining   int
+}
+
+func renderSharePage(w http.ResponseWriter, status int, page sharePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.WriteHeader(status)
+	if err := sharePageTemplate.Execute(w, page); err != nil {
+		log.Printf("渲染分享页面失败: %v", err)
+	}
+}
+
+// handleSharePublic serves /s/<id>[/<path>] without login: a listing (HTML or
+// ?format=json) for folders, the file itself with ?dl=1, and a password form
+// that sets a cookie on POST.
+func handleSharePublic(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(apiPathParam(r, "s/"), "/")
+	jsonOut := wantsShareJSON(r)
+	fail := func(status int, msg string) {
+		if jsonOut {
+			writeError(w, status, msg)
+			return
+		}
+		renderSharePage(w, status, sharePage{Title: "文件分享", Error: msg})
+	}
+
+	sharesMu.Lock()
+	s, ok := shares[id]
+	var snapshot Share
+	if ok {
+		snapshot = *s
+	}
+	sharesMu.Unlock()
+	if !ok {
+		fail(http.StatusNotFound, "分享链接不存在")
+		return
+	}
+	switch shareStatus(&snapshot) {
+	case shareRevoked:
+		fail(http.StatusGone, "分享链接已被撤销")
+		return
+	case shareExpired:
+		fail(http.StatusGone, "分享链接已过期")
+		return
+	}
+	base := apiPrefix(r) + "s/" + id
+	title := path.Base(snapshot.Path)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil || !checkSharePassword(snapshot.Password, r.PostFormValue("password")) {
+			if jsonOut {
+				writeError(w, http.StatusUnauthorized, "密码错误")
+				return
+			}
+			renderSharePage(w, http.StatusUnauthorized, sharePage{Title: title, Error: "密码错误", AskPassword: true})
+			return
+		}
+		cookie := &http.Cookie{
+			Name:     "share_" + id,
+			Value:    shareCookieValue(&snapshot),
+			Path:     base,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if snapshot.ExpiresAt != 0 {
+			cookie.Expires = time.Unix(snapshot.ExpiresAt, 0)
+		}
+		http.SetCookie(w, cookie)
+		if jsonOut {
+			writeJSON(w, http.StatusOK, SuccessResponse{Message: "验证成功"})
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !shareAuthorized(r, &snapshot) {
+		if jsonOut {
+			writeError(w, http.StatusUnauthorized, "需要密码")
+			return
+		}
+		renderSharePage(w, http.StatusUnauthorized, sharePage{Title: title, AskPassword: true})
+		return
+	}
+	absPath, err := resolveSharedPath(&snapshot, sub)
+	if err != nil {
+		fail(http.StatusNotFound, "文件不存在")
+		return
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		fail(http.StatusNotFound, "文件不存在")
+		return
+	}
+	remaining := 0
+	if snapshot.MaxDownloads > 0 {
+		remaining = snapshot.MaxDownloads - snapshot.Downloads
+	}
+
+	if info.IsDir() {
+		relDir, _ := filepath.Rel(rootDir, absPath)
+		files, err := listDirectory(relDir)
+		if err != nil {
+			fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		sub = strings.Trim(path.Clean("/"+sub), "/")
+		entries := make([]sharePageEntry, 0, len(files))
+		for _, f := range files {
+			f.Path = strings.TrimPrefix(path.Join(sub, f.Name), "/")
+			if f.IsSymlink {
+				if _, err := resolveSharedPath(&snapshot, f.Path); err != nil {
+					continue
+				}
+			}
+			f.SymlinkTarget = ""
+			href := base + "/" + escapePath(f.Path)
+			if !f.IsDir {
+				href += "?dl=1"
+			}
+			entries = append(entries, sharePageEntry{FileInfo: f, Href: href})
+		}
+		if jsonOut {
+			list := make([]FileInfo, len(entries))
+			for i, e := range entries {
+				list[i] = e.FileInfo
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"name":         title,
+				"path":         sub,
+				"files":        list,
+				"expiresAt":    snapshot.ExpiresAt,
+				"maxDownloads": snapshot.MaxDownloads,
+				"downloads":    snapshot.Downloads,
+			})
+			return
+		}
+		page := sharePage{Title: title, Entries: entries, ExpiresAt: snapshot.ExpiresAt, Remaining: remaining}
+		if sub != "" {
+			page.Title = title + "/" + sub
+			page.Parent = strings.TrimSuffix(base+"/"+escapePath(path.Dir(sub)), "/.")
+		}
+		renderSharePage(w, http.StatusOK, page)
+		return
+	}
+
+	if r.URL.Query().Get("dl") != "1" {
+		file := FileInfo{Name: info.Name(), Path: sub, Size: info.Size(), ModTime: info.ModTime().Unix()}
+		if jsonOut {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"name":         title,
+				"file":         file,
+				"expiresAt":    snapshot.ExpiresAt,
+				"maxDownloads": snapshot.MaxDownloads,
+				"downloads":    snapshot.Downloads,
+			})
+			return
+		}
+		page := sharePage{Title: title, ExpiresAt: snapshot.ExpiresAt, Remaining: remaining}
+		page.Entries = []sharePageEntry{{FileInfo: file, Href: r.URL.Path + "?dl=1"}}
+		renderSharePage(w, http.StatusOK, page)
+		return
+	}
+	if !countShareDownload(r, id, sub, info.Size()) {
+		fail(http.StatusGone, "分享链接下载次数已用完")
+		return
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		fail(http.StatusNotFound, "文件不存在")
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", getContentType(info.Name()))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	recordFileAccess(r, absPath, info.Size())
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// countShareDownload records a download and reports whether the limit still
+// allows it. Only requests that countsAsDownload are counted; once the limit
+// is reached nothing is served, not even ranges in the middle of the file.
+func countShareDownload(r *http.Request, id, sub string, size int64) bool {
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	s, ok := shares[id]
+	if !ok || shareStatus(s) != shareActive {
+		return false
+	}
+	if !countsAsDownload(r, size) {
+		return true
+	}
+	s.Downloads++
+	s.Recent = append(s.Recent, ShareDownload{
+		Path:  strings.TrimPrefix(path.Join(s.Path, sub), "/"),
+		Actor: requestActor(r),
+		Time:  time.Now().Unix(),
+	})
+	if len(s.Recent) > shareRecentMax {
+		s.Recent = s.Recent[len(s.Recent)-shareRecentMax:]
+	}
+	if err := saveShares(); err != nil {
+		log.Printf("保存分享下载记录失败: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleSharePublic(t *testing.T) {
+	useTempRoots(t)
+	savedShares := shares
+	t.Cleanup(func() { shares = savedShares })
+	if err := os.WriteFile(filepath.Join(rootDir, "doc.txt"), []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashSharePassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares = map[string]*Share{
+		"locked":  {ID: "locked", Path: "doc.txt", Password: hash, MaxDownloads: 2},
+		"revoked": {ID: "revoked", Path: "doc.txt", RevokedAt: 1},
+		"expired": {ID: "expired", Path: "doc.txt", ExpiresAt: time.Now().Add(-time.Hour).Unix()},
+		"open":    {ID: "open", Path: "doc.txt"},
+	}
+
+	var cookie *http.Cookie
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		password  string
+		header    string
+		rangeSpec string
+		useCookie bool
+		status    int
+		downloads int
+	}{
+		{"no password", http.MethodGet, "locked?dl=1", "", "", "", false, http.StatusUnauthorized, 0},
+		{"wrong password header", http.MethodGet, "locked?dl=1", "", "nope", "", false, http.StatusUnauthorized, 0},
+		{"wrong password form", http.MethodPost, "locked", "nope", "", "", false, http.StatusUnauthorized, 0},
+		{"password form sets cookie", http.MethodPost, "locked", "pw", "", "", false, http.StatusOK, 0},
+		{"download with cookie", http.MethodGet, "locked?dl=1", "", "", "", true, http.StatusOK, 1},
+		{"range in the middle is free", http.MethodGet, "locked?dl=1", "", "", "bytes=2-5", true, http.StatusPartialContent, 1},
+		{"range from the start counts", http.MethodGet, "locked?dl=1", "", "", "bytes=0-4", true, http.StatusPartialContent, 2},
+		{"limit reached", http.MethodGet, "locked?dl=1", "", "pw", "", false, http.StatusGone, 2},
+		{"no sub path in a file share", http.MethodGet, "open/secret.txt?dl=1", "", "", "", false, http.StatusNotFound, 0},
+		{"revoked", http.MethodGet, "revoked?dl=1", "", "", "", false, http.StatusGone, 0},
+		{"expired", http.MethodGet, "expired?dl=1", "", "", "", false, http.StatusGone, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.NewReader("")
+			if tt.password != "" {
+				body = strings.NewReader(url.Values{"password": {tt.password}}.Encode())
+			}
+			target := "/api/s/" + tt.target
+			if strings.Contains(target, "?") {
+				target += "&format=json"
+			} else {
+				target += "?format=json"
+			}
+			r := httptest.NewRequest(tt.method, target, body)
+			if tt.method == http.MethodPost {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.header != "" {
+				r.Header.Set("X-Share-Password", tt.header)
+			}
+			if tt.rangeSpec != "" {
+				r.Header.Set("Range", tt.rangeSpec)
+			}
+			if tt.useCookie {
+				if cookie == nil {
+					t.Fatal("no share cookie was issued")
+				}
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			handleSharePublic(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			for _, c := range w.Result().Cookies() {
+				if c.Name == "share_locked" {
+					cookie = c
+				}
+			}
+			id, _, _ := strings.Cut(tt.target, "/")
+			id, _, _ = strings.Cut(id, "?")
+			sharesMu.Lock()
+			downloads := shares[id].Downloads
+			sharesMu.Unlock()
+			if downloads != tt.downloads {
+				t.Errorf("downloads = %d, want %d", downloads, tt.downloads)
+			}
+		})
+	}
+
+	// Changing the password invalidates cookies issued for the old one.
+	sharesMu.Lock()
+	shares["locked"].Password, _ = hashSharePassword("new")
+	shares["locked"].Downloads = 0
+	sharesMu.Unlock()
+	r := httptest.NewRequest(http.MethodGet, "/api/s/locked?format=json", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handleSharePublic(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("old cookie after a password change: status = %d, want 401", w.Code)
+	}
+}
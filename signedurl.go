@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	signedURLDefaultTTL = time.Hour
+	signedURLMaxTTL     = 30 * 24 * time.Hour
+)
+
+// Query parameters of a signed URL. All other query parameters are covered by
+// the signature as well, so handlers taking their target from the query
+// (file/rename?path=...) cannot be pointed elsewhere.
+const (
+	sigParam        = "sig"
+	sigKeyParam     = "sigKey"
+	sigExpiresParam = "sigExpires"
+	sigMaxSizeParam = "sigMaxSize"
+	sigTypeParam    = "sigType"
+)
+
+type SigningKey struct {
+	ID      string `json:"id"`
+	Secret  string `json:"secret,omitempty"`
+	Created int64  `json:"created"`
+	Active  bool   `json:"active"`
+}
+
+var (
+	signingKeysMu sync.Mutex
+	signingKeys   []*SigningKey
+)
+
+func signingKeysFile() string {
+	return filepath.Join(appRootDir, "signing_keys.json")
+}
+
+// loadSigningKeys reads the key ring, creating a first key if there is none.
+func loadSigningKeys() {
+	signingKeysMu.Lock()
+	defer signingKeysMu.Unlock()
+	if data, err := os.ReadFile(signingKeysFile()); err == nil {
+		if err := json.Unmarshal(data, &signingKeys); err != nil {
+			log.Printf("读取签名密钥失败: %v", err)
+		}
+	}
+	if len(signingKeys) == 0 {
+		signingKeys = []*SigningKey{newSigningKey()}
+		if err := saveSigningKeys(); err != nil {
+			log.Printf("保存签名密钥失败: %v", err)
+		}
+	}
+}
+
+// saveSigningKeys must be called with signingKeysMu held.
+func saveSigningKeys() error {
+	data, err := json.MarshalIndent(signingKeys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := signingKeysFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, signingKeysFile())
+}
+
+func newSigningKey() *SigningKey {
+	return &SigningKey{ID: randomToken(4), Secret: randomToken(32), Created: time.Now().Unix(), Active: true}
+}
+
+func findSigningKey(id string) *SigningKey {
+	for _, k := range signingKeys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+func activeSigningKey() *SigningKey {
+	for _, k := range signingKeys {
+		if k.Active {
+			return k
+		}
+	}
+	return nil
+}
+
+// signedPath normalizes an API path so a signature is valid on both the
+// /api and the /filesuploader/api prefix.
+func signedPath(p string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(p, "/"), "filesuploader/"), "api/")
+}
+
+// signedQuery returns the canonical form of the query parameters covered by a
+// signature: everything except the sig* parameters, sorted by key.
+func signedQuery(q url.Values) string {
+	rest := url.Values{}
+	for k, v := range q {
+		switch k {
+		case sigParam, sigKeyParam, sigExpiresParam, sigMaxSizeParam, sigTypeParam:
+			continue
+		}
+		rest[k] = v
+	}
+	return rest.Encode()
+}
+
+func computeSignature(secret, method, apiPath, query string, expires, maxSize int64, contentType string) string {
+	key, _ := hex.DecodeString(secret)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%d\n%s", method, signedPath(apiPath), query, expires, maxSize, contentType)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedBodyRoute reports whether a signed request to apiPath may carry a
+// body: only the raw uploads PUT/POST put/<path> and transfer/<name>, whose
+// body is file content bounded by sigMaxSize and sigType. Every other
+// endpoint, including multipart file/upload and JSON ones such as
+// file/batch-rename, takes its parameters from the signed query alone; a
+// body there would not be covered by the signature.
+func signedBodyRoute(method, apiPath string) bool {
+	if method != http.MethodPut && method != http.MethodPost {
+		return false
+	}
+	if rest, ok := strings.CutPrefix(apiPath, "/put/"); ok {
+		return rest != ""
+	}
+	if rest, ok := strings.CutPrefix(apiPath, "/transfer/"); ok {
+		return rest != "" && !strings.Contains(rest, "/")
+	}
+	return false
+}
+
+// hasRequestBody reports whether r sends a body, sized or chunked.
+func hasRequestBody(r *http.Request) bool {
+	return r.ContentLength != 0 || len(r.TransferEncoding) > 0
+}
+
+// verifySignedRequest checks the signature of r. It returns the key ID on
+// success, or an HTTP status and message describing the failure.
+func verifySignedRequest(r *http.Request) (string, int, string) {
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get(sigExpiresParam), 10, 64)
+	if err != nil {
+		return "", http.StatusForbidden, "签名参数无效"
+	}
+	var maxSize int64
+	if v := q.Get(sigMaxSizeParam); v != "" {
+		if maxSize, err = strconv.ParseInt(v, 10, 64); err != nil || maxSize < 0 {
+			return "", http.StatusForbidden, "签名参数无效"
+		}
+	}
+	contentType := q.Get(sigTypeParam)
+
+	signingKeysMu.Lock()
+	key := findSigningKey(q.Get(sigKeyParam))
+	var secret string
+	if key != nil {
+		secret = key.Secret
+	}
+	signingKeysMu.Unlock()
+	if key == nil {
+		return "", http.StatusForbidden, "签名密钥不存在或已停用"
+	}
+
+	// A URL signed for GET may also be used for HEAD.
+	method := r.Method
+	query := signedQuery(q)
+	expected := computeSignature(secret, method, r.URL.Path, query, expires, maxSize, contentType)
+	if method == http.MethodHead && !hmac.Equal([]byte(expected), []byte(q.Get(sigParam))) {
+		expected = computeSignature(secret, http.MethodGet, r.URL.Path, query, expires, maxSize, contentType)
+	}
+	if !hmac.Equal([]byte(expected), []byte(q.Get(sigParam))) {
+		return "", http.StatusForbidden, "签名无效"
+	}
+	if time.Now().Unix() >= expires {
+		return "", http.StatusForbidden, "签名链接已过期"
+	}
+	if hasRequestBody(r) && !signedBodyRoute(r.Method, signedPath(r.URL.Path)) {
+		return "", http.StatusUnsupportedMediaType, "签名链接只有 put/ 和 transfer/ 上传可以携带请求体，其他参数必须放在查询字符串中"
+	}
+	if contentType != "" {
+		got, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		want, _, _ := mime.ParseMediaType(contentType)
+		if got == "" || !strings.EqualFold(got, want) {
+			return "", http.StatusUnsupportedMediaType, "Content-Type 与签名不符"
+		}
+	}
+	if maxSize > 0 && r.ContentLength > maxSize {
+		return "", http.StatusRequestEntityTooLarge, fmt.Sprintf("请求内容超过签名允许的 %d 字节", maxSize)
+	}
+	return key.ID, 0, ""
+}
+
+// withSignedURLs verifies API requests that carry a signature before they
+// reach the mux. A valid signature authorizes the request on its own, so the
+// reverse proxy may let such requests through without a login session; an
+// invalid one is rejected instead of falling back to other checks.
+func withSignedURLs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.Query().Has(sigParam) ||
+			!(strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/filesuploader/api/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Signed URLs cannot mint further signed URLs or manage keys.
+		if strings.HasPrefix(signedPath(r.URL.Path), "/sign/") {
+			writeError(w, http.StatusForbidden, "签名链接不能访问签名接口")
+			return
+		}
+		keyID, status, msg := verifySignedRequest(r)
+		if status != 0 {
+			log.Printf("签名链接校验失败: %s %s（%s，来自 %s）", r.Method, r.URL.Path, msg, requestActor(r))
+			writeError(w, status, msg)
+			return
+		}
+		if v := r.URL.Query().Get(sigMaxSizeParam); v != "" {
+			maxSize, _ := strconv.ParseInt(v, 10, 64)
+			if maxSize > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+			}
+		}
+		next.ServeHTTP(w, withActor(r, "signed:"+keyID))
+	})
+}
+
+// handleSignURL returns a signed URL for one API request. Parameters the
+// handler needs (path, newName, ...) go in query and become part of the
+// signature. Any GET, HEAD or DELETE endpoint and any POST endpoint that reads
+// only the query can be signed; uploads are signed through the raw put/ and
+// transfer/ routes, the only ones allowed a body (see signedBodyRoute).
+func handleSignURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	method := strings.ToUpper(r.FormValue("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete:
+	default:
+		writeError(w, http.StatusBadRequest, "不支持的 method")
+		return
+	}
+	apiPath := signedPath(r.FormValue("path"))
+	if apiPath == "/" || strings.HasPrefix(apiPath, "/sign/") || strings.Contains(apiPath, "/../") || strings.HasSuffix(apiPath, "/..") {
+		writeError(w, http.StatusBadRequest, "参数 path 无效")
+		return
+	}
+	query, err := url.ParseQuery(r.FormValue("query"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "参数 query 无效")
+		return
+	}
+	for _, k := range []string{sigParam, sigKeyParam, sigExpiresParam, sigMaxSizeParam, sigTypeParam} {
+		if query.Has(k) {
+			writeError(w, http.StatusBadRequest, "参数 query 不能包含 "+k)
+			return
+		}
+	}
+	expires := time.Now().Add(signedURLDefaultTTL).Unix()
+	if r.FormValue("expiresAt") != "" || r.FormValue("expiresIn") != "" {
+		var err error
+		expires, err = parseShareExpiry(r.FormValue("expiresAt"), r.FormValue("expiresIn"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if expires <= time.Now().Unix() || expires > time.Now().Add(signedURLMaxTTL).Unix() {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("有效期必须在 %v 以内", signedURLMaxTTL))
+		return
+	}
+	var maxSize int64
+	if v := r.FormValue("maxSize"); v != "" {
+		var err error
+		if maxSize, err = strconv.ParseInt(v, 10, 64); err != nil || maxSize < 0 {
+			writeError(w, http.StatusBadRequest, "参数 maxSize 无效")
+			return
+		}
+	}
+	contentType := strings.TrimSpace(r.FormValue("contentType"))
+	if contentType != "" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			writeError(w, http.StatusBadRequest, "参数 contentType 无效")
+			return
+		}
+	}
+
+	signingKeysMu.Lock()
+	key := activeSigningKey()
+	var keyID, secret string
+	if key != nil {
+		keyID, secret = key.ID, key.Secret
+	}
+	signingKeysMu.Unlock()
+	if key == nil {
+		writeError(w, http.StatusServiceUnavailable, "没有可用的签名密钥")
+		return
+	}
+
+	q := query
+	q.Set(sigKeyParam, keyID)
+	q.Set(sigExpiresParam, strconv.FormatInt(expires, 10))
+	if maxSize > 0 {
+		q.Set(sigMaxSizeParam, strconv.FormatInt(maxSize, 10))
+	}
+	if contentType != "" {
+		q.Set(sigTypeParam, contentType)
+	}
+	q.Set(sigParam, computeSignature(secret, method, apiPath, signedQuery(query), expires, maxSize, contentType))
+	signed := requestBaseURL(r) + strings.TrimSuffix(apiPrefix(r), "/") + escapePath(apiPath) + "?" + q.Encode()
+	log.Printf("生成签名链接: %s %s（密钥 %s，有效期至 %s，操作者 %s）", method, apiPath, keyID, time.Unix(expires, 0).Format(time.RFC3339), requestActor(r))
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "签名链接已生成", Data: map[string]interface{}{
+		"url":       signed,
+		"method":    method,
+		"expiresAt": expires,
+		"keyId":     keyID,
+	}})
+}
+
+// handleSigningKeys lists keys (GET) or rotates them (POST). Rotation makes a
+// new key active; older keys keep verifying until removed with remove=<id>.
+func handleSigningKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, "无法解析请求")
+			return
+		}
+		signingKeysMu.Lock()
+		var msg string
+		if id := r.FormValue("remove"); id != "" {
+			kept := signingKeys[:0]
+			for _, k := range signingKeys {
+				if k.ID != id {
+					kept = append(kept, k)
+				}
+			}
+			if len(kept) == len(signingKeys) {
+				signingKeysMu.Unlock()
+				writeError(w, http.StatusNotFound, "签名密钥不存在")
+				return
+			}
+			signingKeys = kept
+			if activeSigningKey() == nil && len(signingKeys) > 0 {
+				signingKeys[len(signingKeys)-1].Active = true
+			}
+			msg = "签名密钥已删除: " + id
+		} else {
+			for _, k := range signingKeys {
+				k.Active = false
+			}
+			key := newSigningKey()
+			signingKeys = append(signingKeys, key)
+			msg = "签名密钥已轮换，新密钥: " + key.ID
+		}
+		err := saveSigningKeys()
+		signingKeysMu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("保存签名密钥失败: %v", err))
+			return
+		}
+		log.Printf("%s（操作者 %s）", msg, requestActor(r))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	signingKeysMu.Lock()
+	keys := make([]SigningKey, 0, len(signingKeys))
+	for _, k := range signingKeys {
+		keys = append(keys, SigningKey{ID: k.ID, Created: k.Created, Active: k.Active})
+	}
+	signingKeysMu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created > keys[j].Created })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": keys,
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"sorted by key", "path=a.txt&newName=b.txt", "newName=b.txt&path=a.txt"},
+		{"sig parameters dropped", "sig=x&sigKey=k&sigExpires=1&sigMaxSize=2&sigType=text%2Fplain&path=a", "path=a"},
+		{"repeated values keep order", "tag=b&tag=a", "tag=b&tag=a"},
+		{"escaping normalized", "path=a%20b", "path=a+b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := signedQuery(q); got != tt.want {
+				t.Errorf("signedQuery(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeSignaturePrefixes(t *testing.T) {
+	secret := strings.Repeat("ab", 32)
+	base := computeSignature(secret, http.MethodGet, "/api/file/download/a.txt", "", 100, 0, "")
+	for _, p := range []string{"/filesuploader/api/file/download/a.txt", "file/download/a.txt", "/file/download/a.txt"} {
+		if got := computeSignature(secret, http.MethodGet, p, "", 100, 0, ""); got != base {
+			t.Errorf("signature for %q differs from /api form", p)
+		}
+	}
+	if computeSignature(secret, http.MethodGet, "/api/file/download/a.txt", "x=1", 100, 0, "") == base {
+		t.Error("query is not covered by the signature")
+	}
+}
+
+// reverseQuery reverses the order of the query parameters of target.
+func reverseQuery(target string) string {
+	p, query, _ := strings.Cut(target, "?")
+	parts := strings.Split(query, "&")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return p + "?" + strings.Join(parts, "&")
+}
+
+func TestVerifySignedRequest(t *testing.T) {
+	signingKeysMu.Lock()
+	saved := signingKeys
+	signingKeys = []*SigningKey{{ID: "k1", Secret: strings.Repeat("0f", 32), Active: true}}
+	signingKeysMu.Unlock()
+	defer func() {
+		signingKeysMu.Lock()
+		signingKeys = saved
+		signingKeysMu.Unlock()
+	}()
+
+	future := time.Now().Add(time.Hour).Unix()
+	sign := func(method, apiPath, query string, expires, maxSize int64, contentType string) string {
+		q, _ := url.ParseQuery(query)
+		q.Set(sigKeyParam, "k1")
+		q.Set(sigExpiresParam, strconv.FormatInt(expires, 10))
+		if maxSize > 0 {
+			q.Set(sigMaxSizeParam, strconv.FormatInt(maxSize, 10))
+		}
+		if contentType != "" {
+			q.Set(sigTypeParam, contentType)
+		}
+		q.Set(sigParam, computeSignature(strings.Repeat("0f", 32), method, apiPath, signedQuery(q), expires, maxSize, contentType))
+		return apiPath + "?" + q.Encode()
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"valid GET", http.MethodGet, sign(http.MethodGet, "/api/file/download/a.txt", "", future, 0, ""), "", "", 0},
+		{"valid on proxy prefix", http.MethodGet, "/filesuploader" + sign(http.MethodGet, "/api/file/download/a.txt", "", future, 0, ""), "", "", 0},
+		{"HEAD with GET signature", http.MethodHead, sign(http.MethodGet, "/api/file/download/a.txt", "", future, 0, ""), "", "", 0},
+		{"wrong method", http.MethodDelete, sign(http.MethodGet, "/api/file/download/a.txt", "", future, 0, ""), "", "", http.StatusForbidden},
+		{"other path", http.MethodGet, strings.Replace(sign(http.MethodGet, "/api/file/download/a.txt", "", future, 0, ""), "a.txt", "b.txt", 1), "", "", http.StatusForbidden},
+		{"query tampered", http.MethodPost, strings.Replace(sign(http.MethodPost, "/api/file/rename", "oldPath=a.txt&newName=b.txt", future, 0, ""), "oldPath=a.txt", "oldPath=c.txt", 1), "", "", http.StatusForbidden},
+		{"query added", http.MethodPost, sign(http.MethodPost, "/api/file/rename", "oldPath=a.txt&newName=b.txt", future, 0, "") + "&path=x", "", "", http.StatusForbidden},
+		{"query reordered", http.MethodPost, reverseQuery(sign(http.MethodPost, "/api/file/rename", "oldPath=a.txt&newName=b.txt", future, 0, "")), "", "", 0},
+		{"form body refused", http.MethodPost, sign(http.MethodPost, "/api/file/rename", "oldPath=a.txt&newName=b.txt", future, 0, ""), "application/x-www-form-urlencoded", "oldPath=c.txt", http.StatusUnsupportedMediaType},
+		{"multipart body refused", http.MethodPost, sign(http.MethodPost, "/api/file/upload", "", future, 0, ""), "multipart/form-data; boundary=x", "--x--\r\n", http.StatusUnsupportedMediaType},
+		{"JSON body refused", http.MethodPost, sign(http.MethodPost, "/api/file/batch-rename", "", future, 0, ""), "application/json", `{"paths":["a.txt"],"pattern":"x"}`, http.StatusUnsupportedMediaType},
+		{"untyped body refused", http.MethodPost, sign(http.MethodPost, "/api/file/rename", "oldPath=a.txt&newName=b.txt", future, 0, ""), "", "oldPath=c.txt", http.StatusUnsupportedMediaType},
+		{"raw transfer upload", http.MethodPut, sign(http.MethodPut, "/api/transfer/a.txt", "", future, 0, ""), "", "hello", 0},
+		{"multipart transfer refused", http.MethodPost, sign(http.MethodPost, "/api/transfer/", "", future, 0, ""), "multipart/form-data; boundary=x", "--x--\r\n", http.StatusUnsupportedMediaType},
+		{"body on DELETE refused", http.MethodDelete, sign(http.MethodDelete, "/api/put/a.txt", "", future, 0, ""), "", "x", http.StatusUnsupportedMediaType},
+		{"expired", http.MethodGet, sign(http.MethodGet, "/api/file/download/a.txt", "", time.Now().Add(-time.Minute).Unix(), 0, ""), "", "", http.StatusForbidden},
+		{"content type matches", http.MethodPut, sign(http.MethodPut, "/api/put/a.txt", "", future, 0, "text/plain"), "text/plain; charset=utf-8", "hi", 0},
+		{"content type differs", http.MethodPut, sign(http.MethodPut, "/api/put/a.txt", "", future, 0, "text/plain"), "image/png", "hi", http.StatusUnsupportedMediaType},
+		{"too large", http.MethodPut, sign(http.MethodPut, "/api/put/a.txt", "", future, 4, ""), "", "hello", http.StatusRequestEntityTooLarge},
+		{"unknown key", http.MethodGet, strings.Replace(sign(http.MethodGet, "/api/file/download/a.txt", "", future, 0, ""), "sigKey=k1", "sigKey=k2", 1), "", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			keyID, status, msg := verifySignedRequest(r)
+			if status != tt.want {
+				t.Fatalf("status = %d (%s), want %d", status, msg, tt.want)
+			}
+			if status == 0 && keyID != "k1" {
+				t.Errorf("keyID = %q, want k1", keyID)
+			}
+		})
+	}
+}
+
+func TestWithSignedURLs(t *testing.T) {
+	signingKeysMu.Lock()
+	saved := signingKeys
+	signingKeys = []*SigningKey{{ID: "k1", Secret: strings.Repeat("0f", 32), Active: true}}
+	signingKeysMu.Unlock()
+	defer func() {
+		signingKeysMu.Lock()
+		signingKeys = saved
+		signingKeysMu.Unlock()
+	}()
+
+	var actor string
+	var reached bool
+	handler := withSignedURLs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		actor = requestActor(r)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	expires := time.Now().Add(time.Hour).Unix()
+	signed := func(method, apiPath, query string) string {
+		q, _ := url.ParseQuery(query)
+		q.Set(sigKeyParam, "k1")
+		q.Set(sigExpiresParam, strconv.FormatInt(expires, 10))
+		q.Set(sigParam, computeSignature(strings.Repeat("0f", 32), method, apiPath, signedQuery(q), expires, 0, ""))
+		return apiPath + "?" + q.Encode()
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		want    int
+		reached bool
+		actor   string
+	}{
+		{"unsigned request passes through", http.MethodGet, "/api/files?path=.", "", http.StatusNoContent, true, "192.0.2.1"},
+		{"signed request runs as the key", http.MethodPost, signed(http.MethodPost, "/api/file/rename", "oldPath=a&newName=b"), "", http.StatusNoContent, true, "signed:k1"},
+		{"signed JSON body stops before the handler", http.MethodPost, signed(http.MethodPost, "/api/file/batch-rename", ""), `{"paths":["a"]}`, http.StatusUnsupportedMediaType, false, ""},
+		{"bad signature stops before the handler", http.MethodGet, strings.Replace(signed(http.MethodGet, "/api/file/download/a", ""), "/a?", "/b?", 1), "", http.StatusForbidden, false, ""},
+		{"signing endpoint is off limits", http.MethodPost, signed(http.MethodPost, "/api/sign/url", ""), "", http.StatusForbidden, false, ""},
+		{"static files ignore sig", http.MethodGet, "/static/app.js?sig=x", "", http.StatusNoContent, true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached, actor = false, ""
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("X-Remote-User", "admin")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want || reached != tt.reached {
+				t.Fatalf("status = %d, reached %v; want %d, %v (%s)", w.Code, reached, tt.want, tt.reached, w.Body)
+			}
+			if actor != tt.actor {
+				t.Errorf("actor = %q, want %q", actor, tt.actor)
+			}
+		})
+	}
+}
@@ -5,6 +5,10 @@ let fileList = [];
 let uploadModal = null;
 let createDirModal = null;
 let createSymlinkModal = null;
+let editFileModal = null;
+let editingFile = null;
+let shareModal = null;
+let sharingFile = null;
 let apiBasePath = ''; // API基础路径
 
 // 初始化函数
@@ -24,6 +28,8 @@ $(document).ready(function() {
         uploadModal = new bootstrap.Modal(document.getElementById('upload-modal'));
         createDirModal = new bootstrap.Modal(document.getElementById('create-dir-modal'));
         createSymlinkModal = new bootstrap.Modal(document.getElementById('create-symlink-modal'));
+        editFileModal = new bootstrap.Modal(document.getElementById('edit-file-modal'));
+        shareModal = new bootstrap.Modal(document.getElementById('share-modal'));
 
         setTimeout(function() {
             console.log('开始加载数据...');
@@ -185,6 +191,16 @@ function bindEvents() {
         createDirectory();
     });
 
+    // 保存编辑的文件
+    $('#btn-submit-edit-file').on('click', function() {
+        saveEditedFile();
+    });
+
+    // 生成分享链接
+    $('#btn-submit-share').on('click', function() {
+        createShare();
+    });
+
     // 创建软链接表单提交
     $('#btn-submit-create-symlink').on('click', function() {
         createSymlink();
@@ -437,6 +453,7 @@ function loadFileList(path) {
                 try {
                     fileList = response.files;
                     renderFileList(fileList);
+                    renderReadme(response.readme);
                     // 更新当前路径
                     currentPath = response.path || path;
                     console.log('更新当前路径:', currentPath);
@@ -518,6 +535,7 @@ function renderFileList(files) {
         // 确定图标
         let iconClass = 'fa-file-o';
         let iconColor = 'text-muted';
+        let thumbUrl = '';
         
         if (file.isDir) {
             iconClass = 'fa-folder';
@@ -540,7 +558,9 @@ function renderFileList(files) {
                 case 'jpg':
                 case 'jpeg':
                 case 'png':
-                case 'gif': iconClass = 'fa-file-image-o'; iconColor = 'text-purple'; break;
+                case 'gif':
+                case 'webp':
+                case 'bmp': iconClass = 'fa-file-image-o'; iconColor = 'text-purple'; thumbUrl = thumbnailUrl(file.path); break;
                 case 'zip':
                 case 'rar':
                 case 'tar':
@@ -575,7 +595,8 @@ function renderFileList(files) {
         // 构建卡片内容
         cardInner.append(`
             <div class="card-body">
-                <div class="file-icon ${iconColor}">
+                ${thumbUrl ? `<div class="file-thumb"><img src="${thumbUrl}" alt="" loading="lazy"></div>` : ''}
+                <div class="file-icon ${iconColor}"${thumbUrl ? ' style="display:none"' : ''}>
                     <i class="fa ${iconClass}"></i>
                 </div>
                 <div class="file-name" title="${file.name || ''}">${file.name || '未知文件'}</div>
@@ -589,6 +610,12 @@ function renderFileList(files) {
             </div>
         `);
 
+        // 缩略图加载失败时回退为图标
+        cardInner.find('.file-thumb img').on('error', function() {
+            $(this).parent().remove();
+            cardInner.find('.file-icon').show();
+        });
+
         // 添加点击事件
         if (file.isDir || file.isSymlink) {
             cardInner.css('cursor', 'pointer');
@@ -966,10 +993,32 @@ function showContextMenu(e, file) {
         `);
     }
     
+    if (file.isDir) {
+        menu.append(`
+            <a class="dropdown-item" href="#" data-action="request-files">
+                <i class="fa fa-inbox mr-2"></i>收集文件
+            </a>
+        `);
+    }
+    
+    if (!file.isDir && isEditableFile(file)) {
+        menu.append(`
+            <a class="dropdown-item" href="#" data-action="edit">
+                <i class="fa fa-edit mr-2"></i>编辑
+            </a>
+        `);
+    }
+    
     menu.append(`
+        <a class="dropdown-item" href="#" data-action="share">
+            <i class="fa fa-share-alt mr-2"></i>分享
+        </a>
         <a class="dropdown-item" href="#" data-action="rename">
             <i class="fa fa-pencil mr-2"></i>重命名
         </a>
+        <a class="dropdown-item" href="#" data-action="move">
+            <i class="fa fa-arrows mr-2"></i>移动
+        </a>
         <a class="dropdown-item text-danger" href="#" data-action="delete">
             <i class="fa fa-trash mr-2"></i>删除
         </a>
@@ -987,9 +1036,21 @@ function showContextMenu(e, file) {
             case 'open':
                 loadFileList(file.path);
                 break;
+            case 'edit':
+                editFile(file);
+                break;
+            case 'share':
+                shareFile(file);
+                break;
+            case 'request-files':
+                requestFiles(file);
+                break;
             case 'rename':
                 renameFile(file);
                 break;
+            case 'move':
+                moveFile(file);
+                break;
             case 'delete':
                 deleteFile(file);
                 break;
@@ -1067,47 +1128,239 @@ function renameFile(file) {
     }
 }
 
+// 移动文件到其他目录
+function moveFile(file) {
+    let destination = prompt('请输入目标目录（相对根目录，留空为根目录）:', currentPath || '');
+    if (destination === null) {
+        return;
+    }
+    
+    $.ajax({
+        url: apiBasePath + 'api/file/move',
+        type: 'POST',
+        data: {
+            path: file.path,
+            destination: destination.trim()
+        },
+        dataType: 'json',
+        success: function() {
+            showToast('移动成功', 'success');
+            loadFileList(currentPath);
+            loadDirectoryTree();
+        },
+        error: function(xhr, status, error) {
+            let errorMsg = '移动失败';
+            if (xhr.responseJSON && xhr.responseJSON.error) {
+                errorMsg += ': ' + xhr.responseJSON.error;
+            } else {
+                errorMsg += ': ' + error;
+            }
+            showToast(errorMsg, 'error');
+        }
+    });
+}
+
 // 删除文件
 function deleteFile(file) {
     if (confirm(`确定要删除 ${file.name || '未知文件'} 吗？`)) {
-        let apiUrl = apiBasePath + `api/file/delete/${file.path}`;
-        console.log('删除文件API URL:', apiUrl);
-        
-        // 确保API基础路径正确
-        if (!apiUrl.startsWith('http')) {
-            if (!apiUrl.startsWith('/')) {
-                apiUrl = '/' + apiUrl;
-            }
+        sendDeleteRequest(file, '');
+    }
+}
+
+// 发送删除请求，大目录需要携带确认令牌
+function sendDeleteRequest(file, token) {
+    let apiUrl = apiBasePath + `api/file/delete/${file.path}`;
+    if (token) {
+        apiUrl += `?token=${encodeURIComponent(token)}`;
+    }
+    console.log('删除文件API URL:', apiUrl);
+    
+    // 确保API基础路径正确
+    if (!apiUrl.startsWith('http')) {
+        if (!apiUrl.startsWith('/')) {
+            apiUrl = '/' + apiUrl;
         }
-        
-        console.log('最终API URL:', apiUrl);
-        
-        $.ajax({
-            url: apiUrl,
-            type: 'DELETE',
-            dataType: 'json',
-            success: function(response) {
-                showToast('删除成功', 'success');
-                // 重新加载文件列表
-                loadFileList(currentPath);
-                // 重新加载目录树
-                loadDirectoryTree();
-            },
-            error: function(xhr, status, error) {
-                console.error('删除文件失败:', error, xhr.responseText);
-                console.error('HTTP状态码:', xhr.status);
-                let errorMsg = '删除失败';
-                if (xhr.responseJSON && xhr.responseJSON.error) {
-                    errorMsg += ': ' + xhr.responseJSON.error;
-                } else if (xhr.responseText) {
-                    errorMsg += ': ' + xhr.responseText;
-                } else {
-                    errorMsg += ': ' + error;
+    }
+    
+    console.log('最终API URL:', apiUrl);
+    
+    $.ajax({
+        url: apiUrl,
+        type: 'DELETE',
+        dataType: 'json',
+        success: function(response) {
+            showToast('删除成功', 'success');
+            // 重新加载文件列表
+            loadFileList(currentPath);
+            // 重新加载目录树
+            loadDirectoryTree();
+        },
+        error: function(xhr, status, error) {
+            if (xhr.status === 428 && xhr.responseJSON && xhr.responseJSON.preview) {
+                const preview = xhr.responseJSON.preview;
+                if (confirm(`${file.name} 包含 ${preview.items} 个项目（${formatFileSize(preview.bytes)}），确定要全部删除吗？`)) {
+                    sendDeleteRequest(file, preview.token);
                 }
-                showToast(errorMsg, 'error');
+                return;
             }
-        });
+            console.error('删除文件失败:', error, xhr.responseText);
+            console.error('HTTP状态码:', xhr.status);
+            let errorMsg = '删除失败';
+            if (xhr.responseJSON && xhr.responseJSON.error) {
+                errorMsg += ': ' + xhr.responseJSON.error;
+            } else if (xhr.responseText) {
+                errorMsg += ': ' + xhr.responseText;
+            } else {
+                errorMsg += ': ' + error;
+            }
+            showToast(errorMsg, 'error');
+        }
+    });
+}
+
+// 可在线编辑的文本文件
+function isEditableFile(file) {
+    let ext = (file.name || '').split('.').pop().toLowerCase();
+    return ['txt', 'md', 'log', 'conf', 'cfg', 'ini', 'json', 'yaml', 'yml', 'toml', 'xml', 'sh', 'py', 'js', 'css', 'html', 'go', 'env'].includes(ext) && file.size <= 1024 * 1024;
+}
+
+// 打开编辑器，记录加载时的 ETag 用于保存时检测并发修改
+function editFile(file) {
+    let encoded = (file.path || '').split('/').map(encodeURIComponent).join('/');
+    $.ajax({
+        url: apiBasePath + `api/file/preview/${encoded}?kb=1024`,
+        type: 'GET',
+        dataType: 'json',
+        success: function(response) {
+            if (!response.etag || response.truncated) {
+                showToast('文件过大，无法在线编辑', 'error');
+                return;
+            }
+            editingFile = { path: file.path, etag: response.etag, encoding: response.encoding };
+            $('#edit-file-name').text(file.path);
+            $('#edit-file-content').val(response.content);
+            editFileModal.show();
+        },
+        error: function(xhr) {
+            showToast('加载文件失败: ' + ((xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText), 'error');
+        }
+    });
+}
+
+function saveEditedFile() {
+    if (!editingFile) {
+        return;
+    }
+    let encoded = editingFile.path.split('/').map(encodeURIComponent).join('/');
+    $.ajax({
+        url: apiBasePath + `api/file/save/${encoded}`,
+        type: 'PUT',
+        contentType: 'application/json',
+        dataType: 'json',
+        headers: { 'If-Match': editingFile.etag },
+        data: JSON.stringify({ content: $('#edit-file-content').val(), encoding: editingFile.encoding }),
+        success: function(response) {
+            editingFile.etag = response.data.etag;
+            showToast('保存成功', 'success');
+            editFileModal.hide();
+            loadFileList(currentPath);
+        },
+        error: function(xhr) {
+            if (xhr.status === 412) {
+                showToast('文件已被其他人修改，请关闭后重新打开再编辑', 'error');
+                return;
+            }
+            showToast('保存失败: ' + ((xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText), 'error');
+        }
+    });
+}
+
+function shareFile(file) {
+    sharingFile = file;
+    $('#share-name').text(file.path);
+    $('#share-password').val('');
+    $('#share-max-downloads').val(0);
+    $('#share-result').hide();
+    shareModal.show();
+}
+
+function createShare() {
+    if (!sharingFile) {
+        return;
+    }
+    $.ajax({
+        url: apiBasePath + 'api/share/create',
+        type: 'POST',
+        dataType: 'json',
+        data: {
+            path: sharingFile.path,
+            password: $('#share-password').val(),
+            expiresIn: $('#share-expires').val(),
+            maxDownloads: $('#share-max-downloads').val() || 0
+        },
+        success: function(response) {
+            $('#share-url').val(response.data.url);
+            $('#share-qr').attr('src', apiBasePath + `api/share/qr/${response.data.id}.png?size=200`);
+            $('#share-result').show();
+            $('#share-url').trigger('select');
+            showToast('分享链接已创建', 'success');
+        },
+        error: function(xhr) {
+            showToast('创建分享失败: ' + ((xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText), 'error');
+        }
+    });
+}
+
+// 生成文件收集链接，外部用户只能上传，看不到目录内容
+function requestFiles(file) {
+    let password = prompt(`为 ${file.path} 创建文件收集链接（7 天有效）\n访问密码（可留空）：`, '');
+    if (password === null) {
+        return;
+    }
+    $.ajax({
+        url: apiBasePath + 'api/drop/create',
+        type: 'POST',
+        dataType: 'json',
+        data: { path: file.path, password: password, expiresIn: '7d' },
+        success: function(response) {
+            prompt('文件收集链接已创建，请复制：', response.data.url);
+        },
+        error: function(xhr) {
+            showToast('创建文件收集链接失败: ' + ((xhr.responseJSON && xhr.responseJSON.error) || xhr.statusText), 'error');
+        }
+    });
+}
+
+// 在文件列表下方显示目录中的 README（服务端已做过安全过滤）
+function renderReadme(readme) {
+    if (!readme || !readme.html) {
+        return;
+    }
+    let box = $('<div class="readme-box"></div>');
+    box.append($('<div class="readme-title"></div>').text(readme.name));
+    box.append($('<div class="readme-body"></div>').html(readme.html));
+    box.on('click', 'a', function(e) {
+        let href = $(this).attr('href') || '';
+        let marker = 'api/directory/list/';
+        let idx = href.indexOf(marker);
+        if (idx >= 0) {
+            e.preventDefault();
+            loadFileList(decodeURIComponent(href.substring(idx + marker.length)));
+        } else if (!href.startsWith('#')) {
+            $(this).attr('target', '_blank');
+        }
+    });
+    $('#file-list').append(box);
+}
+
+// 生成缩略图地址
+function thumbnailUrl(path) {
+    let encoded = (path || '').split('/').map(encodeURIComponent).join('/');
+    let url = apiBasePath + `api/thumbnail/${encoded}?size=256`;
+    if (!url.startsWith('http') && !url.startsWith('/')) {
+        url = '/' + url;
     }
+    return url;
 }
 
 // 格式化文件大小
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	statsRetentionDays = 90
+	statsMaxClients    = 10000
+	statsFlushTick     = 30 * time.Second
+	statsDefaultTop    = 20
+	statsMaxTop        = 500
+)
+
+type statsDay struct {
+	Downloads  int             `json:"downloads"`
+	RangeViews int             `json:"rangeViews"`
+	Clients    map[string]bool `json:"clients"`
+}
+
+type fileStatsRecord struct {
+	Downloads  int                  `json:"downloads"`
+	RangeViews int                  `json:"rangeViews"`
+	Clients    map[string]int64     `json:"clients"`
+	LastAccess int64                `json:"lastAccess"`
+	Days       map[string]*statsDay `json:"days"`
+}
+
+// FileStats is the summary attached to listings and reports.
+type FileStats struct {
+	Downloads     int   `json:"downloads"`
+	RangeViews    int   `json:"rangeViews"`
+	UniqueClients int   `json:"uniqueClients"`
+	LastAccess    int64 `json:"lastAccess,omitempty"`
+}
+
+var (
+	fileStatsMu    sync.Mutex
+	fileStats      = map[string]*fileStatsRecord{}
+	fileStatsDirty bool
+)
+
+func fileStatsFile() string {
+	return filepath.Join(appRootDir, "download_stats.json")
+}
+
+func loadFileStats() {
+	data, err := os.ReadFile(fileStatsFile())
+	if err != nil {
+		return
+	}
+	fileStatsMu.Lock()
+	defer fileStatsMu.Unlock()
+	if err := json.Unmarshal(data, &fileStats); err != nil {
+		log.Printf("读取下载统计失败: %v", err)
+	}
+}
+
+// flushFileStats writes the counters if they changed and drops daily buckets
+// older than statsRetentionDays.
+func flushFileStats() {
+	fileStatsMu.Lock()
+	defer fileStatsMu.Unlock()
+	if !fileStatsDirty {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -statsRetentionDays).Format("2006-01-02")
+	for _, rec := range fileStats {
+		for day := range rec.Days {
+			if day < cutoff {
+				delete(rec.Days, day)
+			}
+		}
+	}
+	data, err := json.Marshal(fileStats)
+	if err != nil {
+		log.Printf("保存下载统计失败: %v", err)
+		return
+	}
+	tmp := fileStatsFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("保存下载统计失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, fileStatsFile()); err != nil {
+		log.Printf("保存下载统计失败: %v", err)
+		return
+	}
+	fileStatsDirty = false
+}
+
+func startFileStatsFlusher() {
+	loadFileStats()
+	go func() {
+		for {
+			time.Sleep(statsFlushTick)
+			flushFileStats()
+		}
+	}()
+}
+
+// statsClientID identifies a client by address and user agent without
+// storing either.
+func statsClientID(r *http.Request) string {
+	sum := sha256.Sum256([]byte(clientAddr(r) + "\x00" + r.UserAgent()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// statsKey returns the key of absPath in fileStats.
+func statsKey(absPath string) (string, bool) {
+	relPath, err := filepath.Rel(rootDir, absPath)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(relPath), true
+}
+
+// renameFileStats carries the counters of each old path, and of everything
+// below it, over to the new path. All moves are applied at once, so chained
+// renames (a->b, b->c) keep each file's own counters.
+func renameFileStats(moves map[string]string) {
+	fileStatsMu.Lock()
+	defer fileStatsMu.Unlock()
+	moved := map[string]*fileStatsRecord{}
+	for oldAbs, newAbs := range moves {
+		oldKey, ok1 := statsKey(oldAbs)
+		newKey, ok2 := statsKey(newAbs)
+		if !ok1 || !ok2 {
+			continue
+		}
+		for key, rec := range fileStats {
+			if key == oldKey || strings.HasPrefix(key, oldKey+"/") {
+				moved[newKey+key[len(oldKey):]] = rec
+				delete(fileStats, key)
+			}
+		}
+	}
+	for key, rec := range moved {
+		fileStats[key] = rec
+	}
+	if len(moved) > 0 {
+		fileStatsDirty = true
+	}
+}
+
+// dropFileStats forgets the counters of absPath and everything below it.
+func dropFileStats(absPath string) {
+	key, ok := statsKey(absPath)
+	if !ok {
+		return
+	}
+	fileStatsMu.Lock()
+	defer fileStatsMu.Unlock()
+	for k := range fileStats {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(fileStats, k)
+			fileStatsDirty = true
+		}
+	}
+}
+
+// recordFileAccess counts one fetch of absPath. Requests that countsAsDownload
+// count as downloads, other ranges as partial views; HEAD is ignored.
+func recordFileAccess(r *http.Request, absPath string, size int64) {
+	if r.Method == http.MethodHead {
+		return
+	}
+	relPath, ok := statsKey(absPath)
+	if !ok {
+		return
+	}
+	isDownload := countsAsDownload(r, size)
+	client := statsClientID(r)
+	now := time.Now()
+	day := now.Format("2006-01-02")
+
+	fileStatsMu.Lock()
+	defer fileStatsMu.Unlock()
+	rec, ok := fileStats[relPath]
+	if !ok {
+		rec = &fileStatsRecord{Clients: map[string]int64{}, Days: map[string]*statsDay{}}
+		fileStats[relPath] = rec
+	}
+	d, ok := rec.Days[day]
+	if !ok {
+		d = &statsDay{Clients: map[string]bool{}}
+		rec.Days[day] = d
+	}
+	if isDownload {
+		rec.Downloads++
+		d.Downloads++
+	} else {
+		rec.RangeViews++
+		d.RangeViews++
+	}
+	if _, seen := rec.Clients[client]; seen || len(rec.Clients) < statsMaxClients {
+		rec.Clients[client] = now.Unix()
+	}
+	if len(d.Clients) < statsMaxClients {
+		d.Clients[client] = true
+	}
+	rec.LastAccess = now.Unix()
+	fileStatsDirty = true
+}
+
+// summarizeStats aggregates rec over the days since from ("" for all time).
+// Must be called with fileStatsMu held.
+func summarizeStats(rec *fileStatsRecord, from string) FileStats {
+	if from == "" {
+		return FileStats{Downloads: rec.Downloads, RangeViews: rec.RangeViews, UniqueClients: len(rec.Clients), LastAccess: rec.LastAccess}
+	}
+	s := FileStats{LastAccess: rec.LastAccess}
+	clients := map[string]bool{}
+	for day, d := range rec.Days {
+		if day < from {
+			continue
+		}
+		s.Downloads += d.Downloads
+		s.RangeViews += d.RangeViews
+		for c := range d.Clients {
+			clients[c] = true
+		}
+	}
+	s.UniqueClients = len(clients)
+	return s
+}
+
+func attachFileStats(dir string, files []FileInfo) {
+	absDir, err := ensurePathInRoot(dir)
+	if err != nil {
+		return
+	}
+	relDir, _ := filepath.Rel(rootDir, absDir)
+	fileStatsMu.Lock()
+	defer fileStatsMu.Unlock()
+	for i := range files {
+		if files[i].IsDir {
+			continue
+		}
+		relPath := filepath.ToSlash(filepath.Join(relDir, files[i].Name))
+		if rec, ok := fileStats[relPath]; ok {
+			s := summarizeStats(rec, "")
+			files[i].Stats = &s
+		}
+	}
+}
+
+// parseStatsWindow turns Nd (the last N days, 1d being today) or all into
+// the first day to include. Counters are kept per day, so finer windows are
+// not available.
+func parseStatsWindow(v string) (string, bool) {
+	if v == "" || v == "all" {
+		return "", true
+	}
+	days, ok := strings.CutSuffix(v, "d")
+	n, err := strconv.Atoi(days)
+	if !ok || err != nil || n <= 0 || n > statsRetentionDays {
+		return "", false
+	}
+	return time.Now().AddDate(0, 0, -(n - 1)).Format("2006-01-02"), true
+}
+
+// handleStatsTop reports the most fetched files:
+// stats/top?window=7d&sort=downloads|rangeViews|uniqueClients&limit=&path=
+func handleStatsTop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	window := query.Get("window")
+	from, ok := parseStatsWindow(window)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "参数 window 应为 Nd（1≤N≤"+strconv.Itoa(statsRetentionDays)+"）或 all")
+		return
+	}
+	if window == "" {
+		window = "all"
+	}
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "downloads"
+	}
+	if sortBy != "downloads" && sortBy != "rangeViews" && sortBy != "uniqueClients" {
+		writeError(w, http.StatusBadRequest, "sort 只能是 downloads、rangeViews 或 uniqueClients")
+		return
+	}
+	limit := statsDefaultTop
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "参数 limit 无效")
+			return
+		}
+		limit = min(n, statsMaxTop)
+	}
+	prefix := strings.Trim(query.Get("path"), "/")
+
+	type entry struct {
+		Path string `json:"path"`
+		FileStats
+		Exists bool `json:"exists"`
+	}
+	var entries []entry
+	fileStatsMu.Lock()
+	for p, rec := range fileStats {
+		if prefix != "" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			continue
+		}
+		s := summarizeStats(rec, from)
+		if s.Downloads == 0 && s.RangeViews == 0 {
+			continue
+		}
+		entries = append(entries, entry{Path: p, FileStats: s})
+	}
+	fileStatsMu.Unlock()
+
+	key := func(e entry) int {
+		switch sortBy {
+		case "rangeViews":
+			return e.RangeViews
+		case "uniqueClients":
+			return e.UniqueClients
+		}
+		return e.Downloads
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if key(entries[i]) != key(entries[j]) {
+			return key(entries[i]) > key(entries[j])
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for i := range entries {
+		if absPath, err := ensurePathInRoot(entries[i].Path); err == nil {
+			_, err := os.Stat(absPath)
+			entries[i].Exists = err == nil
+		}
+	}
+	if entries == nil {
+		entries = []entry{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"window": window,
+		"sort":   sortBy,
+		"files":  entries,
+	})
+}
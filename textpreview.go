@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+var (
+	previewDefaultKB  = 64
+	previewMaxBytes   = int64(1024 * 1024)
+	previewHighlightB = 256 * 1024
+	previewStyle      = "github"
+)
+
+// TextPreview.Encoding is UTF-8, UTF-8-BOM, UTF-16LE, UTF-16BE, GBK or
+// GB18030. A BOM is reported separately from plain UTF-8 so that the editor
+// can pass the value back to file/save and keep the BOM.
+type TextPreview struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	Encoding  string `json:"encoding"`
+	Truncated bool   `json:"truncated"`
+	ETag      string `json:"etag,omitempty"`
+	Content   string `json:"content"`
+	Language  string `json:"language,omitempty"`
+	HTML      string `json:"html,omitempty"`
+}
+
+// detectTextEncoding guesses the encoding of a text sample. Without a BOM,
+// valid UTF-8 wins; otherwise the sample is assumed to be GBK, or GB18030
+// when GBK cannot represent it.
+func detectTextEncoding(data []byte) (string, encoding.Encoding, int) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return "UTF-8-BOM", nil, 3
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return "UTF-16LE", unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), 2
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return "UTF-16BE", unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), 2
+	}
+	if utf8.Valid(trimPartialRune(data)) {
+		return "UTF-8", nil, 0
+	}
+	if decoded, err := simplifiedchinese.GBK.NewDecoder().Bytes(data); err == nil && !bytes.ContainsRune(decoded, utf8.RuneError) {
+		return "GBK", simplifiedchinese.GBK, 0
+	}
+	return "GB18030", simplifiedchinese.GB18030, 0
+}
+
+// trimPartialRune drops an incomplete UTF-8 sequence cut off at the end of a
+// byte range.
+func trimPartialRune(data []byte) []byte {
+	for i := 1; i <= 3 && i <= len(data); i++ {
+		c := data[len(data)-i]
+		if c < 0x80 {
+			return data
+		}
+		if c >= 0xC0 {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return data[:len(data)-i]
+			}
+			return data
+		}
+	}
+	return data
+}
+
+// gbCharLen returns the length of the GBK/GB18030 character starting at
+// data[0]: ASCII is one byte, a lead byte followed by a digit starts a
+// four-byte GB18030 sequence, anything else is a two-byte pair.
+func gbCharLen(data []byte) int {
+	if data[0] < 0x80 || data[0] == 0xFF {
+		return 1
+	}
+	if len(data) > 1 && data[1] >= 0x30 && data[1] <= 0x39 {
+		return 4
+	}
+	return 2
+}
+
+// isGBSyncByte reports whether c can only be a single-byte character in
+// GBK/GB18030: it is below every trail byte and is not a GB18030 digit.
+func isGBSyncByte(c byte) bool {
+	return c < 0x30 || (c > 0x39 && c < 0x40)
+}
+
+// alignGBOffset moves offset forward to the next character boundary of a
+// GBK/GB18030 file. Trail bytes overlap the lead and ASCII ranges, so it
+// walks forward from the nearest preceding byte that is a character on its
+// own, such as a newline, or from the start of the file; without either
+// nearby the offset is kept.
+func alignGBOffset(f io.ReaderAt, offset int64) int64 {
+	start := max(0, offset-4096)
+	buf := make([]byte, offset-start+4)
+	n, _ := f.ReadAt(buf, start)
+	buf = buf[:n]
+	back := int(offset - start)
+	if back > len(buf) {
+		return offset
+	}
+	sync := -1
+	for i := back - 1; i >= 0; i-- {
+		if isGBSyncByte(buf[i]) {
+			sync = i
+			break
+		}
+	}
+	if sync < 0 && start == 0 {
+		sync = 0
+	}
+	if sync < 0 {
+		return offset
+	}
+	i := sync
+	for i < back && i < len(buf) {
+		i += gbCharLen(buf[i:])
+	}
+	return start + int64(i)
+}
+
+// trimPartialGB drops a GBK/GB18030 character cut off at the end of data,
+// which must start on a character boundary.
+func trimPartialGB(data []byte) []byte {
+	i := 0
+	for i < len(data) {
+		n := gbCharLen(data[i:])
+		if i+n > len(data) {
+			return data[:i]
+		}
+		i += n
+	}
+	return data
+}
+
+func looksBinary(data []byte, enc string) bool {
+	if strings.HasPrefix(enc, "UTF-16") {
+		return false
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	control := 0
+	for _, c := range data {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' && c != 0x1b {
+			control++
+		}
+	}
+	return control*10 > len(data)
+}
+
+func highlightCode(name, lang, content string) (string, string, error) {
+	var lexer chroma.Lexer
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	}
+	if lexer == nil {
+		lexer = lexers.Match(name)
+	}
+	if lexer == nil {
+		return "", "", nil
+	}
+	lexer = chroma.Coalesce(lexer)
+	iterator, err := lexer.Tokenise(nil, content)
+	if err != nil {
+		return "", "", err
+	}
+	style := styles.Get(previewStyle)
+	formatter := chromahtml.New(chromahtml.WithLineNumbers(true), chromahtml.Standalone(false), chromahtml.WithClasses(false))
+	var buf bytes.Buffer
+	if err := formatter.Format(&buf, style, iterator); err != nil {
+		return "", "", err
+	}
+	return buf.String(), lexer.Config().Name, nil
+}
+
+func handleTextPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "file/preview/")
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "文件不存在")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		writeError(w, http.StatusBadRequest, "只能预览文件")
+		return
+	}
+
+	query := r.URL.Query()
+	offset, length := int64(0), int64(previewDefaultKB)*1024
+	if v := query.Get("kb"); v != "" {
+		kb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || kb <= 0 {
+			writeError(w, http.StatusBadRequest, "参数 kb 无效")
+			return
+		}
+		length = kb * 1024
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "参数 offset 无效")
+			return
+		}
+	}
+	if v := query.Get("length"); v != "" {
+		length, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || length <= 0 {
+			writeError(w, http.StatusBadRequest, "参数 length 无效")
+			return
+		}
+	}
+	length = min(length, previewMaxBytes)
+	if offset > info.Size() {
+		writeError(w, http.StatusRequestedRangeNotSatisfiable, "offset 超出文件大小")
+		return
+	}
+
+	// Sniff the encoding from the start of the file so a range in the middle
+	// of a UTF-16 or GBK file is decoded consistently.
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	encName, enc, bomLen := detectTextEncoding(head)
+	if looksBinary(head, encName) {
+		writeError(w, http.StatusUnsupportedMediaType, "不是文本文件，无法预览")
+		return
+	}
+	if offset < int64(bomLen) {
+		offset = int64(bomLen)
+	}
+	if strings.HasPrefix(encName, "UTF-16") && offset%2 == 1 {
+		offset++
+	}
+	if strings.HasPrefix(encName, "GB") && offset > 0 {
+		offset = min(alignGBOffset(f, offset), info.Size())
+	}
+
+	data := make([]byte, length)
+	n, err = f.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("读取文件失败: %v", err))
+		return
+	}
+	data = data[:n]
+	if strings.HasPrefix(encName, "UTF-16") {
+		data = data[:len(data)&^1]
+	}
+	if offset > int64(bomLen) && enc == nil {
+		for len(data) > 0 && !utf8.RuneStart(data[0]) {
+			data = data[1:]
+			offset++
+		}
+	}
+	if enc == nil {
+		data = trimPartialRune(data)
+	}
+	if strings.HasPrefix(encName, "GB") {
+		data = trimPartialGB(data)
+	}
+
+	content := string(data)
+	if enc != nil {
+		decoded, err := enc.NewDecoder().Bytes(data)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("编码转换失败: %v", err))
+			return
+		}
+		content = string(decoded)
+	}
+	content = strings.ToValidUTF8(content, "�")
+
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	preview := TextPreview{
+		Path:      filepath.ToSlash(relPath),
+		Size:      info.Size(),
+		Offset:    offset,
+		Length:    int64(len(data)),
+		Encoding:  encName,
+		Truncated: offset+int64(len(data)) < info.Size(),
+		Content:   content,
+	}
+	if info.Size() <= editMaxSize {
+		if etag, err := fileContentETag(absPath); err == nil {
+			preview.ETag = etag
+			w.Header().Set("ETag", etag)
+		}
+	}
+	if query.Get("highlight") == "true" && len(content) <= previewHighlightB {
+		html, lang, err := highlightCode(info.Name(), query.Get("lang"), content)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("语法高亮失败: %v", err))
+			return
+		}
+		preview.HTML = html
+		preview.Language = lang
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
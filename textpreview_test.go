@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func gbk(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func gb18030(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := simplifiedchinese.GB18030.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDetectTextEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+		skip int
+	}{
+		{"empty", nil, "UTF-8", 0},
+		{"ASCII", []byte("hello\nworld\n"), "UTF-8", 0},
+		{"UTF-8 Chinese", []byte("你好，世界"), "UTF-8", 0},
+		{"UTF-8 cut inside a rune", []byte("你好")[:5], "UTF-8", 0},
+		{"UTF-8 BOM", []byte("\xEF\xBB\xBFhello"), "UTF-8-BOM", 3},
+		{"UTF-16LE BOM", []byte("\xFF\xFEh\x00i\x00"), "UTF-16LE", 2},
+		{"UTF-16BE BOM", []byte("\xFE\xFF\x00h\x00i"), "UTF-16BE", 2},
+		{"GBK", gbk(t, "中文文本，用于测试编码识别"), "GBK", 0},
+		{"GBK with ASCII", gbk(t, "name=测试\nvalue=数据\n"), "GBK", 0},
+		{"GB18030 four-byte", gb18030(t, "表情😀符号"), "GB18030", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, enc, skip := detectTextEncoding(tt.data)
+			if got != tt.want || skip != tt.skip {
+				t.Fatalf("detectTextEncoding = %s, %d; want %s, %d", got, skip, tt.want, tt.skip)
+			}
+			if (enc == nil) != (got == "UTF-8" || got == "UTF-8-BOM") {
+				t.Errorf("%s returned decoder %v", got, enc)
+			}
+		})
+	}
+}
+
+func TestTrimPartialRune(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"ASCII", []byte("abc"), []byte("abc")},
+		{"complete rune", []byte("a中"), []byte("a中")},
+		{"two of three bytes", []byte("a中")[:3], []byte("a")},
+		{"lead byte only", []byte("a中")[:2], []byte("a")},
+		{"three of four bytes", []byte("😀")[:3], []byte{}},
+		{"stray continuation bytes", []byte("\x80\x80\x80\x80"), []byte("\x80\x80\x80\x80")},
+		{"empty", []byte{}, []byte{}},
+	}
+	for _, tt := range tests {
+		if got := trimPartialRune(tt.data); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: trimPartialRune(%q) = %q, want %q", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestGBCharLen(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want int
+	}{
+		{[]byte("a中"), 1},
+		{[]byte{0xFF, 0x41}, 1},
+		{[]byte{0xD6, 0xD0}, 2},
+		{[]byte{0x81, 0x40}, 2},
+		{[]byte{0x81, 0x30, 0x81, 0x30}, 4},
+		{[]byte{0xD6}, 2},
+	}
+	for _, tt := range tests {
+		if got := gbCharLen(tt.data); got != tt.want {
+			t.Errorf("gbCharLen(% x) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestAlignGBOffset(t *testing.T) {
+	text := gbk(t, "ab中文\n中文")              // 61 62 D6D0 CEC4 0A D6D0 CEC4
+	trail := gbk(t, "\n丂A")                 // 0A 8140 41: the trail byte is '@'
+	four := gb18030(t, "\n😀x")              // 0A 9439FC38 78
+	long := bytes.Repeat(gbk(t, "中"), 3000) // no single-byte character at all
+	tests := []struct {
+		name   string
+		data   []byte
+		offset int64
+		want   int64
+	}{
+		{"start of file", text, 0, 0},
+		{"on a boundary", text, 4, 4},
+		{"inside a pair, walked from file start", text, 3, 4},
+		{"inside second pair", text, 5, 6},
+		{"inside a pair after newline", text, 8, 9},
+		{"end of file", text, int64(len(text)), int64(len(text))},
+		{"trail byte looks like ASCII", trail, 2, 3},
+		{"inside a four-byte sequence", four, 3, 5},
+		{"no sync byte in reach", long, 5001, 5001},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := alignGBOffset(bytes.NewReader(tt.data), tt.offset); got != tt.want {
+				t.Errorf("alignGBOffset(%d) = %d, want %d", tt.offset, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimPartialGB(t *testing.T) {
+	text := gbk(t, "a中文")
+	four := gb18030(t, "a😀")
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"complete", text, text},
+		{"lead byte cut", text[:4], text[:3]},
+		{"four-byte sequence cut", four[:3], four[:1]},
+		{"complete four-byte", four, four},
+		{"ASCII", []byte("abc"), []byte("abc")},
+	}
+	for _, tt := range tests {
+		if got := trimPartialGB(tt.data); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: trimPartialGB(% x) = % x, want % x", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestLooksBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		enc  string
+		want bool
+	}{
+		{"plain text", []byte("line one\r\n\tline two\f"), "UTF-8", false},
+		{"ANSI colours", []byte("\x1b[31mred\x1b[0m"), "UTF-8", false},
+		{"NUL byte", []byte("abc\x00def"), "UTF-8", true},
+		{"UTF-16 zeros", []byte("h\x00i\x00"), "UTF-16LE", false},
+		{"one control byte in ten", []byte("\x01abcdefghi"), "GBK", false},
+		{"many control bytes", []byte("\x01\x02\x03abcdefg"), "UTF-8", true},
+		{"PNG header", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "GB18030", true},
+	}
+	for _, tt := range tests {
+		if got := looksBinary(tt.data, tt.enc); got != tt.want {
+			t.Errorf("%s: looksBinary = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	thumbSizes   = []int{128, 256, 512}
+	thumbWorkers = 2
+	// thumbMaxDecodeBytes bounds the decoded bitmap of one image; peak memory
+	// is roughly thumbWorkers times this. It fits a 50 MP phone photo; larger
+	// JPEGs get their embedded EXIF preview as a thumbnail.
+	thumbMaxDecodeBytes = int64(160 * 1024 * 1024)
+	thumbQuality        = 80
+	thumbCacheMaxSize   = int64(256 * 1024 * 1024)
+)
+
+var (
+	thumbSlot     = make(chan struct{}, thumbWorkers)
+	thumbFlightMu sync.Mutex
+	thumbFlight   = map[string]*thumbCall{}
+	thumbCache    = &diskCache{name: "thumbs", maxSize: thumbCacheMaxSize}
+)
+
+type thumbCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+func isImageFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp":
+		return true
+	}
+	return false
+}
+
+func thumbCacheDir() string {
+	return thumbCache.dir()
+}
+
+// diskCache keeps the total size of a cache directory under appRootDir below
+// maxSize, evicting the least recently used files. Hits refresh the file's
+// mtime, which serves as the LRU timestamp.
+type diskCache struct {
+	name    string
+	maxSize int64
+	mu      sync.Mutex
+	total   int64
+	loaded  bool
+}
+
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c *diskCache) dir() string {
+	return filepath.Join(appRootDir, c.name)
+}
+
+func (c *diskCache) scan() []cachedFile {
+	var files []cachedFile
+	_ = filepath.Walk(c.dir(), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		files = append(files, cachedFile{path: p, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return files
+}
+
+func (c *diskCache) touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// add accounts for a newly written file and evicts old entries once the
+// cache grows past maxSize.
+func (c *diskCache) add(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loaded {
+		c.total = 0
+		for _, f := range c.scan() {
+			c.total += f.size
+		}
+		c.loaded = true
+	} else {
+		c.total += size
+	}
+	if c.total <= c.maxSize {
+		return
+	}
+	files := c.scan()
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if c.total <= c.maxSize*9/10 {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			continue
+		}
+		c.total -= f.size
+	}
+	log.Printf("缓存 %s 已清理，当前大小: %d 字节", c.name, c.total)
+}
+
+func cacheKey(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// decodedBytesPerPixel estimates how much memory the decoder allocates per
+// pixel. JPEG is counted as unsubsampled YCbCr since the config does not say.
+func decodedBytesPerPixel(m color.Model) int64 {
+	switch m {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := m.(color.Palette); ok {
+		return 1
+	}
+	return 4
+}
+
+// decodeImageFile decodes an image after checking the size of the decoded
+// bitmap, so a single huge picture cannot exhaust memory on small boards.
+var errImageTooLarge = errors.New("图片尺寸过大")
+
+func decodeImageFile(absPath string) (image.Image, int, error) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("无法识别图片格式: %v", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height)*decodedBytesPerPixel(cfg.ColorModel) > thumbMaxDecodeBytes {
+		return nil, 0, fmt.Errorf("%w（%dx%d）", errImageTooLarge, cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, 0, err
+	}
+	img, format, err := image.Decode(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("图片解码失败: %v", err)
+	}
+	orientation := 1
+	if format == "jpeg" {
+		if info, err := readEXIF(absPath); err == nil && info.Orientation > 0 {
+			orientation = info.Orientation
+		}
+	}
+	return img, orientation, nil
+}
+
+func fitSize(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+func scaleImage(src image.Image, w, h int, background color.Color) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if background != nil {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	}
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// orientImage applies an EXIF orientation (1-8) to src.
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.SetRGBA(dx, dy, src.RGBAAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+func writeJPEGAtomic(dst string, img image.Image, quality int) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(tmp, img, &jpeg.Options{Quality: quality}); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// decodeEXIFThumbnail decodes the preview embedded in a JPEG's EXIF data. It
+// has the orientation of the full image.
+func decodeEXIFThumbnail(absPath string) (image.Image, int, error) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	tiff, err := findJPEGExif(bufio.NewReader(f))
+	if err != nil {
+		return nil, 0, err
+	}
+	preview := exifThumbnail(tiff)
+	if preview == nil {
+		return nil, 0, fmt.Errorf("没有内嵌缩略图")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(preview))
+	if err != nil {
+		return nil, 0, fmt.Errorf("内嵌缩略图解码失败: %v", err)
+	}
+	orientation := 1
+	if info, err := parseEXIF(tiff); err == nil && info.Orientation > 0 {
+		orientation = info.Orientation
+	}
+	return img, orientation, nil
+}
+
+func generateThumbnail(absPath, dst string, size int) error {
+	img, orientation, err := decodeImageFile(absPath)
+	if errors.Is(err, errImageTooLarge) {
+		if preview, o, perr := decodeEXIFThumbnail(absPath); perr == nil {
+			log.Printf("图片过大，使用内嵌缩略图: %s", absPath)
+			img, orientation, err = preview, o, nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	tw, th := fitSize(w, h, size, size)
+	if orientation >= 5 {
+		tw, th = th, tw
+	}
+	return writeJPEGAtomic(dst, orientImage(scaleImage(img, tw, th, color.White), orientation), thumbQuality)
+}
+
+// runLimited runs fn in the bounded image worker pool, collapsing concurrent
+// requests for the same key into one call. A panic in fn, such as a decoder
+// choking on a crafted file, becomes the call's error so that the slot and
+// the waiters are always released.
+func runLimited(key string, fn func() error) (err error) {
+	thumbFlightMu.Lock()
+	if call, ok := thumbFlight[key]; ok {
+		thumbFlightMu.Unlock()
+		call.wg.Wait()
+		return call.err
+	}
+	call := &thumbCall{}
+	call.wg.Add(1)
+	thumbFlight[key] = call
+	thumbFlightMu.Unlock()
+
+	thumbSlot <- struct{}{}
+	defer func() {
+		<-thumbSlot
+		if p := recover(); p != nil {
+			log.Printf("处理图片时发生异常 %s: %v", key, p)
+			call.err = fmt.Errorf("图片处理失败: %v", p)
+		}
+		thumbFlightMu.Lock()
+		delete(thumbFlight, key)
+		thumbFlightMu.Unlock()
+		call.wg.Done()
+		err = call.err
+	}()
+	call.err = fn()
+	return call.err
+}
+
+func serveCachedImage(w http.ResponseWriter, r *http.Request, cachePath, etag, contentType string) {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法读取缓存: %v", err))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法读取缓存: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "thumbnail/")
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isImageFile(absPath) {
+		writeError(w, http.StatusBadRequest, "不支持的图片格式")
+		return
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || info.IsDir() {
+		writeError(w, http.StatusNotFound, "图片不存在")
+		return
+	}
+
+	size := 256
+	if s := r.URL.Query().Get("size"); s != "" {
+		size, _ = strconv.Atoi(s)
+	}
+	allowed := false
+	for _, s := range thumbSizes {
+		if s == size {
+			allowed = true
+		}
+	}
+	if !allowed {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("不支持的缩略图尺寸，可选: %v", thumbSizes))
+		return
+	}
+
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	key := cacheKey(relPath, strconv.FormatInt(info.ModTime().UnixNano(), 10), strconv.FormatInt(info.Size(), 10), strconv.Itoa(size))
+	cachePath := filepath.Join(thumbCacheDir(), key[:2], key+".jpg")
+	if _, err := os.Stat(cachePath); err == nil {
+		thumbCache.touch(cachePath)
+	} else {
+		start := time.Now()
+		err := runLimited(key, func() error {
+			if _, err := os.Stat(cachePath); err == nil {
+				return nil
+			}
+			if err := generateThumbnail(absPath, cachePath, size); err != nil {
+				return err
+			}
+			if info, err := os.Stat(cachePath); err == nil {
+				thumbCache.add(info.Size())
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("生成缩略图失败 %s: %v", relPath, err)
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		log.Printf("已生成缩略图: %s (%dpx, 耗时 %v)", relPath, size, time.Since(start))
+	}
+	serveCachedImage(w, r, cachePath, key, "image/jpeg")
+}
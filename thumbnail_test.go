@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLimitedRecoversPanics(t *testing.T) {
+	release := make(chan struct{})
+	results := make(chan error, 2)
+	go func() {
+		results <- runLimited("panics", func() error {
+			<-release
+			panic("decoder exploded")
+		})
+	}()
+	for {
+		thumbFlightMu.Lock()
+		_, started := thumbFlight["panics"]
+		thumbFlightMu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		results <- runLimited("panics", func() error { return errors.New("waiter ran its own call") })
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err == nil || !strings.Contains(err.Error(), "decoder exploded") {
+				t.Errorf("call %d: err = %v, want the recovered panic", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("caller still blocked after the panic")
+		}
+	}
+
+	// Every worker slot must be free again.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < thumbWorkers*2; i++ {
+			_ = runLimited("again", func() error { panic("again") })
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker slots leaked")
+	}
+	thumbFlightMu.Lock()
+	defer thumbFlightMu.Unlock()
+	if len(thumbFlight) != 0 {
+		t.Errorf("in-flight entries left behind: %v", thumbFlight)
+	}
+}
+
+// withEXIFPreview returns tiff with an IFD1 holding preview appended.
+func withEXIFPreview(tiff []byte, order binary.ByteOrder, preview []byte) []byte {
+	b := append([]byte(nil), tiff...)
+	ifd0 := order.Uint32(b[4:])
+	next := ifd0 + 2 + uint32(order.Uint16(b[ifd0:]))*12
+	ifd1 := uint32(len(b))
+	order.PutUint32(b[next:], ifd1)
+	entry := func(tag uint16, v uint32) []byte {
+		e := make([]byte, 12)
+		order.PutUint16(e, tag)
+		order.PutUint16(e[2:], 4)
+		order.PutUint32(e[4:], 1)
+		order.PutUint32(e[8:], v)
+		return e
+	}
+	b = append(b, 0, 0)
+	order.PutUint16(b[ifd1:], 2)
+	b = append(b, entry(exifTagThumbnailOffset, ifd1+2+2*12+4)...)
+	b = append(b, entry(exifTagThumbnailLength, uint32(len(preview)))...)
+	b = append(b, 0, 0, 0, 0)
+	return append(b, preview...)
+}
+
+func encodeTestJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExifThumbnail(t *testing.T) {
+	le := testTIFF{binary.LittleEndian}
+	preview := encodeTestJPEG(t, 8, 8)
+	base := le.build([]testIFDEntry{le.short(exifTagOrientation, 1)}, nil, nil)
+	tests := []struct {
+		name string
+		tiff []byte
+		want []byte
+	}{
+		{"preview in IFD1", withEXIFPreview(base, binary.LittleEndian, preview), preview},
+		{"no IFD1", base, nil},
+		{"not a JPEG", withEXIFPreview(base, binary.LittleEndian, []byte("<svg/>")), nil},
+		{"IFD1 at 4 GiB", func() []byte {
+			b := withEXIFPreview(base, binary.LittleEndian, preview)
+			binary.LittleEndian.PutUint32(b[8+2+12:], 0xFFFFFFFF)
+			return b
+		}(), nil},
+		{"length past the end", withEXIFPreview(base, binary.LittleEndian, preview)[:len(base)+40], nil},
+	}
+	for _, tt := range tests {
+		if got := exifThumbnail(tt.tiff); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: exifThumbnail returned %d bytes, want %d", tt.name, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestGenerateThumbnailOversized(t *testing.T) {
+	dir := t.TempDir()
+	le := testTIFF{binary.LittleEndian}
+	// A real 64x48 JPEG whose frame header claims 20000x20000 pixels.
+	huge := func(tiff []byte) []byte {
+		b := encodeTestJPEG(t, 64, 48)
+		sof := bytes.Index(b, []byte{0xFF, 0xC0})
+		binary.BigEndian.PutUint16(b[sof+5:], 20000)
+		binary.BigEndian.PutUint16(b[sof+7:], 20000)
+		if tiff == nil {
+			return b
+		}
+		exif := jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+		return append(append([]byte{0xFF, 0xD8}, exif...), b[2:]...)
+	}
+	base := le.build([]testIFDEntry{le.short(exifTagOrientation, 6)}, nil, nil)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		w, h    int
+	}{
+		{"falls back to the EXIF preview", huge(withEXIFPreview(base, binary.LittleEndian, encodeTestJPEG(t, 64, 48))), false, 48, 64},
+		{"no preview", huge(base), true, 0, 0},
+		{"no EXIF", huge(nil), true, 0, 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(dir, fmt.Sprintf("huge%d.jpg", i))
+			dst := filepath.Join(dir, fmt.Sprintf("thumb%d.jpg", i))
+			if err := os.WriteFile(src, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := generateThumbnail(src, dst, 256)
+			if tt.wantErr {
+				if !errors.Is(err, errImageTooLarge) {
+					t.Fatalf("err = %v, want errImageTooLarge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			cfg, err := jpeg.DecodeConfig(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.w || cfg.Height != tt.h {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.w, tt.h)
+			}
+		})
+	}
+}
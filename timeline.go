@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	timelineMaxFiles  = 200000
+	timelineCacheSize = 16
+)
+
+type TimelinePhoto struct {
+	Name      string   `json:"name"`
+	Path      string   `json:"path"`
+	Size      int64    `json:"size"`
+	TakenAt   int64    `json:"takenAt"`
+	Source    string   `json:"source"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+type TimelineMonth struct {
+	Month string `json:"month"`
+	Count int    `json:"count"`
+}
+
+type photoCacheEntry struct {
+	modTime int64
+	size    int64
+	photo   TimelinePhoto
+}
+
+// timelineFreshFor is how long a built timeline is served without walking
+// its directory again. Uploads, renames, moves, deletes and restores expire
+// it right away; changes made outside the API show up after this delay.
+var timelineFreshFor = 30 * time.Second
+
+type timelineResult struct {
+	signature string
+	checked   time.Time
+	months    []TimelineMonth
+	byMonth   map[string][]TimelinePhoto
+}
+
+// timelineCall is a walk in progress that later requests for the same
+// directory wait for.
+type timelineCall struct {
+	done   chan struct{}
+	stale  bool
+	result *timelineResult
+	err    error
+}
+
+var (
+	photoCacheMu   sync.Mutex
+	photoCache     = map[string]*photoCacheEntry{}
+	timelineCache  = map[string]*timelineResult{}
+	timelineOrder  []string
+	timelineFlight = map[string]*timelineCall{}
+)
+
+// photoEntry returns the timeline data of one image, re-reading EXIF only
+// when the file's mtime or size changed since it was last seen.
+func photoEntry(absPath string, info fs.FileInfo) TimelinePhoto {
+	photoCacheMu.Lock()
+	cached, ok := photoCache[absPath]
+	photoCacheMu.Unlock()
+	if ok && cached.modTime == info.ModTime().UnixNano() && cached.size == info.Size() {
+		return cached.photo
+	}
+
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	photo := TimelinePhoto{
+		Name:    info.Name(),
+		Path:    filepath.ToSlash(relPath),
+		Size:    info.Size(),
+		TakenAt: info.ModTime().Unix(),
+		Source:  "mtime",
+	}
+	if exif, err := readEXIF(absPath); err == nil {
+		if !exif.DateTimeOriginal.IsZero() {
+			photo.TakenAt = exif.DateTimeOriginal.Unix()
+			photo.Source = "exif"
+		}
+		if exif.HasGPS {
+			lat, lon := exif.Latitude, exif.Longitude
+			photo.Latitude, photo.Longitude = &lat, &lon
+		}
+	}
+
+	photoCacheMu.Lock()
+	photoCache[absPath] = &photoCacheEntry{modTime: info.ModTime().UnixNano(), size: info.Size(), photo: photo}
+	photoCacheMu.Unlock()
+	return photo
+}
+
+// buildTimeline returns the timeline of absDir. Requests for the same
+// directory share one walk, while different directories build in parallel.
+func buildTimeline(absDir string) (*timelineResult, error) {
+	photoCacheMu.Lock()
+	if cached, ok := timelineCache[absDir]; ok && time.Since(cached.checked) < timelineFreshFor {
+		photoCacheMu.Unlock()
+		return cached, nil
+	}
+	if call, ok := timelineFlight[absDir]; ok {
+		photoCacheMu.Unlock()
+		<-call.done
+		return call.result, call.err
+	}
+	call := &timelineCall{done: make(chan struct{}), err: fmt.Errorf("生成时间线失败")}
+	timelineFlight[absDir] = call
+	photoCacheMu.Unlock()
+
+	defer func() {
+		photoCacheMu.Lock()
+		delete(timelineFlight, absDir)
+		photoCacheMu.Unlock()
+		close(call.done)
+	}()
+	call.result, call.err = scanTimeline(absDir, call)
+	return call.result, call.err
+}
+
+// invalidateTimeline makes the next request for every timeline covering one
+// of absPaths walk its directory again. The photos themselves stay cached
+// and are only re-read if they changed.
+func invalidateTimeline(absPaths ...string) {
+	photoCacheMu.Lock()
+	defer photoCacheMu.Unlock()
+	for _, p := range absPaths {
+		for dir, cached := range timelineCache {
+			if pathWithin(p, dir) {
+				cached.checked = time.Time{}
+			}
+		}
+		for dir, call := range timelineFlight {
+			if pathWithin(p, dir) {
+				call.stale = true
+			}
+		}
+	}
+}
+
+// scanTimeline walks absDir and rebuilds its timeline unless the files are
+// unchanged since the cached one.
+func scanTimeline(absDir string, call *timelineCall) (*timelineResult, error) {
+	walked := time.Now()
+	type found struct {
+		path string
+		info fs.FileInfo
+	}
+	var files []found
+	h := sha1.New()
+	err := filepath.WalkDir(absDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != absDir && isHiddenName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isImageFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if len(files) >= timelineMaxFiles {
+			return fmt.Errorf("图片数量超过上限 %d", timelineMaxFiles)
+		}
+		files = append(files, found{path: p, info: info})
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", p, info.ModTime().UnixNano(), info.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	signature := hex.EncodeToString(h.Sum(nil))
+
+	// The result's age counts from the start of the walk, and one that was
+	// invalidated during the walk is stale right away. Called with
+	// photoCacheMu held.
+	checkedAt := func() time.Time {
+		if call.stale {
+			return time.Time{}
+		}
+		return walked
+	}
+	photoCacheMu.Lock()
+	if cached, ok := timelineCache[absDir]; ok && cached.signature == signature {
+		cached.checked = checkedAt()
+		photoCacheMu.Unlock()
+		return cached, nil
+	}
+	photoCacheMu.Unlock()
+
+	start := time.Now()
+	result := &timelineResult{signature: signature, byMonth: map[string][]TimelinePhoto{}}
+	for _, f := range files {
+		photo := photoEntry(f.path, f.info)
+		// EXIF times carry no zone and are read as server local time, so
+		// both sources are bucketed in local time.
+		month := time.Unix(photo.TakenAt, 0).Format("2006-01")
+		result.byMonth[month] = append(result.byMonth[month], photo)
+	}
+	for month, photos := range result.byMonth {
+		sort.Slice(photos, func(i, j int) bool {
+			if photos[i].TakenAt != photos[j].TakenAt {
+				return photos[i].TakenAt > photos[j].TakenAt
+			}
+			return photos[i].Path < photos[j].Path
+		})
+		result.months = append(result.months, TimelineMonth{Month: month, Count: len(photos)})
+	}
+	sort.Slice(result.months, func(i, j int) bool { return result.months[i].Month > result.months[j].Month })
+
+	photoCacheMu.Lock()
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		seen[f.path] = true
+	}
+	for p := range photoCache {
+		if strings.HasPrefix(p, absDir+string(filepath.Separator)) && !seen[p] {
+			delete(photoCache, p)
+		}
+	}
+	if _, exists := timelineCache[absDir]; !exists {
+		timelineOrder = append(timelineOrder, absDir)
+	}
+	result.checked = checkedAt()
+	timelineCache[absDir] = result
+	for len(timelineOrder) > timelineCacheSize {
+		delete(timelineCache, timelineOrder[0])
+		timelineOrder = timelineOrder[1:]
+	}
+	photoCacheMu.Unlock()
+	log.Printf("照片时间线已更新: %s（%d 张，耗时 %v）", absDir, len(files), time.Since(start))
+	return result, nil
+}
+
+func handlePhotoTimeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "photo/timeline/")
+	if pathParam == "" {
+		pathParam = "."
+	}
+	absDir, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+		writeError(w, http.StatusNotFound, "目录不存在")
+		return
+	}
+	result, err := buildTimeline(absDir)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := r.URL.Query()
+
+	// ?geo=true returns every geotagged photo for a map view.
+	if query.Get("geo") == "true" {
+		points := []TimelinePhoto{}
+		for _, m := range result.months {
+			for _, p := range result.byMonth[m.Month] {
+				if p.Latitude != nil {
+					points = append(points, p)
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"path":   pathParam,
+			"photos": points,
+		})
+		return
+	}
+
+	month := query.Get("month")
+	if month == "" && len(result.months) > 0 {
+		month = result.months[0].Month
+	}
+	if _, err := time.Parse("2006-01", month); month != "" && err != nil {
+		writeError(w, http.StatusBadRequest, "参数 month 格式应为 YYYY-MM")
+		return
+	}
+	resp := map[string]interface{}{
+		"path":   pathParam,
+		"months": result.months,
+		"month":  month,
+		"photos": []TimelinePhoto{},
+	}
+	total := 0
+	for i, m := range result.months {
+		total += m.Count
+		if m.Month != month {
+			continue
+		}
+		if i > 0 {
+			resp["newerMonth"] = result.months[i-1].Month
+		}
+		if i+1 < len(result.months) {
+			resp["olderMonth"] = result.months[i+1].Month
+		}
+	}
+	if photos, ok := result.byMonth[month]; ok {
+		resp["photos"] = photos
+	}
+	resp["total"] = total
+	writeJSON(w, http.StatusOK, resp)
+}
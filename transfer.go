@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// transferDirName is internal like the trash: the generic file routes
+	// refuse it, so transfers are only reachable through downloadTransfer,
+	// which enforces expiry and download limits.
+	transferDirName     = ".fileuploader_transfer"
+	legacyTransferDir   = "transfer"
+	transferDefaultDays = 14
+	transferMaxDays     = 30
+	transferReapTick    = 10 * time.Minute
+)
+
+type Transfer struct {
+	Slug         string `json:"slug"`
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+	MaxDownloads int    `json:"maxDownloads,omitempty"`
+	Downloads    int    `json:"downloads"`
+	ExpiresAt    int64  `json:"expiresAt"`
+	DeleteToken  string `json:"deleteToken,omitempty"`
+	Uploader     string `json:"uploader"`
+	Created      int64  `json:"created"`
+	URL          string `json:"url,omitempty"`
+	DeleteURL    string `json:"deleteUrl,omitempty"`
+}
+
+var (
+	transfersMu sync.Mutex
+	transfers   = map[string]*Transfer{}
+)
+
+func transfersFile() string {
+	return filepath.Join(appRootDir, "transfers.json")
+}
+
+func loadTransfers() {
+	data, err := os.ReadFile(transfersFile())
+	if err != nil {
+		return
+	}
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	if err := json.Unmarshal(data, &transfers); err != nil {
+		log.Printf("读取临时传输记录失败: %v", err)
+	}
+	// Earlier versions kept transfers in a visible folder; move the known
+	// slugs out of it.
+	for slug := range transfers {
+		oldDir := filepath.Join(rootDir, legacyTransferDir, slug)
+		if _, err := os.Stat(oldDir); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(rootDir, transferDirName), 0755); err != nil {
+			log.Printf("创建临时传输目录失败: %v", err)
+			return
+		}
+		if err := os.Rename(oldDir, transferDir(slug)); err != nil {
+			log.Printf("迁移临时传输 %s 失败: %v", slug, err)
+		}
+	}
+	_ = os.Remove(filepath.Join(rootDir, legacyTransferDir))
+}
+
+// transferDir is where the file of a transfer is stored. Slugs only come
+// from randomToken or from a lookup in transfers.
+func transferDir(slug string) string {
+	return filepath.Join(rootDir, transferDirName, slug)
+}
+
+// saveTransfers must be called with transfersMu held.
+func saveTransfers() error {
+	data, err := json.MarshalIndent(transfers, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := transfersFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, transfersFile())
+}
+
+// Only a hash of the deletion token is kept; the token itself is shown once.
+func hashDeleteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func transferExpired(t *Transfer) bool {
+	return time.Now().Unix() >= t.ExpiresAt || (t.MaxDownloads > 0 && t.Downloads >= t.MaxDownloads)
+}
+
+func transferURL(r *http.Request, t *Transfer) string {
+	return requestBaseURL(r) + apiPrefix(r) + "transfer/" + t.Slug + "/" + escapePath(t.Name)
+}
+
+// removeTransfer deletes the files of t and its record. It must be called
+// with transfersMu held.
+func removeTransfer(t *Transfer, reason string) {
+	absDir := transferDir(t.Slug)
+	if err := os.RemoveAll(absDir); err != nil {
+		log.Printf("删除临时传输文件失败 %s: %v", absDir, err)
+		return
+	}
+	dropFileStats(absDir)
+	delete(transfers, t.Slug)
+	if err := saveTransfers(); err != nil {
+		log.Printf("保存临时传输记录失败: %v", err)
+	}
+	log.Printf("临时传输已删除: %s/%s（%s）", t.Slug, t.Name, reason)
+}
+
+func reapTransfers() {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	for _, t := range transfers {
+		if transferExpired(t) {
+			removeTransfer(t, "已过期")
+		}
+	}
+}
+
+func startTransferReaper() {
+	loadTransfers()
+	go func() {
+		for {
+			reapTransfers()
+			time.Sleep(transferReapTick)
+		}
+	}()
+}
+
+// transferLimits reads max-days and max-downloads from the transfer.sh style
+// Max-Days/Max-Downloads headers or the maxDays/maxDownloads parameters.
+func transferLimits(r *http.Request) (int, int, error) {
+	get := func(header, param string) string {
+		if v := r.Header.Get(header); v != "" {
+			return v
+		}
+		return r.URL.Query().Get(param)
+	}
+	days := transferDefaultDays
+	if v := get("Max-Days", "maxDays"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > transferMaxDays {
+			return 0, 0, fmt.Errorf("保存天数应在 1 到 %d 之间", transferMaxDays)
+		}
+		days = n
+	}
+	downloads := 0
+	if v := get("Max-Downloads", "maxDownloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("参数 maxDownloads 无效")
+		}
+		downloads = n
+	}
+	return days, downloads, nil
+}
+
+// createTransfer moves one buffered upload into transferDirName/<slug>/ and
+// records it. The returned copy carries the plain deletion token and the URLs.
+func createTransfer(r *http.Request, file bufferedFile, sum string, days, maxDownloads int) (*Transfer, error) {
+	slug := randomToken(6)
+	absDir := transferDir(slug)
+	if err := os.MkdirAll(absDir, 0755); err != nil {
+		_ = os.Remove(file.tempPath)
+		return nil, fmt.Errorf("无法创建目标目录")
+	}
+	stored, processed, errorsList := storeUploadedFiles(r, absDir, []bufferedFile{file}, uploadReplace, nil)
+	if len(stored) == 0 {
+		_ = os.RemoveAll(absDir)
+		return nil, fmt.Errorf("%s", strings.Join(errorsList, "; "))
+	}
+	t := &Transfer{
+		Slug:         slug,
+		Name:         file.fileName,
+		Size:         file.fileSize,
+		SHA256:       sum,
+		MaxDownloads: maxDownloads,
+		ExpiresAt:    time.Now().Add(time.Duration(days) * 24 * time.Hour).Unix(),
+		Uploader:     requestActor(r),
+		Created:      time.Now().Unix(),
+	}
+	if len(processed[file.fileName]) > 0 || sum == "" {
+		absPath := filepath.Join(absDir, file.fileName)
+		if info, err := os.Stat(absPath); err == nil {
+			t.Size = info.Size()
+		}
+		if s, err := hashFile(absPath); err == nil {
+			t.SHA256 = s
+		}
+	}
+	token := randomToken(16)
+	t.DeleteToken = hashDeleteToken(token)
+
+	transfersMu.Lock()
+	transfers[slug] = t
+	err := saveTransfers()
+	transfersMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("无法保存临时传输记录: %v", err)
+	}
+	log.Printf("临时传输已创建: %s/%s（%d 字节，%d 天，最多下载 %d 次，来自 %s）", slug, t.Name, t.Size, days, maxDownloads, t.Uploader)
+
+	view := *t
+	view.URL = transferURL(r, t)
+	view.DeleteURL = view.URL + "/" + token
+	view.DeleteToken = token
+	return &view, nil
+}
+
+func writeTransferResult(w http.ResponseWriter, r *http.Request, results []*Transfer, errorsList []string) {
+	if len(results) == 1 {
+		w.Header().Set("X-Url-Delete", results[0].DeleteURL)
+	}
+	status := http.StatusCreated
+	if len(results) == 0 {
+		status = http.StatusBadRequest
+	}
+	if wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		for _, t := range results {
+			fmt.Fprintln(w, t.URL)
+		}
+		for _, e := range errorsList {
+			fmt.Fprintln(w, "错误: "+e)
+		}
+		return
+	}
+	resp := map[string]interface{}{
+		"success":   len(errorsList) == 0,
+		"transfers": results,
+	}
+	if len(errorsList) > 0 {
+		resp["errors"] = errorsList
+	}
+	writeJSON(w, status, resp)
+}
+
+// handleTransfer implements transfer.sh style sharing below transferDirName:
+//
+//	PUT    transfer/<name>                 upload the body, returns the URL
+//	POST   transfer/                       multipart upload, one slug per file
+//	GET    transfer/<slug>/<name>          download (counted)
+//	DELETE transfer/<slug>/<name>/<token>  delete before expiry
+//
+// The list of active transfers is served separately by handleTransferList so
+// it can stay behind the login like share/list.
+func handleTransfer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(apiPathParam(r, "transfer/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		uploadTransferMultipart(w, r)
+	case len(parts) == 1 && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		uploadTransferRaw(w, r, parts[0])
+	case len(parts) == 2 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		downloadTransfer(w, r, parts[0], parts[1])
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		deleteTransfer(w, r, parts[0], parts[1], parts[2])
+	case len(parts) > 3:
+		writeError(w, http.StatusNotFound, "临时传输不存在")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func uploadTransferRaw(w http.ResponseWriter, r *http.Request, name string) {
+	name = filepath.Base(name)
+	if name == "." || name == ".." || isHiddenName(name) {
+		writeError(w, http.StatusBadRequest, "文件名不允许")
+		return
+	}
+	days, maxDownloads, err := transferLimits(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tempPath, written, sum, status, err := receiveRawBody(w, r)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	t, err := createTransfer(r, bufferedFile{tempPath: tempPath, fileName: name, fileSize: written}, sum, days, maxDownloads)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeTransferResult(w, r, []*Transfer{t}, nil)
+}
+
+func uploadTransferMultipart(w http.ResponseWriter, r *http.Request) {
+	days, maxDownloads, err := transferLimits(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	upload, status, err := readMultipartUpload(w, r, maxUploadSize, func(_ map[string]string, name string) error {
+		if isHiddenName(name) {
+			return fmt.Errorf("文件名不允许")
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	if !upload.hasFiles {
+		writeError(w, http.StatusBadRequest, "没有找到上传的文件")
+		return
+	}
+	var results []*Transfer
+	errorsList := upload.errors
+	for _, f := range upload.files {
+		t, err := createTransfer(r, f, "", days, maxDownloads)
+		if err != nil {
+			errorsList = append(errorsList, fmt.Sprintf("无法保存文件 %s: %v", f.fileName, err))
+			continue
+		}
+		results = append(results, t)
+	}
+	writeTransferResult(w, r, results, errorsList)
+}
+
+func lookupTransfer(slug, name string) *Transfer {
+	t, ok := transfers[slug]
+	if !ok || t.Name != name || transferExpired(t) {
+		return nil
+	}
+	return t
+}
+
+func downloadTransfer(w http.ResponseWriter, r *http.Request, slug, name string) {
+	transfersMu.Lock()
+	t := lookupTransfer(slug, name)
+	if t == nil {
+		transfersMu.Unlock()
+		writeError(w, http.StatusNotFound, "临时传输不存在或已过期")
+		return
+	}
+	if countsAsDownload(r, t.Size) {
+		t.Downloads++
+		if err := saveTransfers(); err != nil {
+			log.Printf("保存临时传输记录失败: %v", err)
+		}
+	}
+	exhausted := t.MaxDownloads > 0 && t.Downloads >= t.MaxDownloads
+	remaining := remainingDownloads(t)
+	transfersMu.Unlock()
+
+	absPath := filepath.Join(transferDir(slug), name)
+	f, err := os.Open(absPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "临时传输不存在或已过期")
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		writeError(w, http.StatusNotFound, "临时传输不存在或已过期")
+		return
+	}
+	w.Header().Set("Content-Type", getContentType(name))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Remaining-Downloads", remaining)
+	recordFileAccess(r, absPath, info.Size())
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	f.Close()
+
+	if exhausted {
+		transfersMu.Lock()
+		if t, ok := transfers[slug]; ok {
+			removeTransfer(t, "下载次数已用完")
+		}
+		transfersMu.Unlock()
+	}
+}
+
+func remainingDownloads(t *Transfer) string {
+	if t.MaxDownloads == 0 {
+		return "n/a"
+	}
+	return strconv.Itoa(max(t.MaxDownloads-t.Downloads, 0))
+}
+
+func deleteTransfer(w http.ResponseWriter, r *http.Request, slug, name, token string) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	t, ok := transfers[slug]
+	if !ok || t.Name != name || subtle.ConstantTimeCompare([]byte(hashDeleteToken(token)), []byte(t.DeleteToken)) != 1 {
+		writeError(w, http.StatusNotFound, "临时传输不存在或删除令牌无效")
+		return
+	}
+	removeTransfer(t, "上传者删除")
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "临时传输已删除"})
+}
+
+func handleTransferList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	transfersMu.Lock()
+	list := make([]Transfer, 0, len(transfers))
+	for _, t := range transfers {
+		if transferExpired(t) {
+			continue
+		}
+		v := *t
+		v.DeleteToken = ""
+		v.URL = transferURL(r, t)
+		list = append(list, v)
+	}
+	transfersMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"transfers": list,
+	})
+}
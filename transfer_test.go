@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransferLifecycle(t *testing.T) {
+	useTempRoots(t)
+	transfersMu.Lock()
+	saved := transfers
+	transfers = map[string]*Transfer{}
+	transfersMu.Unlock()
+	defer func() {
+		transfersMu.Lock()
+		transfers = saved
+		transfersMu.Unlock()
+	}()
+
+	upload := func(name, body string, header map[string]string) *Transfer {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPut, "/api/transfer/"+name, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handleTransfer(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("upload status = %d: %s", w.Code, w.Body)
+		}
+		var resp struct{ Transfers []*Transfer }
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Transfers) != 1 {
+			t.Fatalf("upload response %s: %v", w.Body, err)
+		}
+		return resp.Transfers[0]
+	}
+	do := func(method, rawURL string) *httptest.ResponseRecorder {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handleTransfer(w, httptest.NewRequest(method, u.Path, nil))
+		return w
+	}
+
+	once := upload("report.txt", "hello", map[string]string{"Max-Downloads": "1"})
+	if _, err := os.Stat(filepath.Join(rootDir, transferDirName, once.Slug, "report.txt")); err != nil {
+		t.Fatalf("transfer not stored in the internal directory: %v", err)
+	}
+
+	t.Run("hidden from the generic routes", func(t *testing.T) {
+		rel := transferDirName + "/" + once.Slug + "/report.txt"
+		if _, err := ensurePathInRoot(rel); err == nil {
+			t.Error("ensurePathInRoot accepted the transfer directory")
+		}
+		w := httptest.NewRecorder()
+		handleFileDownload(w, httptest.NewRequest(http.MethodGet, "/api/file/download/"+rel, nil))
+		if w.Code == http.StatusOK {
+			t.Error("file/download served a transfer")
+		}
+		if !isHiddenName(transferDirName) {
+			t.Error("transfer directory is listed")
+		}
+	})
+
+	t.Run("range request does not use up the download", func(t *testing.T) {
+		u, _ := url.Parse(once.URL)
+		r := httptest.NewRequest(http.MethodGet, u.Path, nil)
+		r.Header.Set("Range", "bytes=1-2")
+		w := httptest.NewRecorder()
+		handleTransfer(w, r)
+		if w.Code != http.StatusPartialContent || w.Body.String() != "el" {
+			t.Fatalf("range status = %d, body %q", w.Code, w.Body)
+		}
+	})
+
+	t.Run("last download removes the transfer", func(t *testing.T) {
+		w := do(http.MethodGet, once.URL)
+		if w.Code != http.StatusOK || w.Body.String() != "hello" || w.Header().Get("X-Remaining-Downloads") != "0" {
+			t.Fatalf("download status = %d, body %q, headers %v", w.Code, w.Body, w.Header())
+		}
+		if w := do(http.MethodGet, once.URL); w.Code != http.StatusNotFound {
+			t.Errorf("second download status = %d, want 404", w.Code)
+		}
+		if _, err := os.Stat(filepath.Join(rootDir, transferDirName, once.Slug)); !os.IsNotExist(err) {
+			t.Errorf("transfer directory left behind: %v", err)
+		}
+	})
+
+	t.Run("delete needs the token", func(t *testing.T) {
+		kept := upload("notes.md", "# notes", nil)
+		base, token, _ := strings.Cut(strings.TrimPrefix(kept.DeleteURL, kept.URL), "/")
+		if base != "" || token == "" {
+			t.Fatalf("unexpected delete URL %q for %q", kept.DeleteURL, kept.URL)
+		}
+		if w := do(http.MethodDelete, kept.URL+"/wrong"); w.Code != http.StatusNotFound {
+			t.Errorf("wrong token status = %d, want 404", w.Code)
+		}
+		if w := do(http.MethodGet, kept.URL); w.Code != http.StatusOK {
+			t.Fatalf("download after failed delete = %d", w.Code)
+		}
+		if w := do(http.MethodDelete, kept.DeleteURL); w.Code != http.StatusOK {
+			t.Fatalf("delete status = %d: %s", w.Code, w.Body)
+		}
+		if w := do(http.MethodGet, kept.URL); w.Code != http.StatusNotFound {
+			t.Errorf("download after delete = %d, want 404", w.Code)
+		}
+	})
+
+	t.Run("hidden names refused", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/api/transfer/"+transferDirName, strings.NewReader("x"))
+		w := httptest.NewRecorder()
+		handleTransfer(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", w.Code)
+		}
+	})
+}
+
+func TestLoadTransfersMovesLegacyDirectory(t *testing.T) {
+	useTempRoots(t)
+	transfersMu.Lock()
+	saved := transfers
+	transfers = map[string]*Transfer{}
+	transfersMu.Unlock()
+	defer func() {
+		transfersMu.Lock()
+		transfers = saved
+		transfersMu.Unlock()
+	}()
+
+	old := filepath.Join(rootDir, legacyTransferDir, "abc123")
+	if err := os.MkdirAll(old, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(old, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	index := `{"abc123":{"slug":"abc123","name":"a.txt","size":1,"expiresAt":9999999999}}`
+	if err := os.WriteFile(transfersFile(), []byte(index), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loadTransfers()
+	if _, err := os.Stat(filepath.Join(transferDir("abc123"), "a.txt")); err != nil {
+		t.Errorf("transfer not moved: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, legacyTransferDir)); !os.IsNotExist(err) {
+		t.Errorf("empty legacy directory kept: %v", err)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	trashDirName   = ".fileuploader_trash"
+	trashMaxAge    = 30 * 24 * time.Hour
+	trashMaxSize   = int64(20 * 1024 * 1024 * 1024)
+	trashSweepTick = time.Hour
+)
+
+type TrashItem struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	OriginalPath string `json:"originalPath"`
+	Volume       string `json:"volume"`
+	Size         int64  `json:"size"`
+	IsDir        bool   `json:"isDir"`
+	DeletedBy    string `json:"deletedBy"`
+	DeletedAt    int64  `json:"deletedAt"`
+}
+
+var (
+	trashMu      sync.Mutex
+	trashVolumes map[string]bool
+)
+
+func trashVolumesFile() string {
+	return filepath.Join(appRootDir, "trash_volumes.json")
+}
+
+func loadTrashVolumes() {
+	trashVolumes = map[string]bool{".": true}
+	data, err := os.ReadFile(trashVolumesFile())
+	if err != nil {
+		return
+	}
+	var vols []string
+	if err := json.Unmarshal(data, &vols); err != nil {
+		log.Printf("读取回收站卷列表失败: %v", err)
+		return
+	}
+	for _, v := range vols {
+		trashVolumes[v] = true
+	}
+}
+
+func saveTrashVolumes() {
+	vols := make([]string, 0, len(trashVolumes))
+	for v := range trashVolumes {
+		vols = append(vols, v)
+	}
+	sort.Strings(vols)
+	data, _ := json.MarshalIndent(vols, "", "  ")
+	if err := os.WriteFile(trashVolumesFile(), data, 0644); err != nil {
+		log.Printf("保存回收站卷列表失败: %v", err)
+	}
+}
+
+func deviceOf(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("无法获取设备信息")
+	}
+	return uint64(st.Dev), nil
+}
+
+// volumeRootFor returns the highest directory between rootDir and absPath
+// that still lives on the same filesystem as absPath's parent, so items can
+// always be moved into the trash with a plain rename.
+func volumeRootFor(absPath string) (string, error) {
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(absPath)
+	dev, err := deviceOf(dir)
+	if err != nil {
+		return "", err
+	}
+	for dir != absRoot {
+		parent := filepath.Dir(dir)
+		// Files reached through a symlink into /mnt stay on their own volume.
+		if parent == dir || parent == "/mnt" {
+			break
+		}
+		parentDev, err := deviceOf(parent)
+		if err != nil || parentDev != dev {
+			break
+		}
+		dir = parent
+	}
+	return dir, nil
+}
+
+func trashPaths(volume string) (files string, info string) {
+	base := filepath.Join(rootDir, volume, trashDirName)
+	return filepath.Join(base, "files"), filepath.Join(base, "info")
+}
+
+func pathSize(path string) int64 {
+	var total int64
+	_ = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func moveToTrash(absPath, actor string) (*TrashItem, error) {
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	volRoot, err := volumeRootFor(absPath)
+	if err != nil {
+		return nil, err
+	}
+	volume, _ := filepath.Rel(rootDir, volRoot)
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	if relPath == "." {
+		return nil, fmt.Errorf("不能删除根目录")
+	}
+
+	filesDir, infoDir := trashPaths(volume)
+	if err := os.MkdirAll(filesDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(infoDir, 0755); err != nil {
+		return nil, err
+	}
+
+	item := &TrashItem{
+		ID:           randomToken(8),
+		Name:         info.Name(),
+		OriginalPath: relPath,
+		Volume:       volume,
+		Size:         pathSize(absPath),
+		IsDir:        info.IsDir(),
+		DeletedBy:    actor,
+		DeletedAt:    time.Now().Unix(),
+	}
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	infoPath := filepath.Join(infoDir, item.ID+".json")
+	if err := os.WriteFile(infoPath, data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(absPath, filepath.Join(filesDir, item.ID)); err != nil {
+		_ = os.Remove(infoPath)
+		return nil, err
+	}
+	dropFileStats(absPath)
+	invalidateTimeline(absPath)
+
+	trashMu.Lock()
+	if !trashVolumes[volume] {
+		trashVolumes[volume] = true
+		saveTrashVolumes()
+	}
+	trashMu.Unlock()
+
+	log.Printf("已移入回收站: %s -> %s (操作者: %s)", relPath, item.ID, actor)
+	return item, nil
+}
+
+func listTrashItems() []TrashItem {
+	trashMu.Lock()
+	vols := make([]string, 0, len(trashVolumes))
+	for v := range trashVolumes {
+		vols = append(vols, v)
+	}
+	trashMu.Unlock()
+
+	var items []TrashItem
+	for _, vol := range vols {
+		_, infoDir := trashPaths(vol)
+		entries, err := os.ReadDir(infoDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".json") {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(infoDir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			var item TrashItem
+			if err := json.Unmarshal(data, &item); err != nil {
+				log.Printf("回收站元数据损坏 %s: %v", entry.Name(), err)
+				continue
+			}
+			item.Volume = vol
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt > items[j].DeletedAt
+	})
+	return items
+}
+
+func findTrashItem(id string) (*TrashItem, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, fmt.Errorf("无效的回收站条目ID")
+	}
+	for _, item := range listTrashItems() {
+		if item.ID == id {
+			return &item, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func purgeTrashItem(item *TrashItem) error {
+	filesDir, infoDir := trashPaths(item.Volume)
+	if err := os.RemoveAll(filepath.Join(filesDir, item.ID)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(infoDir, item.ID+".json"))
+}
+
+func restoreTarget(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (恢复%d)%s", base, i, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+func restoreTrashItem(item *TrashItem, conflict, actor string) (string, error) {
+	dstPath, err := ensurePathInRoot(item.OriginalPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(dstPath); err == nil {
+		switch conflict {
+		case "rename":
+			dstPath = restoreTarget(dstPath)
+		case "overwrite":
+			if err := checkProtected(item.OriginalPath); err != nil {
+				return "", err
+			}
+			if _, err := moveToTrash(dstPath, actor); err != nil {
+				return "", err
+			}
+		default:
+			return "", os.ErrExist
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return "", err
+	}
+	filesDir, infoDir := trashPaths(item.Volume)
+	if err := os.Rename(filepath.Join(filesDir, item.ID), dstPath); err != nil {
+		return "", err
+	}
+	invalidateTimeline(dstPath)
+	if err := os.Remove(filepath.Join(infoDir, item.ID+".json")); err != nil {
+		log.Printf("删除回收站元数据失败 %s: %v", item.ID, err)
+	}
+	relPath, _ := filepath.Rel(rootDir, dstPath)
+	return relPath, nil
+}
+
+func sweepTrash() {
+	items := listTrashItems()
+	cutoff := time.Now().Add(-trashMaxAge).Unix()
+	usage := map[string]int64{}
+	var kept []TrashItem
+	for i := range items {
+		item := items[i]
+		if trashMaxAge > 0 && item.DeletedAt < cutoff {
+			if err := purgeTrashItem(&item); err != nil {
+				log.Printf("清理过期回收站条目失败 %s: %v", item.ID, err)
+			} else {
+				log.Printf("已清理过期回收站条目: %s (%s)", item.OriginalPath, item.ID)
+			}
+			continue
+		}
+		usage[item.Volume] += item.Size
+		kept = append(kept, item)
+	}
+	if trashMaxSize <= 0 {
+		return
+	}
+	// kept is sorted newest first, so evict from the tail.
+	for i := len(kept) - 1; i >= 0; i-- {
+		item := kept[i]
+		if usage[item.Volume] <= trashMaxSize {
+			continue
+		}
+		if err := purgeTrashItem(&item); err != nil {
+			log.Printf("清理超额回收站条目失败 %s: %v", item.ID, err)
+			continue
+		}
+		usage[item.Volume] -= item.Size
+		log.Printf("回收站超出容量限制，已清理: %s (%s)", item.OriginalPath, item.ID)
+	}
+}
+
+func startTrashSweeper() {
+	loadTrashVolumes()
+	go func() {
+		for {
+			sweepTrash()
+			time.Sleep(trashSweepTick)
+		}
+	}()
+}
+
+func handleTrashList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	items := listTrashItems()
+	if items == nil {
+		items = []TrashItem{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+	})
+}
+
+func handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	item, err := findTrashItem(r.FormValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "回收站条目不存在")
+		return
+	}
+	restored, err := restoreTrashItem(item, r.FormValue("conflict"), requestActor(r))
+	if os.IsExist(err) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("原位置已存在同名文件: %s", item.OriginalPath))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法恢复文件: %v", err))
+		return
+	}
+	log.Printf("已从回收站恢复: %s -> %s", item.ID, restored)
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "恢复成功", Data: map[string]string{"path": restored}})
+}
+
+func handleTrashPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	var items []TrashItem
+	if r.FormValue("all") == "true" {
+		items = listTrashItems()
+	} else {
+		item, err := findTrashItem(r.FormValue("id"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, "回收站条目不存在")
+			return
+		}
+		items = []TrashItem{*item}
+	}
+	for i := range items {
+		if err := purgeTrashItem(&items[i]); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法彻底删除: %v", err))
+			return
+		}
+		log.Printf("已彻底删除回收站条目: %s (%s)", items[i].OriginalPath, items[i].ID)
+	}
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "彻底删除成功", Data: map[string]int{"purged": len(items)}})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTempTrash gives the test empty roots and a fresh trash volume list.
+func useTempTrash(t *testing.T) {
+	t.Helper()
+	useTempRoots(t)
+	savedVolumes := trashVolumes
+	trashVolumes = map[string]bool{".": true}
+	t.Cleanup(func() { trashVolumes = savedVolumes })
+}
+
+func postForm(handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func deleteFile(relPath string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handleDeleteFile(w, httptest.NewRequest(http.MethodDelete, "/api/file/delete/"+relPath, nil))
+	return w
+}
+
+func writeTestFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		p := filepath.Join(rootDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestFile(relPath string) string {
+	data, err := os.ReadFile(filepath.Join(rootDir, filepath.FromSlash(relPath)))
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(data)
+}
+
+func TestTrashRestore(t *testing.T) {
+	useTempTrash(t)
+	trashed := func(t *testing.T, relPath string) TrashItem {
+		t.Helper()
+		w := deleteFile(relPath)
+		if w.Code != http.StatusOK {
+			t.Fatalf("delete %s: status = %d: %s", relPath, w.Code, w.Body)
+		}
+		var resp struct {
+			Data TrashItem `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(rootDir, relPath)); !os.IsNotExist(err) {
+			t.Fatalf("%s still present after delete", relPath)
+		}
+		return resp.Data
+	}
+
+	writeTestFiles(t, map[string]string{"a.txt": "one"})
+	first := trashed(t, "a.txt")
+	if first.OriginalPath != "a.txt" || first.Size != 3 {
+		t.Errorf("trash item = %+v", first)
+	}
+	writeTestFiles(t, map[string]string{"a.txt": "two"})
+
+	tests := []struct {
+		name     string
+		id       string
+		conflict string
+		status   int
+		path     string
+	}{
+		{"original path taken", first.ID, "", http.StatusConflict, ""},
+		{"restore beside it", first.ID, "rename", http.StatusOK, "a (恢复1).txt"},
+		{"already restored", first.ID, "", http.StatusNotFound, ""},
+		{"path in the id", "../a.txt", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := postForm(handleTrashRestore, "/api/trash/restore", url.Values{"id": {tt.id}, "conflict": {tt.conflict}})
+		if w.Code != tt.status {
+			t.Fatalf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if tt.path != "" && readTestFile(tt.path) != "one" {
+			t.Errorf("%s: %s holds %q", tt.name, tt.path, readTestFile(tt.path))
+		}
+	}
+	if got := readTestFile("a.txt"); got != "two" {
+		t.Errorf("a.txt = %q after restoring beside it", got)
+	}
+
+	// Overwriting sends the file in the way to the trash instead.
+	second := trashed(t, "a.txt")
+	writeTestFiles(t, map[string]string{"a.txt": "three"})
+	if w := postForm(handleTrashRestore, "/api/trash/restore", url.Values{"id": {second.ID}, "conflict": {"overwrite"}}); w.Code != http.StatusOK {
+		t.Fatalf("overwrite: status = %d: %s", w.Code, w.Body)
+	}
+	if got := readTestFile("a.txt"); got != "two" {
+		t.Errorf("a.txt = %q after overwrite, want two", got)
+	}
+	items := listTrashItems()
+	if len(items) != 1 || items[0].OriginalPath != "a.txt" || items[0].Size != 5 {
+		t.Fatalf("trash = %+v, want the replaced a.txt only", items)
+	}
+
+	if w := postForm(handleTrashPurge, "/api/trash/purge", url.Values{"all": {"true"}}); w.Code != http.StatusOK {
+		t.Fatalf("purge: status = %d: %s", w.Code, w.Body)
+	}
+	if items := listTrashItems(); len(items) != 0 {
+		t.Errorf("trash after purge = %+v", items)
+	}
+}
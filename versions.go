@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	versionsDirName     = ".fileuploader_versions"
+	versionKeepLast     = 10
+	versionKeepDailyFor = 30
+)
+
+type FileVersion struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"modTime"`
+	CreatedAt int64  `json:"createdAt"`
+	CreatedBy string `json:"createdBy"`
+}
+
+type versionIndex struct {
+	Path     string        `json:"path"`
+	Versions []FileVersion `json:"versions"`
+}
+
+var versionsMu sync.Mutex
+
+func versionStoreDir(absPath string) (string, error) {
+	volRoot, err := volumeRootFor(absPath)
+	if err != nil {
+		return "", err
+	}
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	sum := sha1.Sum([]byte(relPath))
+	return filepath.Join(volRoot, versionsDirName, hex.EncodeToString(sum[:])), nil
+}
+
+func loadVersionIndex(dir, relPath string) *versionIndex {
+	idx := &versionIndex{Path: relPath}
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return idx
+	}
+	if err := json.Unmarshal(data, idx); err != nil {
+		log.Printf("版本索引损坏 %s: %v", dir, err)
+		return &versionIndex{Path: relPath}
+	}
+	return idx
+}
+
+func saveVersionIndex(dir string, idx *versionIndex) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "index.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "index.json"))
+}
+
+// snapshotVersion moves the current file at absPath into the version store.
+// The path is empty until the caller puts the new content in place; on any
+// failure before that the caller must hand the version back with
+// revertSnapshot.
+func snapshotVersion(absPath, actor string) (*FileVersion, error) {
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	dir, err := versionStoreDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	versionsMu.Lock()
+	defer versionsMu.Unlock()
+
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	now := time.Now()
+	v := FileVersion{
+		ID:        fmt.Sprintf("%d-%s", now.UnixNano(), randomToken(4)),
+		Size:      info.Size(),
+		ModTime:   info.ModTime().Unix(),
+		CreatedAt: now.Unix(),
+		CreatedBy: actor,
+	}
+	if err := os.Rename(absPath, filepath.Join(dir, v.ID)); err != nil {
+		return nil, err
+	}
+	idx := loadVersionIndex(dir, relPath)
+	idx.Versions = append([]FileVersion{v}, idx.Versions...)
+	pruneVersions(dir, idx, now)
+	if err := saveVersionIndex(dir, idx); err != nil {
+		return nil, err
+	}
+	log.Printf("已保存历史版本: %s -> %s", relPath, v.ID)
+	return &v, nil
+}
+
+// revertSnapshot puts a version taken by snapshotVersion back at absPath and
+// forgets it, replacing whatever partial file a failed write left behind.
+func revertSnapshot(absPath string, v *FileVersion) {
+	if v == nil {
+		return
+	}
+	dir, err := versionStoreDir(absPath)
+	if err != nil {
+		log.Printf("无法还原历史版本 %s: %v", absPath, err)
+		return
+	}
+	versionsMu.Lock()
+	defer versionsMu.Unlock()
+	if err := os.Rename(filepath.Join(dir, v.ID), absPath); err != nil {
+		log.Printf("无法还原历史版本 %s -> %s: %v", v.ID, absPath, err)
+		return
+	}
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	idx := loadVersionIndex(dir, relPath)
+	for i := range idx.Versions {
+		if idx.Versions[i].ID == v.ID {
+			idx.Versions = append(idx.Versions[:i], idx.Versions[i+1:]...)
+			break
+		}
+	}
+	if err := saveVersionIndex(dir, idx); err != nil {
+		log.Printf("保存版本索引失败 %s: %v", dir, err)
+	}
+	log.Printf("写入失败，已还原: %s <- %s", relPath, v.ID)
+}
+
+func pruneVersions(dir string, idx *versionIndex, now time.Time) {
+	keep := map[string]bool{}
+	days := map[string]bool{}
+	cutoff := now.AddDate(0, 0, -versionKeepDailyFor)
+	for i, v := range idx.Versions {
+		if i < versionKeepLast {
+			keep[v.ID] = true
+		}
+		created := time.Unix(v.CreatedAt, 0)
+		day := created.Format("2006-01-02")
+		if created.After(cutoff) && !days[day] {
+			days[day] = true
+			keep[v.ID] = true
+		}
+	}
+	kept := idx.Versions[:0]
+	for _, v := range idx.Versions {
+		if keep[v.ID] {
+			kept = append(kept, v)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, v.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("清理历史版本失败 %s: %v", v.ID, err)
+		}
+	}
+	idx.Versions = kept
+}
+
+func lookupVersions(pathParam string) (string, string, *versionIndex, error) {
+	absPath, err := ensurePathInRoot(pathParam)
+	if err != nil {
+		return "", "", nil, err
+	}
+	dir, err := versionStoreDir(absPath)
+	if err != nil {
+		return "", "", nil, err
+	}
+	relPath, _ := filepath.Rel(rootDir, absPath)
+	versionsMu.Lock()
+	idx := loadVersionIndex(dir, relPath)
+	versionsMu.Unlock()
+	return absPath, dir, idx, nil
+}
+
+func findVersion(idx *versionIndex, id string) *FileVersion {
+	for i := range idx.Versions {
+		if idx.Versions[i].ID == id {
+			return &idx.Versions[i]
+		}
+	}
+	return nil
+}
+
+func handleVersionList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "version/list/")
+	if pathParam == "" {
+		writeError(w, http.StatusBadRequest, "路径不能为空")
+		return
+	}
+	_, _, idx, err := lookupVersions(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	versions := idx.Versions
+	if versions == nil {
+		versions = []FileVersion{}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].CreatedAt > versions[j].CreatedAt
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"path":     idx.Path,
+		"versions": versions,
+	})
+}
+
+func handleVersionDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	pathParam := apiPathParam(r, "version/download/")
+	_, dir, idx, err := lookupVersions(pathParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	v := findVersion(idx, r.URL.Query().Get("id"))
+	if v == nil {
+		writeError(w, http.StatusNotFound, "版本不存在")
+		return
+	}
+	file, err := os.Open(filepath.Join(dir, v.ID))
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("无法打开历史版本: %v", err))
+		return
+	}
+	defer file.Close()
+	name := filepath.Base(idx.Path)
+	w.Header().Set("Content-Type", getContentType(name))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, time.Unix(v.ModTime, 0), file)
+}
+
+func handleVersionRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "无法解析请求")
+		return
+	}
+	absPath, dir, idx, err := lookupVersions(r.FormValue("path"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	v := findVersion(idx, r.FormValue("id"))
+	if v == nil {
+		writeError(w, http.StatusNotFound, "版本不存在")
+		return
+	}
+
+	src, err := os.Open(filepath.Join(dir, v.ID))
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("无法打开历史版本: %v", err))
+		return
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(absPath), ".restore-*")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法恢复版本: %v", err))
+		return
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法恢复版本: %v", err))
+		return
+	}
+	_ = tmp.Close()
+	_ = os.Chtimes(tmp.Name(), time.Now(), time.Unix(v.ModTime, 0))
+	_ = os.Chmod(tmp.Name(), 0644)
+
+	current, err := snapshotVersion(absPath, requestActor(r))
+	if err != nil && !os.IsNotExist(err) {
+		_ = os.Remove(tmp.Name())
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法保存当前版本: %v", err))
+		return
+	}
+	if err := os.Rename(tmp.Name(), absPath); err != nil {
+		_ = os.Remove(tmp.Name())
+		revertSnapshot(absPath, current)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("无法恢复版本: %v", err))
+		return
+	}
+	log.Printf("已恢复历史版本: %s <- %s", idx.Path, v.ID)
+	writeJSON(w, http.StatusOK, SuccessResponse{Message: "版本恢复成功", Data: v})
+}